@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-notify/model"
+)
+
+const (
+	headerName = "X-Gotify-Key"
+	// 令牌的最后使用时间只在超过该间隔后才写回数据库，避免每个请求都写库
+	lastUsedUpdateInterval = 5 * time.Minute
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByToken(token string) (*model.Application, error)
+	UpdateApplicationTokenLastUsed(token string, t *time.Time) error
+	GetApplicationUserIDs(appID uint) ([]uint, error)
+	GetClientByToken(token string) (*model.Client, error)
+	UpdateClientTokensLastUsed(tokens []string, t *time.Time) error
+	GetUserByName(name string) (*model.User, error)
+	GetUserByID(id uint) (*model.User, error)
+}
+
+// Auth is the provider for authentication middleware.
+type Auth struct {
+	DB Database
+}
+
+// authenticate 返回值：authenticated 凭证是否有效，success 是否允许访问，userID 凭证所属的用户
+type authenticate func(tokenID string, user *model.User) (authenticated, success bool, userID uint, err error)
+
+// RequireAdmin returns a gin middleware which requires a client token or basic authentication header to be supplied
+// with the request. Also the authenticated user must be an administrator.
+func (a *Auth) RequireAdmin() gin.HandlerFunc {
+	return a.requireToken(func(tokenID string, user *model.User) (bool, bool, uint, error) {
+		if user != nil {
+			return true, user.Admin, user.ID, nil
+		}
+		client, err := a.clientByToken(tokenID)
+		if err != nil || client == nil {
+			return false, false, 0, err
+		}
+		owner, err := a.DB.GetUserByID(client.UserID)
+		if err != nil || owner == nil {
+			return false, false, client.UserID, err
+		}
+		return true, owner.Admin, client.UserID, nil
+	})
+}
+
+// RequireClient returns a gin middleware which requires a client token or basic authentication header to be supplied
+// with the request.
+func (a *Auth) RequireClient() gin.HandlerFunc {
+	return a.requireToken(func(tokenID string, user *model.User) (bool, bool, uint, error) {
+		if user != nil {
+			return true, true, user.ID, nil
+		}
+		client, err := a.clientByToken(tokenID)
+		if err != nil || client == nil {
+			return false, false, 0, err
+		}
+		return true, true, client.UserID, nil
+	})
+}
+
+// RequireApplicationToken returns a gin middleware which requires an application token to be supplied with the request.
+func (a *Auth) RequireApplicationToken() gin.HandlerFunc {
+	return a.requireToken(func(tokenID string, user *model.User) (bool, bool, uint, error) {
+		if user != nil {
+			// 用户名密码只能用于管理，不能用于发送消息
+			return true, false, 0, nil
+		}
+		app, err := a.DB.GetApplicationByToken(tokenID)
+		if err != nil || app == nil {
+			return false, false, 0, err
+		}
+		now := time.Now()
+		if app.LastUsed == nil || app.LastUsed.Add(lastUsedUpdateInterval).Before(now) {
+			if err := a.DB.UpdateApplicationTokenLastUsed(tokenID, &now); err != nil {
+				return false, false, 0, err
+			}
+		}
+		// 应用与用户是多对多关系，第一个关联的用户为应用的创建者
+		userIDs, err := a.DB.GetApplicationUserIDs(app.ID)
+		if err != nil {
+			return false, false, 0, err
+		}
+		var userID uint
+		if len(userIDs) > 0 {
+			userID = userIDs[0]
+		}
+		return true, true, userID, nil
+	})
+}
+
+// clientByToken 查找客户端并在需要时刷新其最后使用时间
+func (a *Auth) clientByToken(tokenID string) (*model.Client, error) {
+	if tokenID == "" {
+		return nil, nil
+	}
+	client, err := a.DB.GetClientByToken(tokenID)
+	if err != nil || client == nil {
+		return nil, err
+	}
+	now := time.Now()
+	if client.LastUsed == nil || client.LastUsed.Add(lastUsedUpdateInterval).Before(now) {
+		if err := a.DB.UpdateClientTokensLastUsed([]string{tokenID}, &now); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (a *Auth) tokenFromQueryOrHeader(ctx *gin.Context) string {
+	if token := a.tokenFromQuery(ctx); token != "" {
+		return token
+	} else if token := a.tokenFromXGotifyHeader(ctx); token != "" {
+		return token
+	} else if token := a.tokenFromAuthorizationHeader(ctx); token != "" {
+		return token
+	}
+	return ""
+}
+
+func (a *Auth) tokenFromQuery(ctx *gin.Context) string {
+	return ctx.Request.URL.Query().Get("token")
+}
+
+func (a *Auth) tokenFromXGotifyHeader(ctx *gin.Context) string {
+	return ctx.Request.Header.Get(headerName)
+}
+
+func (a *Auth) tokenFromAuthorizationHeader(ctx *gin.Context) string {
+	const prefix = "Bearer "
+
+	authHeader := ctx.Request.Header.Get("Authorization")
+	if len(authHeader) < len(prefix) || !strings.EqualFold(prefix, authHeader[:len(prefix)]) {
+		return ""
+	}
+
+	return authHeader[len(prefix):]
+}
+
+func (a *Auth) userFromBasicAuth(ctx *gin.Context) (*model.User, error) {
+	if name, pass, ok := ctx.Request.BasicAuth(); ok {
+		if user, err := a.DB.GetUserByName(name); err != nil {
+			return nil, err
+		} else if user != nil && ComparePassword(user.Pass, []byte(pass)) {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (a *Auth) requireToken(auth authenticate) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := a.tokenFromQueryOrHeader(ctx)
+		user, err := a.userFromBasicAuth(ctx)
+		if err != nil {
+			ctx.AbortWithError(500, errors.New("an error occurred while authenticating user"))
+			return
+		}
+
+		if user != nil || token != "" {
+			authenticated, ok, userID, err := auth(token, user)
+			if err != nil {
+				ctx.AbortWithError(500, errors.New("an error occurred while authenticating user"))
+				return
+			} else if ok {
+				RegisterAuthentication(ctx, user, userID, token)
+				ctx.Next()
+				return
+			} else if authenticated {
+				ctx.AbortWithError(403, errors.New("you are not allowed to access this api"))
+				return
+			}
+		}
+		ctx.AbortWithError(401, errors.New("you need to provide a valid access token or user credentials to access this api"))
+	}
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go-notify/model"
+)
+
+type fakeDatabase struct {
+	users       []*model.User
+	apps        []*model.Application
+	appUsers    map[uint][]uint
+	clients     []*model.Client
+	usedTokens  []string
+	appLastUsed *time.Time
+}
+
+func (d *fakeDatabase) GetApplicationByToken(token string) (*model.Application, error) {
+	for _, app := range d.apps {
+		if app.Token == token {
+			return app, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *fakeDatabase) UpdateApplicationTokenLastUsed(token string, t *time.Time) error {
+	d.appLastUsed = t
+	return nil
+}
+
+func (d *fakeDatabase) GetApplicationUserIDs(appID uint) ([]uint, error) {
+	return d.appUsers[appID], nil
+}
+
+func (d *fakeDatabase) GetClientByToken(token string) (*model.Client, error) {
+	for _, client := range d.clients {
+		if client.Token == token {
+			return client, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *fakeDatabase) UpdateClientTokensLastUsed(tokens []string, t *time.Time) error {
+	d.usedTokens = append(d.usedTokens, tokens...)
+	return nil
+}
+
+func (d *fakeDatabase) GetUserByName(name string) (*model.User, error) {
+	for _, user := range d.users {
+		if user.Name == name {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *fakeDatabase) GetUserByID(id uint) (*model.User, error) {
+	for _, user := range d.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func newFakeDatabase() *fakeDatabase {
+	return &fakeDatabase{
+		users: []*model.User{
+			{ID: 1, Name: "admin", Pass: CreatePassword("pw", 4), Admin: true},
+			{ID: 2, Name: "normal", Pass: CreatePassword("pw", 4)},
+		},
+		apps:     []*model.Application{{ID: 5, Token: "Aapp"}},
+		appUsers: map[uint][]uint{5: {2, 1}},
+		clients: []*model.Client{
+			{ID: 1, Token: "Cadmin", UserID: 1},
+			{ID: 2, Token: "Cnormal", UserID: 2},
+		},
+	}
+}
+
+func performRequest(handler gin.HandlerFunc, prepare func(req *http.Request)) (int, *gin.Context) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	prepare(ctx.Request)
+	handler(ctx)
+	if ctx.IsAborted() {
+		return ctx.Writer.Status(), ctx
+	}
+	return http.StatusOK, ctx
+}
+
+func TestRequireClient(t *testing.T) {
+	db := newFakeDatabase()
+	a := &Auth{DB: db}
+
+	status, ctx := performRequest(a.RequireClient(), func(req *http.Request) {
+		req.Header.Set("X-Gotify-Key", "Cnormal")
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, uint(2), GetUserID(ctx))
+	assert.Equal(t, "Cnormal", GetTokenID(ctx))
+	assert.Equal(t, []string{"Cnormal"}, db.usedTokens)
+
+	status, ctx = performRequest(a.RequireClient(), func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer Cadmin")
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, uint(1), GetUserID(ctx))
+
+	status, _ = performRequest(a.RequireClient(), func(req *http.Request) {
+		req.URL.RawQuery = "token=Aapp"
+	})
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = performRequest(a.RequireClient(), func(req *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestRequireClient_basicAuth(t *testing.T) {
+	a := &Auth{DB: newFakeDatabase()}
+
+	status, ctx := performRequest(a.RequireClient(), func(req *http.Request) {
+		req.SetBasicAuth("normal", "pw")
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, uint(2), GetUserID(ctx))
+	assert.Equal(t, "", GetTokenID(ctx))
+
+	status, _ = performRequest(a.RequireClient(), func(req *http.Request) {
+		req.SetBasicAuth("normal", "wrong")
+	})
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestRequireAdmin(t *testing.T) {
+	a := &Auth{DB: newFakeDatabase()}
+
+	status, _ := performRequest(a.RequireAdmin(), func(req *http.Request) {
+		req.Header.Set("X-Gotify-Key", "Cadmin")
+	})
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _ = performRequest(a.RequireAdmin(), func(req *http.Request) {
+		req.Header.Set("X-Gotify-Key", "Cnormal")
+	})
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _ = performRequest(a.RequireAdmin(), func(req *http.Request) {
+		req.SetBasicAuth("admin", "pw")
+	})
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestRequireApplicationToken(t *testing.T) {
+	db := newFakeDatabase()
+	a := &Auth{DB: db}
+
+	status, ctx := performRequest(a.RequireApplicationToken(), func(req *http.Request) {
+		req.URL.RawQuery = "token=Aapp"
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, uint(2), GetUserID(ctx))
+	assert.Equal(t, "Aapp", GetTokenID(ctx))
+	assert.NotNil(t, db.appLastUsed)
+
+	status, _ = performRequest(a.RequireApplicationToken(), func(req *http.Request) {
+		req.Header.Set("X-Gotify-Key", "Cnormal")
+	})
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = performRequest(a.RequireApplicationToken(), func(req *http.Request) {
+		req.SetBasicAuth("admin", "pw")
+	})
+	assert.Equal(t, http.StatusForbidden, status)
+}
@@ -1,6 +1,11 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 // CreatePassword returns a hashed version of the given password.
 func CreatePassword(pw string, strength int) []byte {
@@ -15,3 +20,30 @@ func CreatePassword(pw string, strength int) []byte {
 func ComparePassword(hashedPassword, password []byte) bool {
 	return bcrypt.CompareHashAndPassword(hashedPassword, password) == nil
 }
+
+// maxPasswordBytes is the maximum password length bcrypt can handle.
+const maxPasswordBytes = 72
+
+// PasswordPolicy describes the requirements for user passwords and how they are hashed.
+type PasswordPolicy struct {
+	// MinLength is the minimum amount of characters a password must have.
+	MinLength int
+	// Strength is the bcrypt cost used for hashing.
+	Strength int
+}
+
+// Validate returns an error describing why the password does not satisfy the policy.
+func (p PasswordPolicy) Validate(pw string) error {
+	if utf8.RuneCountInString(pw) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	if len(pw) > maxPasswordBytes {
+		return fmt.Errorf("password must not be longer than %d bytes", maxPasswordBytes)
+	}
+	return nil
+}
+
+// Hash returns the hashed password using the configured strength.
+func (p PasswordPolicy) Hash(pw string) []byte {
+	return CreatePassword(pw, p.Strength)
+}
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicy_validate(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, Strength: 4}
+
+	assert.EqualError(t, policy.Validate("short"), "password must be at least 8 characters long")
+	assert.NoError(t, policy.Validate("12345678"))
+	// 长度按字符计算，而不是字节
+	assert.NoError(t, policy.Validate("密码密码密码密码"))
+	assert.Error(t, policy.Validate("密码密码密码密"))
+	assert.NoError(t, policy.Validate(strings.Repeat("x", maxPasswordBytes)))
+	assert.EqualError(t, policy.Validate(strings.Repeat("x", maxPasswordBytes+1)), "password must not be longer than 72 bytes")
+}
+
+func TestPasswordPolicy_hash(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, Strength: 5}
+
+	hashed := policy.Hash("correct horse")
+	assert.True(t, ComparePassword(hashed, []byte("correct horse")))
+	assert.False(t, ComparePassword(hashed, []byte("wrong horse")))
+	assert.True(t, strings.HasPrefix(string(hashed), "$2a$05$"), "the configured strength is used")
+}
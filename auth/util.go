@@ -5,6 +5,13 @@ import (
 	"go-notify/model"
 )
 
+// RegisterAuthentication registers the user id, user and or token.
+func RegisterAuthentication(ctx *gin.Context, user *model.User, userID uint, tokenID string) {
+	ctx.Set("user", user)
+	ctx.Set("userid", userID)
+	ctx.Set("tokenid", tokenID)
+}
+
 func TryGetUserID(ctx *gin.Context) uint {
 	user := ctx.MustGet("user").(*model.User)
 	if user == nil {
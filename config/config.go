@@ -0,0 +1,293 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of all environment variables which override the config file.
+// The variable name is the upper-cased yaml path joined by underscores, e.g. GONOTIFY_SERVER_PORT.
+const EnvPrefix = "GONOTIFY"
+
+// Configuration is stuff that can be configured externally per env variables or config file (config.yml).
+type Configuration struct {
+	Server struct {
+		ListenAddr string `yaml:"listenaddr"`
+		Port       int    `yaml:"port"`
+		SSL        struct {
+			Enabled         bool   `yaml:"enabled"`
+			RedirectToHTTPS bool   `yaml:"redirecttohttps"`
+			ListenAddr      string `yaml:"listenaddr"`
+			Port            int    `yaml:"port"`
+			CertFile        string `yaml:"certfile"`
+			CertKey         string `yaml:"certkey"`
+		} `yaml:"ssl"`
+		// 关闭服务时等待正在处理的请求完成的最长时间
+		ShutdownTimeoutSeconds int `yaml:"shutdowntimeoutseconds"`
+		Stream                 struct {
+			PingPeriodSeconds  int      `yaml:"pingperiodseconds"`
+			PongTimeoutSeconds int      `yaml:"pongtimeoutseconds"`
+			AllowedOrigins     []string `yaml:"allowedorigins"`
+			// 每个连接的发送队列长度及队列已满时的处理策略（drop-oldest、drop-newest、disconnect）
+			QueueSize      int    `yaml:"queuesize"`
+			OverflowPolicy string `yaml:"overflowpolicy"`
+			// 客户端通过 WebSocket 发送的单帧命令的最大字节数
+			ReadLimit int64 `yaml:"readlimit"`
+		} `yaml:"stream"`
+	} `yaml:"server"`
+	Database struct {
+		Path string `yaml:"path"`
+	} `yaml:"database"`
+	// 定期删除过期消息和超出应用保留数量的消息
+	Retention struct {
+		IntervalSeconds int `yaml:"intervalseconds"`
+		BatchSize       int `yaml:"batchsize"`
+	} `yaml:"retention"`
+	// 带有相同 Idempotency-Key 请求头的创建消息请求在这段时间内只处理一次，为 0 时忽略该请求头
+	Idempotency struct {
+		WindowSeconds int `yaml:"windowseconds"`
+	} `yaml:"idempotency"`
+	// 发送 webhook 请求的超时时间、最大尝试次数、第一次重试前的等待时间（之后每次翻倍）以及投递记录的保留天数。
+	// webhook 和 Web Push 默认不能访问内部网络的地址，AllowedHosts 列出允许访问的主机名、IP 地址或 CIDR 网段
+	Webhook struct {
+		TimeoutSeconds   int      `yaml:"timeoutseconds"`
+		MaxAttempts      int      `yaml:"maxattempts"`
+		BackoffSeconds   int      `yaml:"backoffseconds"`
+		LogRetentionDays int      `yaml:"logretentiondays"`
+		AllowedHosts     []string `yaml:"allowedhosts"`
+	} `yaml:"webhook"`
+	// 发送邮件通知的 SMTP 服务器，Host 为空时不发送邮件。Security 为 starttls、tls 或 none，
+	// 在 BatchSeconds 内到达的消息合并为一封邮件，临时错误最多尝试 MaxAttempts 次
+	SMTP struct {
+		Host           string `yaml:"host"`
+		Port           int    `yaml:"port"`
+		Username       string `yaml:"username"`
+		Password       string `yaml:"password"`
+		From           string `yaml:"from"`
+		Security       string `yaml:"security"`
+		TimeoutSeconds int    `yaml:"timeoutseconds"`
+		BatchSeconds   int    `yaml:"batchseconds"`
+		MaxAttempts    int    `yaml:"maxattempts"`
+		BackoffSeconds int    `yaml:"backoffseconds"`
+	} `yaml:"smtp"`
+	// 浏览器推送（Web Push）。Subject 是推送服务联系管理员的 mailto: 或 https: 地址，部分推送服务要求设置
+	WebPush struct {
+		Subject        string `yaml:"subject"`
+		TimeoutSeconds int    `yaml:"timeoutseconds"`
+	} `yaml:"webpush"`
+	DefaultUser struct {
+		Name string `yaml:"name"`
+		Pass string `yaml:"pass"`
+	} `yaml:"defaultuser"`
+	PassStrength      int    `yaml:"passstrength"`
+	PassMinLength     int    `yaml:"passminlength"`
+	UploadedImagesDir string `yaml:"uploadedimagesdir"`
+}
+
+// Default returns the configuration used when neither the config file nor the environment set a value.
+func Default() *Configuration {
+	conf := new(Configuration)
+	conf.Server.Port = 80
+	conf.Server.SSL.Port = 443
+	conf.Server.ShutdownTimeoutSeconds = 10
+	conf.Server.Stream.PingPeriodSeconds = 45
+	conf.Server.Stream.PongTimeoutSeconds = 60
+	conf.Server.Stream.QueueSize = 64
+	conf.Server.Stream.OverflowPolicy = "drop-oldest"
+	conf.Server.Stream.ReadLimit = 4096
+	conf.Database.Path = "data/go-notify.db"
+	conf.Retention.IntervalSeconds = 60
+	conf.Retention.BatchSize = 500
+	conf.Idempotency.WindowSeconds = 24 * 60 * 60
+	conf.Webhook.TimeoutSeconds = 10
+	conf.Webhook.MaxAttempts = 8
+	conf.Webhook.BackoffSeconds = 30
+	conf.Webhook.LogRetentionDays = 7
+	conf.SMTP.Port = 587
+	conf.SMTP.Security = "starttls"
+	conf.SMTP.TimeoutSeconds = 10
+	conf.SMTP.BatchSeconds = 30
+	conf.SMTP.MaxAttempts = 5
+	conf.SMTP.BackoffSeconds = 60
+	conf.WebPush.TimeoutSeconds = 10
+	conf.DefaultUser.Name = "admin"
+	conf.DefaultUser.Pass = "admin"
+	conf.PassStrength = 10
+	conf.PassMinLength = 8
+	conf.UploadedImagesDir = "data/images"
+	return conf
+}
+
+// Load reads the config file at path (a missing file is not an error) and applies the environment overrides.
+func Load(path string) (*Configuration, error) {
+	conf := Default()
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := yaml.Unmarshal(content, conf); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", path, err)
+			}
+		}
+	}
+	if err := applyEnv(EnvPrefix, reflect.ValueOf(conf).Elem(), os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// validate 检查配置的取值范围，避免错误的配置在启动后才导致服务崩溃
+func (c *Configuration) validate() error {
+	stream := c.Server.Stream
+	switch stream.OverflowPolicy {
+	case "drop-oldest", "drop-newest", "disconnect":
+	default:
+		return fmt.Errorf("server.stream.overflowpolicy: unknown policy %q, must be drop-oldest, drop-newest or disconnect", stream.OverflowPolicy)
+	}
+	if stream.QueueSize < 1 {
+		return positiveError("server.stream.queuesize", stream.QueueSize)
+	}
+	if stream.ReadLimit < 1 {
+		return positiveError("server.stream.readlimit", stream.ReadLimit)
+	}
+	if stream.PingPeriodSeconds < 1 {
+		return positiveError("server.stream.pingperiodseconds", stream.PingPeriodSeconds)
+	}
+	if stream.PongTimeoutSeconds < 1 {
+		return positiveError("server.stream.pongtimeoutseconds", stream.PongTimeoutSeconds)
+	}
+	// 超时不大于 ping 的间隔时，客户端来不及回复 pong 连接就会被关闭
+	if stream.PongTimeoutSeconds <= stream.PingPeriodSeconds {
+		return fmt.Errorf("server.stream.pongtimeoutseconds: must be greater than server.stream.pingperiodseconds (%d), got %d",
+			stream.PingPeriodSeconds, stream.PongTimeoutSeconds)
+	}
+	// 超出范围时 bcrypt 会使用默认强度或返回错误，设置不会生效
+	if c.PassStrength < bcrypt.MinCost || c.PassStrength > bcrypt.MaxCost {
+		return fmt.Errorf("passstrength: must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, c.PassStrength)
+	}
+	if c.Retention.IntervalSeconds < 1 {
+		return positiveError("retention.intervalseconds", c.Retention.IntervalSeconds)
+	}
+	if c.Retention.BatchSize < 1 {
+		return positiveError("retention.batchsize", c.Retention.BatchSize)
+	}
+	if c.Webhook.MaxAttempts < 1 {
+		return positiveError("webhook.maxattempts", c.Webhook.MaxAttempts)
+	}
+	if c.Webhook.BackoffSeconds < 1 {
+		return positiveError("webhook.backoffseconds", c.Webhook.BackoffSeconds)
+	}
+	for _, host := range c.Webhook.AllowedHosts {
+		if _, _, err := net.ParseCIDR(host); strings.Contains(host, "/") && err != nil {
+			return fmt.Errorf("webhook.allowedhosts: invalid network %q", host)
+		}
+	}
+	return c.validateSMTP()
+}
+
+// validateSMTP 检查邮件发送的配置，没有设置 SMTP 服务器时不发送邮件，不检查其它配置
+func (c *Configuration) validateSMTP() error {
+	smtp := c.SMTP
+	if smtp.Host == "" {
+		return nil
+	}
+	switch smtp.Security {
+	case "starttls", "tls":
+	case "none":
+		// 不加密的连接会泄露密码
+		if smtp.Username != "" {
+			return errors.New("smtp.username: authentication requires starttls or tls security")
+		}
+	default:
+		return fmt.Errorf("smtp.security: unknown security %q, must be starttls, tls or none", smtp.Security)
+	}
+	if smtp.MaxAttempts < 1 {
+		return positiveError("smtp.maxattempts", smtp.MaxAttempts)
+	}
+	if smtp.BackoffSeconds < 1 {
+		return positiveError("smtp.backoffseconds", smtp.BackoffSeconds)
+	}
+	if smtp.BatchSeconds < 0 {
+		return fmt.Errorf("smtp.batchseconds: must not be negative, got %d", smtp.BatchSeconds)
+	}
+	return nil
+}
+
+func positiveError(name string, value interface{}) error {
+	return fmt.Errorf("%s: must be positive, got %v", name, value)
+}
+
+// applyEnv 递归遍历结构体字段，按 yaml 路径拼出环境变量名并覆盖对应的值
+func applyEnv(prefix string, v reflect.Value, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		envName := prefix + "_" + strings.ToUpper(name)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(envName, fv, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok := lookup(envName)
+		if !ok {
+			continue
+		}
+		if err := setValue(fv, raw); err != nil {
+			return fmt.Errorf("environment variable %s: %w", envName, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported slice type %s", v.Type())
+		}
+		// 列表使用逗号分隔
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad_defaultsWithoutFile(t *testing.T) {
+	conf, err := Load(filepath.Join(t.TempDir(), "missing.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), conf)
+}
+
+func TestLoad_fileAndEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	content := `
+server:
+  port: 8080
+  ssl:
+    enabled: true
+    certfile: /etc/cert.pem
+  stream:
+    allowedorigins:
+      - ".+\\.example\\.com"
+database:
+  path: /var/lib/go-notify/data.db
+defaultuser:
+  name: root
+`
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	t.Setenv("GONOTIFY_SERVER_PORT", "9090")
+	t.Setenv("GONOTIFY_DEFAULTUSER_PASS", "secret")
+	t.Setenv("GONOTIFY_SERVER_STREAM_ALLOWEDORIGINS", "a\\.com, b\\.com")
+
+	conf, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 9090, conf.Server.Port)
+	assert.True(t, conf.Server.SSL.Enabled)
+	assert.Equal(t, "/etc/cert.pem", conf.Server.SSL.CertFile)
+	assert.Equal(t, 443, conf.Server.SSL.Port)
+	assert.Equal(t, []string{"a\\.com", "b\\.com"}, conf.Server.Stream.AllowedOrigins)
+	assert.Equal(t, "/var/lib/go-notify/data.db", conf.Database.Path)
+	assert.Equal(t, "root", conf.DefaultUser.Name)
+	assert.Equal(t, "secret", conf.DefaultUser.Pass)
+}
+
+func TestLoad_invalidEnv(t *testing.T) {
+	t.Setenv("GONOTIFY_SERVER_PORT", "eighty")
+	_, err := Load("")
+	assert.Error(t, err)
+}
+
+func TestLoad_invalidValues(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+		err   string
+	}{
+		{"GONOTIFY_SERVER_STREAM_OVERFLOWPOLICY", "drop-all", `server.stream.overflowpolicy: unknown policy "drop-all", must be drop-oldest, drop-newest or disconnect`},
+		{"GONOTIFY_SERVER_STREAM_QUEUESIZE", "0", "server.stream.queuesize: must be positive, got 0"},
+		{"GONOTIFY_SERVER_STREAM_READLIMIT", "-1", "server.stream.readlimit: must be positive, got -1"},
+		{"GONOTIFY_SERVER_STREAM_PINGPERIODSECONDS", "0", "server.stream.pingperiodseconds: must be positive, got 0"},
+		{"GONOTIFY_SERVER_STREAM_PONGTIMEOUTSECONDS", "-1", "server.stream.pongtimeoutseconds: must be positive, got -1"},
+		{"GONOTIFY_SERVER_STREAM_PONGTIMEOUTSECONDS", "45", "server.stream.pongtimeoutseconds: must be greater than server.stream.pingperiodseconds (45), got 45"},
+		{"GONOTIFY_PASSSTRENGTH", "3", "passstrength: must be between 4 and 31, got 3"},
+		{"GONOTIFY_PASSSTRENGTH", "32", "passstrength: must be between 4 and 31, got 32"},
+		{"GONOTIFY_RETENTION_INTERVALSECONDS", "0", "retention.intervalseconds: must be positive, got 0"},
+		{"GONOTIFY_RETENTION_BATCHSIZE", "-5", "retention.batchsize: must be positive, got -5"},
+		{"GONOTIFY_WEBHOOK_MAXATTEMPTS", "0", "webhook.maxattempts: must be positive, got 0"},
+		{"GONOTIFY_WEBHOOK_BACKOFFSECONDS", "-30", "webhook.backoffseconds: must be positive, got -30"},
+		{"GONOTIFY_WEBHOOK_ALLOWEDHOSTS", "hooks.internal, 10.0.0.0/33", `webhook.allowedhosts: invalid network "10.0.0.0/33"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			_, err := Load("")
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestLoad_invalidSMTP(t *testing.T) {
+	tests := []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"GONOTIFY_SMTP_SECURITY": "ssl"}, `smtp.security: unknown security "ssl", must be starttls, tls or none`},
+		{map[string]string{"GONOTIFY_SMTP_SECURITY": "none", "GONOTIFY_SMTP_USERNAME": "mailer"}, "smtp.username: authentication requires starttls or tls security"},
+		{map[string]string{"GONOTIFY_SMTP_MAXATTEMPTS": "0"}, "smtp.maxattempts: must be positive, got 0"},
+		{map[string]string{"GONOTIFY_SMTP_BACKOFFSECONDS": "-1"}, "smtp.backoffseconds: must be positive, got -1"},
+		{map[string]string{"GONOTIFY_SMTP_BATCHSECONDS": "-1"}, "smtp.batchseconds: must not be negative, got -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err, func(t *testing.T) {
+			t.Setenv("GONOTIFY_SMTP_HOST", "smtp.example.com")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load("")
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+
+	// 没有设置 SMTP 服务器时不发送邮件
+	t.Setenv("GONOTIFY_SMTP_SECURITY", "ssl")
+	_, err := Load("")
+	assert.NoError(t, err)
+	t.Setenv("GONOTIFY_SMTP_HOST", "smtp.example.com")
+	t.Setenv("GONOTIFY_SMTP_SECURITY", "none")
+	_, err = Load("")
+	assert.NoError(t, err, "sending without authentication over an unencrypted connection is allowed")
+}
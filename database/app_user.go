@@ -35,3 +35,14 @@ func (d *GormDatabase) IsUserAlloweOpMessage(userID uint, msgID []uint) (bool, e
 	}
 	return true, nil
 }
+
+// GetApplicationUserIDs returns the ids of all users linked to the application, the creator comes first.
+func (d *GormDatabase) GetApplicationUserIDs(appID uint) ([]uint, error) {
+	var userIDs []uint
+	err := d.DB.Table("app_users").Where("app_id = ? AND deleted_at IS NULL", appID).
+		Order("created_at ASC, user_id ASC").Pluck("user_id", &userIDs).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return userIDs, err
+}
@@ -38,22 +38,67 @@ func (d *GormDatabase) CreateApplication(application *model.Application) error {
 	return d.DB.Create(application).Error
 }
 
+// CreateApplicationForUser creates an application and links it to its creator.
+func (d *GormDatabase) CreateApplicationForUser(application *model.Application, userID uint) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(application).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		return tx.Create(&model.AppUser{AppID: application.ID, UserID: userID, CreateAt: &now}).Error
+	})
+}
+
 // DeleteApplicationByID deletes an application by its id.
 func (d *GormDatabase) DeleteApplicationByID(id uint) error {
 	d.DeleteMessagesByApplication(id)
+	d.DB.Where("application_id = ?", id).Delete(&model.ScheduledMessage{})
+	d.DB.Where("application_id = ?", id).Delete(&model.IdempotencyKey{})
+	d.DB.Where("application_id = ?", id).Delete(&model.ApplicationPriority{})
+	d.DB.Where("application_id = ?", id).Delete(&model.UnifiedPushRegistration{})
+	d.DB.Where("application_id = ?", id).Delete(&model.UserDigestApplication{})
+	// sqlite 的外键约束只对开启了 foreign_keys 的连接生效，这里手动删除关联关系
+	d.DB.Where("app_id = ?", id).Delete(&model.AppUser{})
 	return d.DB.Where("id = ?", id).Delete(&model.Application{}).Error
 }
 
 // GetApplicationsByUser returns all applications from a user.
 func (d *GormDatabase) GetApplicationsByUser(userID uint) ([]*model.Application, error) {
 	var apps []*model.Application
-	err := d.DB.Where("user_id = ?", userID).Order("id ASC").Find(&apps).Error
+	err := d.DB.Joins("JOIN app_users ON app_users.app_id = applications.id").
+		Where("app_users.user_id = ? AND app_users.deleted_at IS NULL", userID).
+		Order("applications.id ASC").Find(&apps).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return apps, err
+}
+
+// GetUnmanagedApplicationsByUser returns the applications of a user except the ones the server manages,
+// see IsManagedApplication.
+func (d *GormDatabase) GetUnmanagedApplicationsByUser(userID uint) ([]*model.Application, error) {
+	var apps []*model.Application
+	err := d.DB.Joins("JOIN app_users ON app_users.app_id = applications.id").
+		Where("app_users.user_id = ? AND app_users.deleted_at IS NULL", userID).
+		Where("applications.id NOT IN (" + managedApplicationIDs + ")").
+		Order("applications.id ASC").Find(&apps).Error
 	if err == gorm.ErrRecordNotFound {
 		err = nil
 	}
 	return apps, err
 }
 
+// IsManagedApplication returns true if the server manages the application,
+// that is the application of a UnifiedPush registration or the digest application of a user.
+func (d *GormDatabase) IsManagedApplication(id uint) (bool, error) {
+	var count int
+	err := d.DB.Table("applications").Where("id = ? AND id IN ("+managedApplicationIDs+")", id).Count(&count).Error
+	return count > 0, err
+}
+
+// 由服务器管理的应用：UnifiedPush 注册的应用和用户的摘要应用
+const managedApplicationIDs = "SELECT application_id FROM unified_push_registrations UNION SELECT application_id FROM user_digest_applications"
+
 // UpdateApplication updates an application.
 func (d *GormDatabase) UpdateApplication(app *model.Application) error {
 	return d.DB.Save(app).Error
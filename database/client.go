@@ -48,8 +48,14 @@ func (d *GormDatabase) GetClientsByUser(userID uint) ([]*model.Client, error) {
 	return clients, err
 }
 
-// DeleteClientByID deletes a client by its id.
+// DeleteClientByID deletes a client, its web push subscription and its UnifiedPush registrations by its id.
 func (d *GormDatabase) DeleteClientByID(id uint) error {
+	d.DeleteWebPushSubscriptionByClient(id)
+	var registrations []*model.UnifiedPushRegistration
+	d.DB.Where("client_id = ?", id).Find(&registrations)
+	for _, registration := range registrations {
+		d.DeleteApplicationByID(registration.ApplicationID)
+	}
 	return d.DB.Where("id = ?", id).Delete(&model.Client{}).Error
 }
 
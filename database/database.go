@@ -10,15 +10,11 @@ import (
 )
 
 type GormDatabase struct {
-	DB *gorm.DB
+	DB    *gorm.DB
+	fts   bool // 是否可以使用 FTS5 全文索引搜索消息
+	json1 bool // 是否可以使用 JSON1 函数查询 Extras
 }
 
-const (
-	defaultUser     = "admin"
-	defaultPass     = "admin"
-	defaultStrength = 10
-)
-
 func (d *GormDatabase) Close() {
 	d.DB.Close()
 }
@@ -42,6 +38,7 @@ func initAppUsersTable(db *gorm.DB) error {
 		user_id INTEGER NOT NULL,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,  -- 对应 autoCreateTime
 		deleted_at DATETIME,
+		last_read_id INTEGER NOT NULL DEFAULT 0,
 		PRIMARY KEY (app_id, user_id),
 		FOREIGN KEY (app_id) REFERENCES applications(id) ON DELETE CASCADE,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
@@ -51,10 +48,16 @@ func initAppUsersTable(db *gorm.DB) error {
 	if err := db.Exec(createTableSQL).Error; err != nil {
 		return err
 	}
+	// 旧版本创建的表没有已读位置
+	if !db.Dialect().HasColumn("app_users", "last_read_id") {
+		return db.Exec("ALTER TABLE app_users ADD COLUMN last_read_id INTEGER NOT NULL DEFAULT 0").Error
+	}
 	return nil
 }
 
-func NewGormDatabase(dataPath string) (*GormDatabase, error) {
+// NewGormDatabase opens the sqlite database at dataPath, migrates the schema and creates
+// the default admin user if there is no user yet.
+func NewGormDatabase(dataPath, defaultUser, defaultPass string, strength int) (*GormDatabase, error) {
 	createDirectory(dataPath)
 	db, err := gorm.Open("sqlite3", dataPath)
 	if err != nil {
@@ -65,15 +68,27 @@ func NewGormDatabase(dataPath string) (*GormDatabase, error) {
 	if err := initAppUsersTable(db); err != nil {
 		return nil, err
 	}
-	if err := db.AutoMigrate(new(model.User), new(model.Application), new(model.Message), new(model.Client), new(model.PluginConf)).Error; err != nil {
+	if err := db.AutoMigrate(new(model.User), new(model.Application), new(model.Message), new(model.Client), new(model.PluginConf), new(model.MessageRead),
+		new(model.ScheduledMessage), new(model.IdempotencyKey),
+		new(model.NotificationRules), new(model.ApplicationPriority), new(model.DeferredNotification), new(model.Webhook),
+		new(model.WebhookDelivery), new(model.EmailSettings), new(model.EmailNotification), new(model.VAPIDKey),
+		new(model.WebPushSubscription), new(model.UnifiedPushRegistration), new(model.UserDigestApplication)).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Exec(createReplaceKeyIndex).Error; err != nil {
+		return nil, err
+	}
+	fts, err := initMessagesFTS(db)
+	if err != nil {
 		return nil, err
 	}
 
 	userCount := 0
 	db.Find(new(model.User)).Count(&userCount)
 	if userCount == 0 {
-		db.Create(&model.User{Name: defaultUser, Pass: auth.CreatePassword(defaultPass, defaultStrength), Admin: true})
+		db.Create(&model.User{Name: defaultUser, Pass: auth.CreatePassword(defaultPass, strength), Admin: true})
 	}
 
-	return &GormDatabase{DB: db}, nil
+	return &GormDatabase{DB: db, fts: fts, json1: compileOptionUsed(db, "ENABLE_JSON1")}, nil
 }
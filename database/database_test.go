@@ -5,7 +5,7 @@ import (
 )
 
 func TestDatabase(t *testing.T) {
-	_, err := NewGormDatabase("data/go-notify.db")
+	_, err := NewGormDatabase("data/go-notify.db", "admin", "admin", 10)
 	if err != nil {
 		panic(err)
 	}
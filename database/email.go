@@ -0,0 +1,91 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// GetEmailSettings returns the email settings of the user or nil if the user has none.
+func (d *GormDatabase) GetEmailSettings(userID uint) (*model.EmailSettings, error) {
+	settings := new(model.EmailSettings)
+	err := d.DB.Where("user_id = ?", userID).First(settings).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// GetAllEmailSettings returns the email settings of all users with an email address.
+func (d *GormDatabase) GetAllEmailSettings() ([]*model.EmailSettings, error) {
+	var settings []*model.EmailSettings
+	err := d.DB.Where("address <> ''").Order("user_id ASC").Find(&settings).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return settings, err
+}
+
+// SaveEmailSettings creates or replaces the email settings of the user.
+func (d *GormDatabase) SaveEmailSettings(settings *model.EmailSettings) error {
+	return d.DB.Save(settings).Error
+}
+
+// CreateEmailNotification queues a message to be sent by email.
+func (d *GormDatabase) CreateEmailNotification(notification *model.EmailNotification) error {
+	return d.DB.Create(notification).Error
+}
+
+// GetDueEmailUserIDs returns the ids of all users with an email notification which is due at now.
+func (d *GormDatabase) GetDueEmailUserIDs(now time.Time) ([]uint, error) {
+	var userIDs []uint
+	err := d.DB.Model(&model.EmailNotification{}).Where("julianday(next_attempt_at) <= julianday(?)", now).
+		Order("user_id ASC").Pluck("DISTINCT user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// GetEmailNotificationsByUser returns all queued email notifications of the user, oldest first.
+func (d *GormDatabase) GetEmailNotificationsByUser(userID uint) ([]*model.EmailNotification, error) {
+	var notifications []*model.EmailNotification
+	err := d.DB.Where("user_id = ?", userID).Order("id ASC").Find(&notifications).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return notifications, err
+}
+
+// GetNextEmailNotification returns the email notification which is due next or nil if there is none.
+func (d *GormDatabase) GetNextEmailNotification() (*model.EmailNotification, error) {
+	notification := new(model.EmailNotification)
+	err := d.DB.Order("julianday(next_attempt_at) ASC").First(notification).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return notification, nil
+}
+
+// RescheduleEmailNotifications sets the attempts and the next attempt of the notifications.
+func (d *GormDatabase) RescheduleEmailNotifications(notifications []*model.EmailNotification, attempts int, next time.Time) error {
+	return d.DB.Model(&model.EmailNotification{}).Where("id IN (?)", emailNotificationIDs(notifications)).
+		Updates(map[string]interface{}{"attempts": attempts, "next_attempt_at": next}).Error
+}
+
+// DeleteEmailNotifications deletes the notifications.
+func (d *GormDatabase) DeleteEmailNotifications(notifications []*model.EmailNotification) error {
+	return d.DB.Where("id IN (?)", emailNotificationIDs(notifications)).Delete(&model.EmailNotification{}).Error
+}
+
+func emailNotificationIDs(notifications []*model.EmailNotification) []uint {
+	ids := make([]uint, len(notifications))
+	for i, n := range notifications {
+		ids[i] = n.ID
+	}
+	return ids
+}
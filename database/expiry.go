@@ -0,0 +1,49 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+var timeNow = time.Now
+
+// 日期以带时区的文本保存，使用 julianday 比较以忽略时区差异
+const notExpiredCondition = "(messages.expires_at IS NULL OR julianday(messages.expires_at) > julianday(?))"
+
+// notExpired 排除已过期但还没有被清理的消息
+func notExpired(db *gorm.DB) *gorm.DB {
+	return db.Where(notExpiredCondition, timeNow())
+}
+
+// GetExpiredMessages returns up to limit messages which expired before now, oldest first.
+func (d *GormDatabase) GetExpiredMessages(now time.Time, limit int) ([]*model.Message, error) {
+	var messages []*model.Message
+	err := d.DB.Where("messages.expires_at IS NOT NULL AND julianday(messages.expires_at) <= julianday(?)", now).
+		Order("messages.id ASC").Limit(limit).Find(&messages).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return messages, err
+}
+
+// GetApplicationsWithMessageLimit returns all applications which limit the amount of kept messages.
+func (d *GormDatabase) GetApplicationsWithMessageLimit() ([]*model.Application, error) {
+	var apps []*model.Application
+	err := d.DB.Where("max_messages > 0").Order("id ASC").Find(&apps).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return apps, err
+}
+
+// GetMessagesBeyondLimit returns up to limit messages of the application which are older than the newest keep messages.
+func (d *GormDatabase) GetMessagesBeyondLimit(appID uint, keep, limit int) ([]*model.Message, error) {
+	var messages []*model.Message
+	err := d.DB.Where("application_id = ?", appID).Order("id DESC").Offset(keep).Limit(limit).Find(&messages).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return messages, err
+}
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+func TestExpiredMessages(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	user := &model.User{Name: "expiry"}
+	require.NoError(t, db.CreateUser(user))
+	app := &model.Application{Name: "app", Token: "Aapp", MaxMessages: 1}
+	require.NoError(t, db.CreateApplicationForUser(app, user.ID))
+
+	now := time.Now()
+	// 以其它时区保存的过期时间也能正确比较
+	past := now.Add(-time.Minute).In(time.FixedZone("UTC+8", 8*60*60))
+	future := now.Add(time.Hour)
+	expired := &model.Message{ApplicationID: app.ID, Message: "expired", Date: now, ExpiresAt: &past}
+	valid := &model.Message{ApplicationID: app.ID, Message: "valid", Date: now, ExpiresAt: &future}
+	forever := &model.Message{ApplicationID: app.ID, Message: "forever", Date: now}
+	require.NoError(t, db.CreateMessage(expired))
+	require.NoError(t, db.CreateMessage(valid))
+	require.NoError(t, db.CreateMessage(forever))
+
+	messages, err := db.GetMessagesByUserSince(user.ID, "", 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{forever.ID, valid.ID}, messageIDs(messages))
+	messages, err = db.SearchMessagesByUser(user.ID, "", nil, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{forever.ID, valid.ID}, messageIDs(messages))
+	counts, err := db.CountUnreadMessages(user.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, []*model.ApplicationUnreadCount{{ApplicationID: app.ID, Count: 2}}, counts)
+
+	messages, err = db.GetExpiredMessages(now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{expired.ID}, messageIDs(messages))
+
+	apps, err := db.GetApplicationsWithMessageLimit()
+	require.NoError(t, err)
+	assert.Len(t, apps, 1)
+	messages, err = db.GetMessagesBeyondLimit(app.ID, apps[0].MaxMessages, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{valid.ID, expired.ID}, messageIDs(messages))
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// ReserveIdempotencyKey reserves the key of the application for a request which is about to be processed.
+// If the key was already reserved after since, the existing record is returned together with false instead.
+// Records which are still in progress and were created before abandonedBefore are taken over, the request
+// which reserved them is assumed to be lost.
+func (d *GormDatabase) ReserveIdempotencyKey(appID uint, key string, since, abandonedBefore time.Time) (*model.IdempotencyKey, bool, error) {
+	record := &model.IdempotencyKey{ApplicationID: appID, Key: key, CreatedAt: timeNow()}
+	var existing *model.IdempotencyKey
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		found := new(model.IdempotencyKey)
+		err := tx.Where("application_id = ? AND key = ?", appID, key).First(found).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		if err == nil {
+			if found.CreatedAt.After(since) && (found.Status != 0 || found.CreatedAt.After(abandonedBefore)) {
+				existing = found
+				return nil
+			}
+			// 超出时间窗口或被遗弃的记录，重新占用该键
+			if err := tx.Delete(found).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(record).Error
+	})
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		// 并发的请求抢先占用了该键
+		existing = new(model.IdempotencyKey)
+		err = d.DB.Where("application_id = ? AND key = ?", appID, key).First(existing).Error
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if existing != nil {
+		return existing, false, nil
+	}
+	return record, true, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request which reserved the key.
+func (d *GormDatabase) CompleteIdempotencyKey(id uint, status int, response []byte) error {
+	return d.DB.Model(&model.IdempotencyKey{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"status": status, "response": response}).Error
+}
+
+// DeleteIdempotencyKeyByID deletes a reserved key, e.g. when the request failed and may be retried.
+func (d *GormDatabase) DeleteIdempotencyKeyByID(id uint) error {
+	return d.DB.Where("id = ?", id).Delete(&model.IdempotencyKey{}).Error
+}
+
+// DeleteIdempotencyKeysBefore deletes all keys reserved before t.
+func (d *GormDatabase) DeleteIdempotencyKeysBefore(t time.Time) error {
+	return d.DB.Where("julianday(created_at) < julianday(?)", t).Delete(&model.IdempotencyKey{}).Error
+}
+
+// FindDuplicateMessage returns the newest message of the application with the content hash created after since,
+// or nil if there is none.
+func (d *GormDatabase) FindDuplicateMessage(appID uint, contentHash string, since time.Time) (*model.Message, error) {
+	message := new(model.Message)
+	err := notExpired(d.DB).
+		Where("messages.application_id = ? AND messages.content_hash = ? AND julianday(messages.date) >= julianday(?)", appID, contentHash, since).
+		Order("messages.id DESC").First(message).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
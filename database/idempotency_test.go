@@ -0,0 +1,84 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Now()
+	window, abandoned := now.Add(-time.Hour), now.Add(-time.Minute)
+
+	record, reserved, err := db.ReserveIdempotencyKey(1, "key", window, abandoned)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	// 处理中的请求不能被其它请求占用，其它应用可以使用相同的键
+	existing, reserved, err := db.ReserveIdempotencyKey(1, "key", window, abandoned)
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, record.ID, existing.ID)
+	assert.Equal(t, 0, existing.Status)
+	_, reserved, err = db.ReserveIdempotencyKey(2, "key", window, abandoned)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	require.NoError(t, db.CompleteIdempotencyKey(record.ID, 200, []byte(`{"id":1}`)))
+	existing, reserved, err = db.ReserveIdempotencyKey(1, "key", window, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, 200, existing.Status)
+	assert.Equal(t, []byte(`{"id":1}`), existing.Response)
+
+	// 超出时间窗口后可以重新占用
+	renewed, reserved, err := db.ReserveIdempotencyKey(1, "key", now.Add(time.Minute), abandoned)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+	assert.NotEqual(t, record.ID, renewed.ID)
+
+	// 被遗弃的请求可以重新占用
+	_, reserved, err = db.ReserveIdempotencyKey(1, "key", window, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	require.NoError(t, db.DeleteIdempotencyKeysBefore(now.Add(time.Minute)))
+	var count int
+	require.NoError(t, db.DB.Model(&model.IdempotencyKey{}).Count(&count).Error)
+	assert.Equal(t, 0, count)
+}
+
+func TestFindDuplicateMessage(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Now()
+	old := &model.Message{ApplicationID: 1, Message: "old", ContentHash: "hash", Date: now.Add(-time.Hour)}
+	recent := &model.Message{ApplicationID: 1, Message: "recent", ContentHash: "hash", Date: now.Add(-time.Second)}
+	other := &model.Message{ApplicationID: 2, Message: "other", ContentHash: "hash", Date: now}
+	require.NoError(t, db.CreateMessage(old))
+	require.NoError(t, db.CreateMessage(recent))
+	require.NoError(t, db.CreateMessage(other))
+
+	duplicate, err := db.FindDuplicateMessage(1, "hash", now.Add(-time.Minute))
+	require.NoError(t, err)
+	require.NotNil(t, duplicate)
+	assert.Equal(t, recent.ID, duplicate.ID)
+
+	duplicate, err = db.FindDuplicateMessage(1, "other", now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, duplicate)
+	// 以其它时区比较时间窗口
+	duplicate, err = db.FindDuplicateMessage(1, "hash", now.In(time.FixedZone("UTC-8", -8*60*60)))
+	require.NoError(t, err)
+	assert.Nil(t, duplicate)
+}
@@ -35,8 +35,9 @@ func (d *GormDatabase) GetMessagesByUser(userID uint) ([]*model.Message, error)
 }
 
 // GetMessagesByUserSince returns limited messages from a user.
-// If since is 0 it will be ignored.
-func (d *GormDatabase) GetMessagesByUserSince(userID uint, limit int, since uint) ([]*model.Message, error) {
+// If since is 0 it will be ignored. Messages of UnifiedPush registrations are only returned to the client
+// with the clientToken which registered.
+func (d *GormDatabase) GetMessagesByUserSince(userID uint, clientToken string, limit int, since uint) ([]*model.Message, error) {
 	var messages []*model.Message
 	db := d.DB.
 		// 左连接applications表，确保application_id=0的消息也能保留
@@ -45,6 +46,7 @@ func (d *GormDatabase) GetMessagesByUserSince(userID uint, limit int, since uint
 		Joins("LEFT JOIN app_users ON applications.id = app_users.app_id AND app_users.user_id = ?", userID).
 		// 核心条件：要么是用户关联的应用消息，要么是application_id=0的系统消息
 		Where("(app_users.user_id = ? AND app_users.deleted_at IS NULL)", userID)
+	db = notExpired(exceptOtherClientsRegistrations(db, clientToken))
 
 	// 处理since参数：如果since>0，只查询ID大于since的消息（获取更新的消息）
 	if since > 0 {
@@ -58,6 +60,23 @@ func (d *GormDatabase) GetMessagesByUserSince(userID uint, limit int, since uint
 	return messages, nil
 }
 
+// GetMessagesByUserAfter returns up to limit messages of a user with an id greater than after, oldest first.
+// Callers page through all missed messages by passing the id of the last message of the previous page.
+// Messages of UnifiedPush registrations are only returned to the client with the clientToken which registered.
+func (d *GormDatabase) GetMessagesByUserAfter(userID uint, clientToken string, after uint, limit int) ([]*model.Message, error) {
+	var messages []*model.Message
+	db := d.DB.
+		Joins("LEFT JOIN applications ON messages.application_id = applications.id").
+		Joins("LEFT JOIN app_users ON applications.id = app_users.app_id AND app_users.user_id = ?", userID).
+		Where("(app_users.user_id = ? AND app_users.deleted_at IS NULL)", userID).
+		Where("messages.id > ?", after)
+	err := notExpired(exceptOtherClientsRegistrations(db, clientToken)).Order("messages.id ASC").Limit(limit).Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
 // GetMessagesByApplication returns all messages from an application.
 func (d *GormDatabase) GetMessagesByApplication(tokenID uint) ([]*model.Message, error) {
 	var messages []*model.Message
@@ -72,7 +91,7 @@ func (d *GormDatabase) GetMessagesByApplication(tokenID uint) ([]*model.Message,
 // If since is 0 it will be ignored.
 func (d *GormDatabase) GetMessagesByApplicationSince(appID uint, limit int, since uint) ([]*model.Message, error) {
 	var messages []*model.Message
-	db := d.DB.Where("application_id = ?", appID).Order("id desc").Limit(limit)
+	db := notExpired(d.DB.Where("application_id = ?", appID)).Order("id desc").Limit(limit)
 	if since != 0 {
 		db = db.Where("messages.id < ?", since)
 	}
@@ -85,11 +104,19 @@ func (d *GormDatabase) GetMessagesByApplicationSince(appID uint, limit int, sinc
 
 // DeleteMessageByID deletes a message by its id.
 func (d *GormDatabase) DeleteMessageByID(id []uint) error {
+	if err := d.DB.Where("message_id IN (?)", id).Delete(&model.MessageRead{}).Error; err != nil {
+		return err
+	}
 	return d.DB.Where("id IN (?)", id).Delete(&model.Message{}).Error
 }
 
 // DeleteMessagesByApplication deletes all messages from an application.
 func (d *GormDatabase) DeleteMessagesByApplication(applicationID uint) error {
+	err := d.DB.Where("message_id IN (?)", d.DB.Table("messages").Select("id").Where("application_id = ?", applicationID).SubQuery()).
+		Delete(&model.MessageRead{}).Error
+	if err != nil {
+		return err
+	}
 	return d.DB.Where("application_id = ?", applicationID).Delete(&model.Message{}).Error
 }
 
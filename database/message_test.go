@@ -1,12 +1,16 @@
 package database
 
 import (
-	"go-notify/model"
+	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
 )
 
 func TestMessageGetMessagesByUserSince(t *testing.T) {
-	db, _ := NewGormDatabase("data/go-notify.db")
+	db, _ := NewGormDatabase("data/go-notify.db", "admin", "admin", 10)
 	defer db.Close()
 	db.CreateUser(&model.User{
 		Name:  "test",
@@ -21,3 +25,33 @@ func TestMessageGetMessagesByUserSince(t *testing.T) {
 		Internal:    true,
 	})
 }
+
+func TestGetMessagesByUserAfter_pagesOldestFirst(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	user := &model.User{Name: "replay"}
+	require.NoError(t, db.CreateUser(user))
+	app := &model.Application{Name: "app", Token: "Aapp"}
+	require.NoError(t, db.CreateApplicationForUser(app, user.ID))
+	other := &model.Application{Name: "other", Token: "Aother"}
+	require.NoError(t, db.CreateApplicationForUser(other, 1))
+	var ids []uint
+	for i := 0; i < 5; i++ {
+		message := &model.Message{ApplicationID: app.ID, Message: "m"}
+		require.NoError(t, db.CreateMessage(message))
+		ids = append(ids, message.ID)
+		require.NoError(t, db.CreateMessage(&model.Message{ApplicationID: other.ID, Message: "not visible"}))
+	}
+
+	messages, err := db.GetMessagesByUserAfter(user.ID, "", ids[0], 2)
+	require.NoError(t, err)
+	assert.Equal(t, ids[1:3], messageIDs(messages), "the oldest missed messages come first")
+	messages, err = db.GetMessagesByUserAfter(user.ID, "", ids[2], 2)
+	require.NoError(t, err)
+	assert.Equal(t, ids[3:5], messageIDs(messages))
+	messages, err = db.GetMessagesByUserAfter(user.ID, "", ids[4], 2)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// 用户可见的消息：消息所属的应用关联了该用户
+const joinUserApplications = "JOIN app_users ON app_users.app_id = messages.application_id AND app_users.user_id = ? AND app_users.deleted_at IS NULL"
+
+// 未读消息：ID 大于用户在该应用中的已读位置，并且没有单独标记为已读
+const unreadCondition = "messages.id > app_users.last_read_id AND NOT EXISTS " +
+	"(SELECT 1 FROM message_reads WHERE message_reads.user_id = app_users.user_id AND message_reads.message_id = messages.id)"
+
+// MarkMessagesRead marks the messages as read by the user, messages the user can't see are ignored.
+func (d *GormDatabase) MarkMessagesRead(userID uint, messageIDs []uint, readAt time.Time) error {
+	return d.DB.Exec("INSERT OR IGNORE INTO message_reads (user_id, message_id, read_at) "+
+		"SELECT app_users.user_id, messages.id, ? FROM messages "+joinUserApplications+
+		" WHERE messages.id IN (?) AND messages.id > app_users.last_read_id", readAt, userID, messageIDs).Error
+}
+
+// MarkApplicationMessagesRead marks all current messages of the application as read by the user.
+func (d *GormDatabase) MarkApplicationMessagesRead(userID, appID uint) error {
+	return d.advanceLastRead(userID, "app_id = ? AND user_id = ?", appID, userID)
+}
+
+// MarkAllMessagesRead marks all current messages as read by the user.
+func (d *GormDatabase) MarkAllMessagesRead(userID uint) error {
+	return d.advanceLastRead(userID, "user_id = ? AND deleted_at IS NULL", userID)
+}
+
+// advanceLastRead 把已读位置移动到应用的最新消息，并删除已被该位置覆盖的单条已读记录
+func (d *GormDatabase) advanceLastRead(userID uint, where string, args ...interface{}) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Table("app_users").Where(where, args...).UpdateColumn("last_read_id",
+			gorm.Expr("MAX(last_read_id, (SELECT COALESCE(MAX(id), 0) FROM messages WHERE messages.application_id = app_users.app_id))")).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM message_reads WHERE user_id = ? AND message_id IN "+
+			"(SELECT messages.id FROM messages "+joinUserApplications+" WHERE messages.id <= app_users.last_read_id)",
+			userID, userID).Error
+	})
+}
+
+// CountUnreadMessages returns the amount of unread messages of the user per application.
+// Messages of UnifiedPush registrations are only counted for the client with the clientToken which registered.
+func (d *GormDatabase) CountUnreadMessages(userID uint, clientToken string) ([]*model.ApplicationUnreadCount, error) {
+	counts := []*model.ApplicationUnreadCount{}
+	db := d.DB.Table("messages").Select("messages.application_id AS application_id, COUNT(*) AS count").
+		Joins(joinUserApplications, userID).Where(unreadCondition)
+	err := notExpired(exceptOtherClientsRegistrations(db, clientToken)).
+		Group("messages.application_id").Order("messages.application_id ASC").Scan(&counts).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return counts, err
+}
+
+// GetReadMessageIDs returns the ids of the given messages which the user has read.
+func (d *GormDatabase) GetReadMessageIDs(userID uint, messageIDs []uint) ([]uint, error) {
+	var ids []uint
+	if len(messageIDs) == 0 {
+		return ids, nil
+	}
+	err := d.DB.Table("messages").Joins(joinUserApplications, userID).
+		Where("messages.id IN (?) AND NOT ("+unreadCondition+")", messageIDs).Pluck("messages.id", &ids).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return ids, err
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+func TestReadState(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	user := &model.User{Name: "reader"}
+	require.NoError(t, db.CreateUser(user))
+	app1 := &model.Application{Name: "one", Token: "Aone"}
+	app2 := &model.Application{Name: "two", Token: "Atwo"}
+	require.NoError(t, db.CreateApplicationForUser(app1, user.ID))
+	require.NoError(t, db.CreateApplicationForUser(app2, user.ID))
+	other := &model.Application{Name: "other", Token: "Aother"}
+	require.NoError(t, db.CreateApplicationForUser(other, 1))
+
+	var ids []uint
+	for _, appID := range []uint{app1.ID, app1.ID, app2.ID, app2.ID, other.ID} {
+		msg := &model.Message{ApplicationID: appID, Message: "m"}
+		require.NoError(t, db.CreateMessage(msg))
+		ids = append(ids, msg.ID)
+	}
+
+	counts, err := db.CountUnreadMessages(user.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, []*model.ApplicationUnreadCount{{ApplicationID: app1.ID, Count: 2}, {ApplicationID: app2.ID, Count: 2}}, counts)
+
+	// 其他用户的消息会被忽略
+	require.NoError(t, db.MarkMessagesRead(user.ID, []uint{ids[0], ids[3], ids[4]}, time.Now()))
+	read, err := db.GetReadMessageIDs(user.ID, ids)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []uint{ids[0], ids[3]}, read)
+
+	unread, err := db.SearchMessagesByUser(user.ID, "", &model.MessageFilter{Unread: true}, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{ids[2], ids[1]}, messageIDs(unread))
+
+	require.NoError(t, db.MarkApplicationMessagesRead(user.ID, app1.ID))
+	unread, err = db.SearchMessagesByApplication(user.ID, "", app1.ID, &model.MessageFilter{Unread: true}, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, unread)
+
+	require.NoError(t, db.MarkAllMessagesRead(user.ID))
+	counts, err = db.CountUnreadMessages(user.ID, "")
+	require.NoError(t, err)
+	assert.Empty(t, counts)
+	read, err = db.GetReadMessageIDs(user.ID, ids)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, ids[:4], read)
+
+	// 新消息仍然是未读的
+	msg := &model.Message{ApplicationID: app2.ID, Message: "new"}
+	require.NoError(t, db.CreateMessage(msg))
+	unread, err = db.SearchMessagesByUser(user.ID, "", &model.MessageFilter{Unread: true}, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{msg.ID}, messageIDs(unread))
+}
+
+func messageIDs(messages []*model.Message) []uint {
+	ids := make([]uint, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
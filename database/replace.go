@@ -0,0 +1,68 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// 替换键只在同一应用内唯一，没有替换键的消息不受约束
+const createReplaceKeyIndex = `CREATE UNIQUE INDEX IF NOT EXISTS uix_messages_application_replace_key
+	ON messages(application_id, replace_key) WHERE replace_key IS NOT NULL AND replace_key <> ''`
+
+// CreateOrReplaceMessage creates the message, or replaces the message of the same application
+// with the same replace key. The replacement always gets a new id so that clients which fetch
+// messages after the last id they know also receive it. It returns the id of the replaced message
+// or 0 if no message was replaced.
+func (d *GormDatabase) CreateOrReplaceMessage(message *model.Message) (uint, error) {
+	var replacedID uint
+	create := func() error {
+		return d.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			replacedID, err = createOrReplaceMessage(tx, message)
+			return err
+		})
+	}
+	err := create()
+	if err != nil && message.ReplaceKey != "" && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		// 并发创建了相同替换键的消息，再次执行时会替换该消息
+		err = create()
+	}
+	return replacedID, err
+}
+
+// ReplaceMessage deletes the message with the given id together with its read state
+// and creates the message with a new id in its place.
+func (d *GormDatabase) ReplaceMessage(replacedID uint, message *model.Message) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		return replaceMessage(tx, replacedID, message)
+	})
+}
+
+func createOrReplaceMessage(tx *gorm.DB, message *model.Message) (uint, error) {
+	if message.ReplaceKey == "" {
+		return 0, tx.Create(message).Error
+	}
+	existing := new(model.Message)
+	err := tx.Where("application_id = ? AND replace_key = ?", message.ApplicationID, message.ReplaceKey).First(existing).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, tx.Create(message).Error
+	}
+	if err != nil {
+		return 0, err
+	}
+	return existing.ID, replaceMessage(tx, existing.ID, message)
+}
+
+func replaceMessage(tx *gorm.DB, replacedID uint, message *model.Message) error {
+	// 已读状态属于被替换的内容，替换后的消息重新变为未读
+	if err := tx.Where("message_id = ?", replacedID).Delete(&model.MessageRead{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("id = ?", replacedID).Delete(&model.Message{}).Error; err != nil {
+		return err
+	}
+	message.ID = 0
+	return tx.Create(message).Error
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+func TestCreateOrReplaceMessage(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app1 := &model.Application{Name: "one", Token: "Aone"}
+	app2 := &model.Application{Name: "two", Token: "Atwo"}
+	require.NoError(t, db.CreateApplicationForUser(app1, 1))
+	require.NoError(t, db.CreateApplicationForUser(app2, 1))
+
+	now := time.Now()
+	running := &model.Message{ApplicationID: app1.ID, Message: "build running", Date: now, ReplaceKey: "build"}
+	replacedID, err := db.CreateOrReplaceMessage(running)
+	require.NoError(t, err)
+	assert.Zero(t, replacedID)
+
+	// 其他应用的相同替换键和没有替换键的消息都会新建
+	other := &model.Message{ApplicationID: app2.ID, Message: "other", Date: now, ReplaceKey: "build"}
+	replacedID, err = db.CreateOrReplaceMessage(other)
+	require.NoError(t, err)
+	assert.Zero(t, replacedID)
+	for i := 0; i < 2; i++ {
+		replacedID, err = db.CreateOrReplaceMessage(&model.Message{ApplicationID: app1.ID, Message: "plain", Date: now})
+		require.NoError(t, err)
+		assert.Zero(t, replacedID)
+	}
+	require.NoError(t, db.MarkMessagesRead(1, []uint{running.ID}, now))
+	read, err := db.GetReadMessageIDs(1, []uint{running.ID})
+	require.NoError(t, err)
+	require.Equal(t, []uint{running.ID}, read)
+
+	passed := &model.Message{ApplicationID: app1.ID, Message: "build passed", Date: now, ReplaceKey: "build"}
+	replacedID, err = db.CreateOrReplaceMessage(passed)
+	require.NoError(t, err)
+	assert.Equal(t, running.ID, replacedID)
+	assert.Greater(t, passed.ID, other.ID, "the replacement gets a new id so cursor clients fetch it")
+
+	msg, err := db.GetMessageByID(running.ID)
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+	msg, err = db.GetMessageByID(passed.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "build passed", msg.Message)
+	messages, err := db.GetMessagesByApplicationSince(app1.ID, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+	read, err = db.GetReadMessageIDs(1, []uint{running.ID, passed.ID})
+	require.NoError(t, err)
+	assert.Empty(t, read, "the read state of the replaced message is cleared")
+
+	// 绕过替换逻辑直接插入相同替换键的消息会违反唯一约束
+	assert.Error(t, db.CreateMessage(&model.Message{ApplicationID: app1.ID, Message: "dup", Date: now, ReplaceKey: "build"}))
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// GetNotificationRules returns the notification rules of the user or nil if the user has none.
+func (d *GormDatabase) GetNotificationRules(userID uint) (*model.NotificationRules, error) {
+	rules := new(model.NotificationRules)
+	err := d.DB.Preload("ApplicationPriorities", func(db *gorm.DB) *gorm.DB {
+		return db.Order("application_priorities.application_id ASC")
+	}).Where("user_id = ?", userID).First(rules).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// SaveNotificationRules creates or replaces the notification rules of the user, including the application priorities.
+func (d *GormDatabase) SaveNotificationRules(rules *model.NotificationRules) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Set("gorm:save_associations", false).Save(rules).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", rules.UserID).Delete(&model.ApplicationPriority{}).Error; err != nil {
+			return err
+		}
+		for i := range rules.ApplicationPriorities {
+			rules.ApplicationPriorities[i].UserID = rules.UserID
+			if err := tx.Create(&rules.ApplicationPriorities[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeferNotification stores a notification which is pushed at DeliverAt.
+func (d *GormDatabase) DeferNotification(deferred *model.DeferredNotification) error {
+	return d.DB.Set("gorm:save_associations", false).Save(deferred).Error
+}
+
+// GetDueDeferredUserIDs returns the ids of all users with notifications which are due at now and are,
+// or are not, summarized in a digest.
+func (d *GormDatabase) GetDueDeferredUserIDs(now time.Time, digest bool) ([]uint, error) {
+	var userIDs []uint
+	err := d.DB.Model(&model.DeferredNotification{}).Where("digest = ? AND julianday(deliver_at) <= julianday(?)", digest, now).
+		Order("user_id ASC").Pluck("DISTINCT user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// GetDueDeferredNotifications returns all notifications of the user which are due at now and are, or are not,
+// summarized in a digest, together with their messages ordered by message id. The message of a notification
+// is empty if it was deleted in the meantime.
+func (d *GormDatabase) GetDueDeferredNotifications(userID uint, digest bool, now time.Time) ([]*model.DeferredNotification, error) {
+	var deferred []*model.DeferredNotification
+	err := d.DB.Preload("Message").Where("user_id = ? AND digest = ? AND julianday(deliver_at) <= julianday(?)", userID, digest, now).
+		Order("message_id ASC").Find(&deferred).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return deferred, err
+}
+
+// GetNextDeferredNotification returns the notification which is due next or nil if there is none.
+func (d *GormDatabase) GetNextDeferredNotification() (*model.DeferredNotification, error) {
+	deferred := new(model.DeferredNotification)
+	err := d.DB.Order("julianday(deliver_at) ASC").First(deferred).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deferred, nil
+}
+
+// DeleteDeferredNotifications deletes the notifications.
+func (d *GormDatabase) DeleteDeferredNotifications(deferred []*model.DeferredNotification) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		return deleteDeferredNotifications(tx, deferred)
+	})
+}
+
+func deleteDeferredNotifications(tx *gorm.DB, deferred []*model.DeferredNotification) error {
+	for _, n := range deferred {
+		if err := tx.Where("user_id = ? AND message_id = ?", n.UserID, n.MessageID).Delete(&model.DeferredNotification{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDigestApplication returns the application the digests of the user are saved under or nil if it was not created yet.
+func (d *GormDatabase) GetDigestApplication(userID uint) (*model.Application, error) {
+	link := new(model.UserDigestApplication)
+	err := d.DB.Where("user_id = ?", userID).First(link).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.GetApplicationByID(link.ApplicationID)
+}
+
+// CreateDigestApplication creates the application the digests of the user are saved under
+// and links it to the user, replacing the link to a deleted application.
+func (d *GormDatabase) CreateDigestApplication(userID uint, application *model.Application) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(application).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := tx.Create(&model.AppUser{AppID: application.ID, UserID: userID, CreateAt: &now}).Error; err != nil {
+			return err
+		}
+		return tx.Save(&model.UserDigestApplication{UserID: userID, ApplicationID: application.ID}).Error
+	})
+}
+
+// CreateDigestMessage saves the digest and deletes the deferred notifications it summarizes in one transaction,
+// so that a digest is neither lost nor saved twice.
+func (d *GormDatabase) CreateDigestMessage(digest *model.Message, deferred []*model.DeferredNotification) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := deleteDeferredNotifications(tx, deferred); err != nil {
+			return err
+		}
+		return tx.Create(digest).Error
+	})
+}
+
+// RescheduleDeferredNotifications changes the delivery time of the deferred notifications of the user
+// which are, or are not, summarized in a digest.
+func (d *GormDatabase) RescheduleDeferredNotifications(userID uint, digest bool, deliverAt time.Time) error {
+	return d.DB.Model(&model.DeferredNotification{}).Where("user_id = ? AND digest = ?", userID, digest).
+		Update("deliver_at", deliverAt).Error
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+func TestNotificationRules(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	rules, err := db.GetNotificationRules(1)
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	minPriority := 5
+	require.NoError(t, db.SaveNotificationRules(&model.NotificationRules{
+		UserID: 1, QuietHours: true, QuietStart: "22:00", QuietEnd: "07:00", TimeZone: "Europe/Berlin", MinPriority: &minPriority,
+		ApplicationPriorities: []model.ApplicationPriority{{ApplicationID: 3, Priority: 1}, {ApplicationID: 2, Priority: 9}},
+	}))
+	rules, err = db.GetNotificationRules(1)
+	require.NoError(t, err)
+	require.NotNil(t, rules)
+	assert.Equal(t, "Europe/Berlin", rules.TimeZone)
+	assert.Equal(t, 5, *rules.MinPriority)
+	assert.Equal(t, []model.ApplicationPriority{{UserID: 1, ApplicationID: 2, Priority: 9}, {UserID: 1, ApplicationID: 3, Priority: 1}},
+		rules.ApplicationPriorities)
+
+	// 保存时替换所有应用的优先级
+	require.NoError(t, db.SaveNotificationRules(&model.NotificationRules{UserID: 1,
+		ApplicationPriorities: []model.ApplicationPriority{{ApplicationID: 4, Priority: 2}}}))
+	rules, err = db.GetNotificationRules(1)
+	require.NoError(t, err)
+	assert.False(t, rules.QuietHours)
+	assert.Nil(t, rules.MinPriority)
+	assert.Equal(t, []model.ApplicationPriority{{UserID: 1, ApplicationID: 4, Priority: 2}}, rules.ApplicationPriorities)
+}
+
+func TestDeferredNotifications(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Now()
+	first := &model.Message{ApplicationID: 1, Message: "first", Date: now}
+	second := &model.Message{ApplicationID: 1, Message: "second", Date: now}
+	require.NoError(t, db.CreateMessage(first))
+	require.NoError(t, db.CreateMessage(second))
+
+	// 以其它时区保存的时间也能正确比较
+	later := now.Add(time.Hour).In(time.FixedZone("UTC-8", -8*60*60))
+	require.NoError(t, db.DeferNotification(&model.DeferredNotification{UserID: 1, MessageID: second.ID, DeliverAt: now.Add(-time.Minute)}))
+	require.NoError(t, db.DeferNotification(&model.DeferredNotification{UserID: 1, MessageID: first.ID, DeliverAt: now.Add(-time.Minute)}))
+	require.NoError(t, db.DeferNotification(&model.DeferredNotification{UserID: 2, MessageID: first.ID, DeliverAt: later}))
+	require.NoError(t, db.DeleteMessageByID([]uint{second.ID}))
+
+	next, err := db.GetNextDeferredNotification()
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), next.UserID)
+
+	userIDs, err := db.GetDueDeferredUserIDs(now, false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1}, userIDs)
+	due, err := db.GetDueDeferredNotifications(1, false, now)
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+	assert.Equal(t, first.ID, due[0].MessageID)
+	assert.Equal(t, "first", due[0].Message.Message)
+	assert.Equal(t, second.ID, due[1].MessageID)
+	assert.Zero(t, due[1].Message.ID)
+
+	require.NoError(t, db.DeleteDeferredNotifications(due))
+	require.NoError(t, db.RescheduleDeferredNotifications(2, false, now.Add(-time.Second)))
+	userIDs, err = db.GetDueDeferredUserIDs(now, false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{2}, userIDs)
+	due, err = db.GetDueDeferredNotifications(2, false, now)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, first.ID, due[0].MessageID)
+}
+
+func TestDigestNotifications(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Now()
+	message := &model.Message{ApplicationID: 1, Message: "digest", Date: now}
+	require.NoError(t, db.CreateMessage(message))
+	require.NoError(t, db.DeferNotification(&model.DeferredNotification{UserID: 1, MessageID: message.ID, DeliverAt: now.Add(-time.Minute), Digest: true}))
+	require.NoError(t, db.DeferNotification(&model.DeferredNotification{UserID: 2, MessageID: message.ID, DeliverAt: now.Add(time.Hour), Digest: true}))
+	require.NoError(t, db.DeferNotification(&model.DeferredNotification{UserID: 3, MessageID: message.ID, DeliverAt: now.Add(-time.Minute)}))
+
+	// 摘要中的消息不单独推送
+	userIDs, err := db.GetDueDeferredUserIDs(now, false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{3}, userIDs)
+
+	userIDs, err = db.GetDueDeferredUserIDs(now, true)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1}, userIDs)
+	digest, err := db.GetDueDeferredNotifications(1, true, now)
+	require.NoError(t, err)
+	require.Len(t, digest, 1)
+	assert.Equal(t, "digest", digest[0].Message.Message)
+
+	require.NoError(t, db.RescheduleDeferredNotifications(2, true, now))
+	userIDs, err = db.GetDueDeferredUserIDs(now, true)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2}, userIDs)
+}
+
+func TestDigestApplication(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	application, err := db.GetDigestApplication(1)
+	require.NoError(t, err)
+	assert.Nil(t, application)
+	require.NoError(t, db.CreateDigestApplication(1, &model.Application{Name: "Digest", Token: "Adigest"}))
+	application, err = db.GetDigestApplication(1)
+	require.NoError(t, err)
+	require.NotNil(t, application)
+	owns, err := db.JudgeUserOwnsApplication(1, application.ID)
+	require.NoError(t, err)
+	assert.True(t, owns, "the user is subscribed to its digest application")
+	managed, err := db.IsManagedApplication(application.ID)
+	require.NoError(t, err)
+	assert.True(t, managed)
+	apps, err := db.GetUnmanagedApplicationsByUser(1)
+	require.NoError(t, err)
+	assert.Empty(t, apps, "the digest application is not listed")
+
+	now := time.Now()
+	message := &model.Message{ApplicationID: application.ID, Message: "low", Date: now}
+	require.NoError(t, db.CreateMessage(message))
+	deferred := &model.DeferredNotification{UserID: 1, MessageID: message.ID, DeliverAt: now, Digest: true}
+	require.NoError(t, db.DeferNotification(deferred))
+	digest := &model.Message{ApplicationID: application.ID, Message: "1 new message", Date: now}
+	require.NoError(t, db.CreateDigestMessage(digest, []*model.DeferredNotification{deferred}))
+	assert.NotZero(t, digest.ID)
+	userIDs, err := db.GetDueDeferredUserIDs(now, true)
+	require.NoError(t, err)
+	assert.Empty(t, userIDs, "the summarized notifications are deleted with the digest")
+
+	// 应用被删除后重新创建
+	require.NoError(t, db.DeleteApplicationByID(application.ID))
+	application, err = db.GetDigestApplication(1)
+	require.NoError(t, err)
+	assert.Nil(t, application)
+	require.NoError(t, db.CreateDigestApplication(1, &model.Application{Name: "Digest", Token: "Adigest2"}))
+	application, err = db.GetDigestApplication(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Adigest2", application.Token)
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// CreateScheduledMessage creates a scheduled message.
+func (d *GormDatabase) CreateScheduledMessage(message *model.ScheduledMessage) error {
+	return d.DB.Create(message).Error
+}
+
+// GetScheduledMessageByID returns the scheduled message for the given id or nil.
+func (d *GormDatabase) GetScheduledMessageByID(id uint) (*model.ScheduledMessage, error) {
+	msg := new(model.ScheduledMessage)
+	err := d.DB.Find(msg, id).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	if msg.ID == id {
+		return msg, err
+	}
+	return nil, err
+}
+
+// GetScheduledMessagesByApplication returns all scheduled messages of an application, the next delivery first.
+func (d *GormDatabase) GetScheduledMessagesByApplication(appID uint) ([]*model.ScheduledMessage, error) {
+	var messages []*model.ScheduledMessage
+	err := d.DB.Where("application_id = ?", appID).Order("julianday(deliver_at) ASC, id ASC").Find(&messages).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return messages, err
+}
+
+// GetDueScheduledMessages returns up to limit scheduled messages which are due at now, the oldest first.
+func (d *GormDatabase) GetDueScheduledMessages(now time.Time, limit int) ([]*model.ScheduledMessage, error) {
+	var messages []*model.ScheduledMessage
+	err := d.DB.Where("julianday(deliver_at) <= julianday(?)", now).
+		Order("julianday(deliver_at) ASC, id ASC").Limit(limit).Find(&messages).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return messages, err
+}
+
+// GetNextScheduledMessage returns the scheduled message which is delivered next or nil.
+func (d *GormDatabase) GetNextScheduledMessage() (*model.ScheduledMessage, error) {
+	msg := new(model.ScheduledMessage)
+	err := d.DB.Order("julianday(deliver_at) ASC, id ASC").First(msg).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	return msg, err
+}
+
+// DeleteScheduledMessageByID deletes a scheduled message by its id.
+func (d *GormDatabase) DeleteScheduledMessageByID(id uint) error {
+	return d.DB.Where("id = ?", id).Delete(&model.ScheduledMessage{}).Error
+}
+
+// RetryScheduledMessage postpones a scheduled message whose delivery failed to deliverAt and counts the attempt.
+func (d *GormDatabase) RetryScheduledMessage(id uint, deliverAt time.Time) error {
+	return d.DB.Model(&model.ScheduledMessage{}).Where("id = ?", id).
+		UpdateColumns(map[string]interface{}{"deliver_at": deliverAt, "attempts": gorm.Expr("attempts + 1")}).Error
+}
+
+// DeliverScheduledMessage replaces the scheduled message with the message, see CreateOrReplaceMessage.
+// delivered is false if the scheduled message no longer exists, e.g. because it was cancelled.
+func (d *GormDatabase) DeliverScheduledMessage(scheduled *model.ScheduledMessage, message *model.Message) (delivered bool, replacedID uint, err error) {
+	err = d.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ?", scheduled.ID).Delete(&model.ScheduledMessage{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		var err error
+		if replacedID, err = createOrReplaceMessage(tx, message); err != nil {
+			return err
+		}
+		delivered = true
+		return nil
+	})
+	return delivered, replacedID, err
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+func TestScheduledMessages(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := &model.Application{Name: "app", Token: "Aapp"}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+
+	now := time.Now()
+	later := &model.ScheduledMessage{ApplicationID: app.ID, Message: "later", DeliverAt: now.Add(time.Hour)}
+	// 以其它时区保存的投递时间也按实际时间排序
+	due := &model.ScheduledMessage{ApplicationID: app.ID, Message: "due", DeliverAt: now.Add(-time.Minute).In(time.FixedZone("UTC+8", 8*60*60))}
+	require.NoError(t, db.CreateScheduledMessage(later))
+	require.NoError(t, db.CreateScheduledMessage(due))
+
+	next, err := db.GetNextScheduledMessage()
+	require.NoError(t, err)
+	assert.Equal(t, due.ID, next.ID)
+	scheduled, err := db.GetScheduledMessagesByApplication(app.ID)
+	require.NoError(t, err)
+	assert.Len(t, scheduled, 2)
+
+	dueMessages, err := db.GetDueScheduledMessages(now, 10)
+	require.NoError(t, err)
+	require.Len(t, dueMessages, 1)
+	assert.Equal(t, due.ID, dueMessages[0].ID)
+
+	msg := &model.Message{ApplicationID: app.ID, Message: "due", Date: now}
+	delivered, replacedID, err := db.DeliverScheduledMessage(dueMessages[0], msg)
+	require.NoError(t, err)
+	assert.True(t, delivered)
+	assert.Zero(t, replacedID)
+	assert.NotZero(t, msg.ID)
+
+	// 已投递或已取消的定时消息不会再次投递
+	delivered, _, err = db.DeliverScheduledMessage(dueMessages[0], &model.Message{ApplicationID: app.ID, Message: "again", Date: now})
+	require.NoError(t, err)
+	assert.False(t, delivered)
+	messages, err := db.GetMessagesByApplicationSince(app.ID, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{msg.ID}, messageIDs(messages))
+
+	require.NoError(t, db.DeleteApplicationByID(app.ID))
+	next, err = db.GetNextScheduledMessage()
+	require.NoError(t, err)
+	assert.Nil(t, next)
+}
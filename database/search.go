@@ -0,0 +1,171 @@
+package database
+
+import (
+	"log"
+	"strings"
+
+	json "github.com/bytedance/sonic"
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// go-sqlite3 只有在使用 sqlite_fts5 和 sqlite_json 构建标签编译时才包含 FTS5 和 JSON1 扩展（见 Makefile），
+// 缺少时全文搜索退化为 LIKE 匹配，Extras 键的匹配退化为对序列化内容的文本匹配
+const createMessagesFTS = `CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(title, message, content='messages', content_rowid='id')`
+
+var messagesFTSTriggerNames = []string{"messages_fts_insert", "messages_fts_delete", "messages_fts_update"}
+
+var messagesFTSTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, title, message) VALUES (new.id, new.title, new.message);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, title, message) VALUES ('delete', old.id, old.title, old.message);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF title, message ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, title, message) VALUES ('delete', old.id, old.title, old.message);
+		INSERT INTO messages_fts(rowid, title, message) VALUES (new.id, new.title, new.message);
+	END`,
+}
+
+// initMessagesFTS 创建与 messages 表同步的 FTS5 索引，返回 FTS5 是否可用
+func initMessagesFTS(db *gorm.DB) (bool, error) {
+	if !compileOptionUsed(db, "ENABLE_FTS5") {
+		log.Print("SQLite was built without FTS5, message search falls back to LIKE")
+		// 删除之前由支持 FTS5 的版本创建的触发器，否则插入消息会失败
+		for _, name := range messagesFTSTriggerNames {
+			if err := db.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	if err := db.Exec(createMessagesFTS).Error; err != nil {
+		return false, err
+	}
+	var triggers int
+	if err := db.Table("sqlite_master").Where("type = 'trigger' AND name IN (?)", messagesFTSTriggerNames).
+		Count(&triggers).Error; err != nil {
+		return false, err
+	}
+	for _, trigger := range messagesFTSTriggers {
+		if err := db.Exec(trigger).Error; err != nil {
+			return false, err
+		}
+	}
+	if triggers < len(messagesFTSTriggerNames) {
+		// 新建的索引，或不支持 FTS5 的版本删除触发器期间写入的消息，需要重新建立索引
+		if err := db.Exec("INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')").Error; err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// compileOptionUsed 判断 SQLite 编译时是否使用了该选项
+func compileOptionUsed(db *gorm.DB, option string) bool {
+	var used bool
+	if err := db.Raw("SELECT sqlite_compileoption_used(?)", option).Row().Scan(&used); err != nil {
+		return false
+	}
+	return used
+}
+
+// SearchMessagesByUser returns limited messages of a user which match the filter, newest first.
+// If since is 0 it will be ignored, otherwise only messages older than since are returned.
+// Messages of UnifiedPush registrations are only returned to the client with the clientToken which registered.
+func (d *GormDatabase) SearchMessagesByUser(userID uint, clientToken string, filter *model.MessageFilter, limit int, since uint) ([]*model.Message, error) {
+	return d.searchMessages(exceptOtherClientsRegistrations(d.DB.Joins(joinUserApplications, userID), clientToken), filter, limit, since)
+}
+
+// SearchMessagesByApplication returns limited messages of an application which match the filter, newest first.
+// If since is 0 it will be ignored, otherwise only messages older than since are returned.
+// Messages of UnifiedPush registrations are only returned to the client with the clientToken which registered.
+func (d *GormDatabase) SearchMessagesByApplication(userID uint, clientToken string, appID uint, filter *model.MessageFilter, limit int, since uint) ([]*model.Message, error) {
+	db := exceptOtherClientsRegistrations(d.DB.Joins(joinUserApplications, userID), clientToken)
+	return d.searchMessages(db.Where("messages.application_id = ?", appID), filter, limit, since)
+}
+
+func (d *GormDatabase) searchMessages(db *gorm.DB, filter *model.MessageFilter, limit int, since uint) ([]*model.Message, error) {
+	var messages []*model.Message
+	db = notExpired(db)
+	if since != 0 {
+		db = db.Where("messages.id < ?", since)
+	}
+	err := d.applyMessageFilter(db, filter).Order("messages.id DESC").Limit(limit).Find(&messages).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return messages, err
+}
+
+// applyMessageFilter 把过滤条件加入查询，查询需要已经关联 app_users
+func (d *GormDatabase) applyMessageFilter(db *gorm.DB, filter *model.MessageFilter) *gorm.DB {
+	if filter == nil {
+		return db
+	}
+	if terms := strings.Fields(filter.Search); len(terms) > 0 {
+		if d.fts && isASCII(filter.Search) {
+			db = db.Where("messages.id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)", ftsQuery(terms))
+		} else {
+			// unicode61 分词器不切分中文等没有空格的文字，这类搜索使用 LIKE
+			for _, term := range terms {
+				pattern := "%" + escapeLike(term) + "%"
+				db = db.Where(`(messages.title LIKE ? ESCAPE '\' OR messages.message LIKE ? ESCAPE '\')`, pattern, pattern)
+			}
+		}
+	}
+	if filter.MinPriority != nil {
+		db = db.Where("messages.priority >= ?", *filter.MinPriority)
+	}
+	if filter.MaxPriority != nil {
+		db = db.Where("messages.priority <= ?", *filter.MaxPriority)
+	}
+	// 日期以带时区的文本保存，使用 julianday 比较以忽略时区差异
+	if filter.After != nil {
+		db = db.Where("julianday(messages.date) >= julianday(?)", *filter.After)
+	}
+	if filter.Before != nil {
+		db = db.Where("julianday(messages.date) < julianday(?)", *filter.Before)
+	}
+	if len(filter.AppIDs) > 0 {
+		db = db.Where("messages.application_id IN (?)", filter.AppIDs)
+	}
+	if filter.ExtrasKey != "" {
+		if d.json1 {
+			// 没有 Extras 的消息保存的是空内容，不是合法的 JSON
+			db = db.Where("EXISTS (SELECT 1 FROM json_each(CASE WHEN json_valid(CAST(messages.extras AS TEXT)) "+
+				"THEN CAST(messages.extras AS TEXT) ELSE '{}' END) WHERE json_each.key = ?)", filter.ExtrasKey)
+		} else {
+			// 序列化后的键形如 "key":，嵌套对象中的同名键也会被匹配
+			key, _ := json.MarshalString(filter.ExtrasKey)
+			db = db.Where(`CAST(messages.extras AS TEXT) LIKE ? ESCAPE '\'`, "%"+escapeLike(key)+":%")
+		}
+	}
+	if filter.Unread {
+		db = db.Where(unreadCondition)
+	}
+	return db
+}
+
+// ftsQuery 把每个词作为前缀匹配的短语，避免用户输入被解析为 FTS5 语法
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+//go:build sqlite_fts5
+
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+// 需要使用 make test（go test -tags sqlite_fts5）运行，默认构建的 SQLite 不包含 FTS5
+func TestSearchMessages_fts5(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewGormDatabase(path, "admin", "admin", 4)
+	require.NoError(t, err)
+	require.True(t, db.fts, "SQLite must be built with FTS5")
+
+	user := &model.User{Name: "searcher"}
+	require.NoError(t, db.CreateUser(user))
+	app := &model.Application{Name: "app", Token: "Aapp"}
+	require.NoError(t, db.CreateApplicationForUser(app, user.ID))
+	search := func(db *GormDatabase, text string) []uint {
+		messages, err := db.SearchMessagesByUser(user.ID, "", &model.MessageFilter{Search: text}, 10, 0)
+		require.NoError(t, err)
+		return messageIDs(messages)
+	}
+
+	backup := &model.Message{ApplicationID: app.ID, Title: "Backup", Message: "backup finished"}
+	require.NoError(t, db.CreateMessage(backup))
+	assert.Equal(t, []uint{backup.ID}, search(db, "finish"))
+	replaced := backup.ID
+	backup.Message = "backup failed"
+	require.NoError(t, db.ReplaceMessage(replaced, backup))
+	assert.Empty(t, search(db, "finish"), "the index follows replacements")
+	assert.Equal(t, []uint{backup.ID}, search(db, "fail"))
+
+	// 不支持 FTS5 的版本会删除同步触发器，期间写入的消息不在索引中
+	for _, name := range messagesFTSTriggerNames {
+		require.NoError(t, db.DB.Exec("DROP TRIGGER "+name).Error)
+	}
+	disk := &model.Message{ApplicationID: app.ID, Title: "Disk", Message: "disk almost full"}
+	require.NoError(t, db.CreateMessage(disk))
+	require.NoError(t, db.DeleteMessageByID([]uint{backup.ID}))
+	db.Close()
+
+	db, err = NewGormDatabase(path, "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, []uint{disk.ID}, search(db, "almost"), "the index is rebuilt when the triggers are recreated")
+	assert.Empty(t, search(db, "backup"))
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+func TestSearchMessages(t *testing.T) {
+	db, err := NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	defer db.Close()
+
+	user := &model.User{Name: "searcher"}
+	require.NoError(t, db.CreateUser(user))
+	app1 := &model.Application{Name: "one", Token: "Aone"}
+	app2 := &model.Application{Name: "two", Token: "Atwo"}
+	require.NoError(t, db.CreateApplicationForUser(app1, user.ID))
+	require.NoError(t, db.CreateApplicationForUser(app2, user.ID))
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	create := func(appID uint, title, message string, priority int, hours int, extras string) uint {
+		msg := &model.Message{ApplicationID: appID, Title: title, Message: message, Priority: priority,
+			Date: base.Add(time.Duration(hours) * time.Hour), Extras: []byte(extras)}
+		require.NoError(t, db.CreateMessage(msg))
+		return msg.ID
+	}
+	backup := create(app1.ID, "Backup", "backup finished successfully", 2, 0, `{"client::display":{"contentType":"text/markdown"}}`)
+	disk := create(app1.ID, "Disk", "disk almost full", 8, 1, "")
+	deploy := create(app2.ID, "Deploy", "部署完成 100%_done", 5, 2, `{"android::action":{"onReceive":{"intentUrl":"x"}}}`)
+
+	search := func(filter *model.MessageFilter) []uint {
+		messages, err := db.SearchMessagesByUser(user.ID, "", filter, 10, 0)
+		require.NoError(t, err)
+		return messageIDs(messages)
+	}
+	intp := func(i int) *int { return &i }
+	timep := func(t time.Time) *time.Time { return &t }
+
+	assert.Equal(t, []uint{deploy, disk, backup}, search(nil))
+	assert.Equal(t, []uint{backup}, search(&model.MessageFilter{Search: "backup succ"}))
+	assert.Equal(t, []uint{disk}, search(&model.MessageFilter{Search: "ALMOST"}))
+	assert.Empty(t, search(&model.MessageFilter{Search: `backup "disk`}))
+	assert.Equal(t, []uint{deploy}, search(&model.MessageFilter{Search: "部署"}))
+	assert.Equal(t, []uint{deploy}, search(&model.MessageFilter{Search: "100%_done"}))
+	assert.Equal(t, []uint{deploy, disk}, search(&model.MessageFilter{MinPriority: intp(5)}))
+	assert.Equal(t, []uint{deploy, backup}, search(&model.MessageFilter{MaxPriority: intp(5)}))
+	assert.Equal(t, []uint{disk}, search(&model.MessageFilter{
+		After:  timep(base.Add(30 * time.Minute).In(time.FixedZone("CEST", 2*60*60))),
+		Before: timep(base.Add(2 * time.Hour)),
+	}))
+	assert.Equal(t, []uint{deploy}, search(&model.MessageFilter{AppIDs: []uint{app2.ID}}))
+	assert.Equal(t, []uint{backup}, search(&model.MessageFilter{ExtrasKey: "client::display"}))
+	assert.Empty(t, search(&model.MessageFilter{ExtrasKey: "client"}))
+
+	// 分页游标返回更早的消息
+	messages, err := db.SearchMessagesByApplication(user.ID, "", app1.ID, &model.MessageFilter{Search: "disk backup"}, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+	messages, err = db.SearchMessagesByUser(user.ID, "", nil, 10, deploy)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{disk, backup}, messageIDs(messages))
+
+	// 索引随消息删除同步更新
+	require.NoError(t, db.DeleteMessageByID([]uint{disk}))
+	assert.Empty(t, search(&model.MessageFilter{Search: "almost"}))
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// CreateUnifiedPushRegistration creates the registration together with its application.
+func (d *GormDatabase) CreateUnifiedPushRegistration(registration *model.UnifiedPushRegistration, application *model.Application) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(application).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := tx.Create(&model.AppUser{AppID: application.ID, UserID: registration.UserID, CreateAt: &now}).Error; err != nil {
+			return err
+		}
+		registration.ApplicationID = application.ID
+		return tx.Create(registration).Error
+	})
+}
+
+// GetUnifiedPushRegistrationByID returns the registration for the given id or nil.
+func (d *GormDatabase) GetUnifiedPushRegistrationByID(id uint) (*model.UnifiedPushRegistration, error) {
+	return d.findUnifiedPushRegistration("id = ?", id)
+}
+
+// GetUnifiedPushRegistrationByToken returns the registration of the client with the given connector token or nil.
+func (d *GormDatabase) GetUnifiedPushRegistrationByToken(clientID uint, token string) (*model.UnifiedPushRegistration, error) {
+	return d.findUnifiedPushRegistration("client_id = ? AND token = ?", clientID, token)
+}
+
+// GetUnifiedPushRegistrationByApplication returns the registration the application was created for or nil.
+func (d *GormDatabase) GetUnifiedPushRegistrationByApplication(appID uint) (*model.UnifiedPushRegistration, error) {
+	return d.findUnifiedPushRegistration("application_id = ?", appID)
+}
+
+func (d *GormDatabase) findUnifiedPushRegistration(query string, args ...interface{}) (*model.UnifiedPushRegistration, error) {
+	registration := new(model.UnifiedPushRegistration)
+	err := d.DB.Where(query, args...).First(registration).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
+
+// GetUnifiedPushRegistrationsByUser returns all registrations of the user.
+func (d *GormDatabase) GetUnifiedPushRegistrationsByUser(userID uint) ([]*model.UnifiedPushRegistration, error) {
+	var registrations []*model.UnifiedPushRegistration
+	err := d.DB.Where("user_id = ?", userID).Order("id ASC").Find(&registrations).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return registrations, err
+}
+
+// DeleteUnifiedPushRegistrationByID deletes the registration together with its application and messages.
+func (d *GormDatabase) DeleteUnifiedPushRegistrationByID(id uint) error {
+	registration, err := d.GetUnifiedPushRegistrationByID(id)
+	if err != nil || registration == nil {
+		return err
+	}
+	return d.DeleteApplicationByID(registration.ApplicationID)
+}
+
+// exceptOtherClientsRegistrations 排除其它客户端的 UnifiedPush 注册的消息，这些消息只推送给注册的客户端；
+// clientToken 为空（使用用户名密码认证）时排除所有注册的消息
+func exceptOtherClientsRegistrations(db *gorm.DB, clientToken string) *gorm.DB {
+	return db.Where("messages.application_id NOT IN (SELECT application_id FROM unified_push_registrations "+
+		"WHERE client_id NOT IN (SELECT id FROM clients WHERE token = ?))", clientToken)
+}
@@ -51,10 +51,15 @@ func (d *GormDatabase) GetUsers() ([]*model.User, error) {
 	return users, err
 }
 
-// DeleteUserByID deletes a user by its id.
+// DeleteUserByID deletes a user by its id. Applications which are shared with other users are kept.
 func (d *GormDatabase) DeleteUserByID(id uint) error {
 	apps, _ := d.GetApplicationsByUser(id)
 	for _, app := range apps {
+		userIDs, _ := d.GetApplicationUserIDs(app.ID)
+		if len(userIDs) > 1 {
+			d.DB.Where("app_id = ? AND user_id = ?", app.ID, id).Delete(&model.AppUser{})
+			continue
+		}
 		d.DeleteApplicationByID(app.ID)
 	}
 	clients, _ := d.GetClientsByUser(id)
@@ -65,6 +70,16 @@ func (d *GormDatabase) DeleteUserByID(id uint) error {
 	for _, conf := range pluginConfs {
 		d.DeletePluginConfByID(conf.ID)
 	}
+	d.DB.Where("user_id = ?", id).Delete(&model.MessageRead{})
+	d.DB.Where("user_id = ?", id).Delete(&model.ApplicationPriority{})
+	d.DB.Where("user_id = ?", id).Delete(&model.DeferredNotification{})
+	d.DB.Where("user_id = ?", id).Delete(&model.NotificationRules{})
+	d.DB.Where("user_id = ?", id).Delete(&model.EmailSettings{})
+	d.DB.Where("user_id = ?", id).Delete(&model.EmailNotification{})
+	webhooks, _ := d.GetWebhooksByUser(id)
+	for _, webhook := range webhooks {
+		d.DeleteWebhookByID(webhook.ID)
+	}
 	return d.DB.Where("id = ?", id).Delete(&model.User{}).Error
 }
 
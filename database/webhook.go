@@ -0,0 +1,156 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// CreateWebhook creates a webhook.
+func (d *GormDatabase) CreateWebhook(webhook *model.Webhook) error {
+	return d.DB.Create(webhook).Error
+}
+
+// GetWebhookByID returns the webhook for the given id or nil.
+func (d *GormDatabase) GetWebhookByID(id uint) (*model.Webhook, error) {
+	webhook := new(model.Webhook)
+	err := d.DB.Where("id = ?", id).First(webhook).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// GetWebhooksByUser returns all webhooks of a user.
+func (d *GormDatabase) GetWebhooksByUser(userID uint) ([]*model.Webhook, error) {
+	var webhooks []*model.Webhook
+	err := d.DB.Where("user_id = ?", userID).Order("id ASC").Find(&webhooks).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return webhooks, err
+}
+
+// GetEnabledWebhooks returns the enabled webhooks of the user, or of all users if userID is 0.
+func (d *GormDatabase) GetEnabledWebhooks(userID uint) ([]*model.Webhook, error) {
+	var webhooks []*model.Webhook
+	db := d.DB.Where("disabled = ?", false)
+	if userID != 0 {
+		db = db.Where("user_id = ?", userID)
+	}
+	err := db.Order("id ASC").Find(&webhooks).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return webhooks, err
+}
+
+// UpdateWebhook updates a webhook.
+func (d *GormDatabase) UpdateWebhook(webhook *model.Webhook) error {
+	return d.DB.Save(webhook).Error
+}
+
+// DeleteWebhookByID deletes a webhook and its deliveries.
+func (d *GormDatabase) DeleteWebhookByID(id uint) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", id).Delete(&model.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&model.Webhook{}).Error
+	})
+}
+
+// CreateWebhookDeliveries creates the deliveries.
+func (d *GormDatabase) CreateWebhookDeliveries(deliveries []*model.WebhookDelivery) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		for _, delivery := range deliveries {
+			if err := tx.Create(delivery).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetWebhookDeliveryByID returns the delivery for the given id or nil.
+func (d *GormDatabase) GetWebhookDeliveryByID(id uint) (*model.WebhookDelivery, error) {
+	delivery := new(model.WebhookDelivery)
+	err := d.DB.Where("id = ?", id).First(delivery).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries whose next attempt is due at now, oldest first.
+func (d *GormDatabase) GetDueWebhookDeliveries(now time.Time, limit int) ([]*model.WebhookDelivery, error) {
+	var deliveries []*model.WebhookDelivery
+	err := d.DB.Where("status = ? AND julianday(next_attempt_at) <= julianday(?)", model.WebhookDeliveryPending, now).
+		Order("julianday(next_attempt_at) ASC, id ASC").Limit(limit).Find(&deliveries).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return deliveries, err
+}
+
+// GetNextWebhookDelivery returns the pending delivery which is attempted next or nil if there is none.
+func (d *GormDatabase) GetNextWebhookDelivery() (*model.WebhookDelivery, error) {
+	delivery := new(model.WebhookDelivery)
+	err := d.DB.Where("status = ?", model.WebhookDeliveryPending).Order("julianday(next_attempt_at) ASC").First(delivery).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// UpdateWebhookDelivery updates a delivery.
+func (d *GormDatabase) UpdateWebhookDelivery(delivery *model.WebhookDelivery) error {
+	return d.DB.Save(delivery).Error
+}
+
+// GetWebhookDeliveries returns up to limit deliveries of the webhook with an id lower than since, newest first.
+// All deliveries are returned if since is 0.
+func (d *GormDatabase) GetWebhookDeliveries(webhookID uint, limit int, since uint) ([]*model.WebhookDelivery, error) {
+	var deliveries []*model.WebhookDelivery
+	db := d.DB.Where("webhook_id = ?", webhookID)
+	if since != 0 {
+		db = db.Where("id < ?", since)
+	}
+	err := db.Order("id DESC").Limit(limit).Find(&deliveries).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return deliveries, err
+}
+
+// GetDeadWebhookDeliveriesByUser returns up to limit dead deliveries of all webhooks of the user
+// with an id lower than since, newest first. All dead deliveries are returned if since is 0.
+func (d *GormDatabase) GetDeadWebhookDeliveriesByUser(userID uint, limit int, since uint) ([]*model.WebhookDelivery, error) {
+	var deliveries []*model.WebhookDelivery
+	db := d.DB.Joins("JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id").
+		Where("webhooks.user_id = ? AND webhook_deliveries.status = ?", userID, model.WebhookDeliveryDead)
+	if since != 0 {
+		db = db.Where("webhook_deliveries.id < ?", since)
+	}
+	err := db.Order("webhook_deliveries.id DESC").Limit(limit).Find(&deliveries).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return deliveries, err
+}
+
+// DeleteWebhookDeliveriesBefore deletes the delivered and dead deliveries created before t.
+func (d *GormDatabase) DeleteWebhookDeliveriesBefore(t time.Time) error {
+	return d.DB.Where("status <> ? AND julianday(created_at) < julianday(?)", model.WebhookDeliveryPending, t).
+		Delete(&model.WebhookDelivery{}).Error
+}
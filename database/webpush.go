@@ -0,0 +1,71 @@
+package database
+
+import (
+	"github.com/jinzhu/gorm"
+	"go-notify/model"
+)
+
+// GetVAPIDKey returns the VAPID key of the server or nil if none was created yet.
+func (d *GormDatabase) GetVAPIDKey() (*model.VAPIDKey, error) {
+	key := new(model.VAPIDKey)
+	err := d.DB.Order("id ASC").First(key).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// CreateVAPIDKey stores the VAPID key of the server.
+func (d *GormDatabase) CreateVAPIDKey(key *model.VAPIDKey) error {
+	return d.DB.Create(key).Error
+}
+
+// SaveWebPushSubscription stores the subscription, replacing the previous subscription of the client.
+func (d *GormDatabase) SaveWebPushSubscription(subscription *model.WebPushSubscription) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("client_id = ?", subscription.ClientID).Delete(&model.WebPushSubscription{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(subscription).Error
+	})
+}
+
+// GetWebPushSubscriptionByClient returns the subscription of the client or nil.
+func (d *GormDatabase) GetWebPushSubscriptionByClient(clientID uint) (*model.WebPushSubscription, error) {
+	subscription := new(model.WebPushSubscription)
+	err := d.DB.Where("client_id = ?", clientID).First(subscription).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// GetWebPushSubscriptions returns the subscriptions of the user, or of all users if userID is 0.
+func (d *GormDatabase) GetWebPushSubscriptions(userID uint) ([]*model.WebPushSubscription, error) {
+	var subscriptions []*model.WebPushSubscription
+	query := d.DB.Order("id ASC")
+	if userID != 0 {
+		query = query.Where("user_id = ?", userID)
+	}
+	err := query.Find(&subscriptions).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return subscriptions, err
+}
+
+// DeleteWebPushSubscriptionByID deletes a subscription by its id.
+func (d *GormDatabase) DeleteWebPushSubscriptionByID(id uint) error {
+	return d.DB.Where("id = ?", id).Delete(&model.WebPushSubscription{}).Error
+}
+
+// DeleteWebPushSubscriptionByClient deletes the subscription of the client.
+func (d *GormDatabase) DeleteWebPushSubscriptionByClient(clientID uint) error {
+	return d.DB.Where("client_id = ?", clientID).Delete(&model.WebPushSubscription{}).Error
+}
@@ -1,21 +1,62 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	_ "time/tzdata" // 免打扰时间使用的时区不依赖系统的时区数据
+
+	"go-notify/config"
+	"go-notify/database"
+	"go-notify/mode"
+	"go-notify/model"
+	"go-notify/router"
+	"go-notify/runner"
 )
 
-//TIP <p>To run your code, right-click the code and select <b>Run</b>.</p> <p>Alternatively, click
-// the <icon src="AllIcons.Actions.Execute"/> icon in the gutter and select the <b>Run</b> menu item from here.</p>
+var (
+	// Version the version of go-notify.
+	Version = "unknown"
+	// Commit the git commit hash of this version.
+	Commit = "unknown"
+	// BuildDate the date on which this binary was build.
+	BuildDate = "unknown"
+	// Mode the build mode.
+	Mode = mode.Dev
+)
 
 func main() {
-	//TIP <p>Press <shortcut actionId="ShowIntentionActions"/> when your caret is at the underlined text
-	// to see how GoLand suggests fixing the warning.</p><p>Alternatively, if available, click the lightbulb to view possible fixes.</p>
-	s := "gopher"
-	fmt.Println("Hello and welcome, %s!", s)
-
-	for i := 1; i <= 5; i++ {
-		//TIP <p>To start your debugging session, right-click your code in the editor and select the Debug option.</p> <p>We have set one <icon src="AllIcons.Debugger.Db_set_breakpoint"/> breakpoint
-		// for you, but you can always add more by pressing <shortcut actionId="ToggleLineBreakpoint"/>.</p>
-		fmt.Println("i =", 100/i)
+	configPath := flag.String("config", "config.yml", "path to the yaml config file, GONOTIFY_* environment variables take precedence")
+	flag.Parse()
+
+	vInfo := &model.VersionInfo{Version: Version, Commit: Commit, BuildDate: BuildDate}
+	mode.Set(Mode)
+	fmt.Println("Starting go-notify version", vInfo.Version+"@"+BuildDate)
+
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Println("Error while loading the config", err)
+		os.Exit(1)
+	}
+
+	db, err := database.NewGormDatabase(conf.Database.Path, conf.DefaultUser.Name, conf.DefaultUser.Pass, conf.PassStrength)
+	if err != nil {
+		fmt.Println("Error while initializing the database", err)
+		os.Exit(1)
+	}
+
+	engine, closeRouter := router.CreateRouter(db, vInfo, conf)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// 断开所有推送连接并停止 HTTP 服务后再关闭数据库
+	runErr := runner.Run(ctx, engine, conf, closeRouter)
+	db.Close()
+	if runErr != nil {
+		fmt.Println("Server error:", runErr)
+		os.Exit(1)
 	}
 }
@@ -7,8 +7,10 @@ import (
 type AppUser struct {
 	AppID    uint       `gorm:"primary_key;foreignKey:AppID;references:Application.ID" json:"appId"` // 显式关联 Application.ID
 	UserID   uint       `gorm:"primary_key;foreignKey:UserID;references:User.ID" json:"userId"`      // 显式关联 User.ID
-	CreateAt *time.Time `gorm:"autoCreateTime" json:"createAt"`
-	DeleteAt *time.Time `gorm:"index" json:"deleteAt,omitempty"`
+	CreateAt *time.Time `gorm:"column:created_at" json:"createAt"`
+	DeleteAt *time.Time `gorm:"column:deleted_at;index" json:"deleteAt,omitempty"`
+	// 该用户已读到的最大消息ID，更大的消息是否已读记录在 message_reads 中
+	LastReadID uint `gorm:"column:last_read_id;not null;default:0" json:"lastReadId"`
 }
 
 // 可选：自定义表名（如果表名与模型名复数形式不同）
@@ -49,6 +49,22 @@ type Application struct {
 	// required: false
 	// example: 4
 	DefaultPriority int `form:"defaultPriority" query:"defaultPriority" json:"defaultPriority"`
+	// The default time to live of messages in seconds. Messages are kept until deleted when 0.
+	//
+	// required: false
+	// example: 3600
+	DefaultTTL int `form:"defaultTtl" query:"defaultTtl" json:"defaultTtl" binding:"min=0"`
+	// The maximum amount of messages kept, older messages are deleted. Unlimited when 0.
+	//
+	// required: false
+	// example: 100
+	MaxMessages int `form:"maxMessages" query:"maxMessages" json:"maxMessages" binding:"min=0"`
+	// Messages with the same title, message and priority as a message created by this application
+	// within this many seconds are not created again, the existing message is returned instead. Disabled when 0.
+	//
+	// required: false
+	// example: 60
+	DedupWindowSeconds int `form:"dedupWindowSeconds" query:"dedupWindowSeconds" json:"dedupWindowSeconds" binding:"min=0"`
 	// The last time the application token was used.
 	//
 	// read only: true
@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+// EmailSettings Model
+//
+// The address messages of the user are sent to by email. Only messages with at least minPriority are sent,
+// messages arriving in quick succession are combined into one email.
+//
+// swagger:model EmailSettings
+type EmailSettings struct {
+	UserID uint `gorm:"primary_key;auto_increment:false" json:"-"`
+	// The email address. No emails are sent if empty.
+	//
+	// required: false
+	// example: admin@example.com
+	Address string `gorm:"type:varchar(254)" form:"address" query:"address" json:"address" binding:"omitempty,email,max=254"`
+	// Messages with at least this priority are sent by email.
+	//
+	// required: false
+	// example: 8
+	MinPriority int `form:"minPriority" query:"minPriority" json:"minPriority" binding:"min=0"`
+}
+
+// EmailNotification holds a message waiting to be sent to the user by email.
+type EmailNotification struct {
+	ID            uint `gorm:"primary_key;AUTO_INCREMENT"`
+	UserID        uint `gorm:"index"`
+	MessageID     uint
+	Payload       []byte    // 入队时的消息内容
+	Attempts      int       // 已经失败的次数
+	NextAttemptAt time.Time `gorm:"index"`
+	CreatedAt     time.Time
+}
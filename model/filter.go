@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// MessageFilter narrows the messages returned by the list endpoints, zero values are ignored.
+type MessageFilter struct {
+	// Search matches the words against the title and the message.
+	Search string
+	// MinPriority and MaxPriority limit the priority range, both inclusive.
+	MinPriority *int
+	MaxPriority *int
+	// After and Before limit the date range, After is inclusive and Before exclusive.
+	After  *time.Time
+	Before *time.Time
+	// AppIDs only returns messages of these applications.
+	AppIDs []uint
+	// ExtrasKey only returns messages which have this top-level key in their extras.
+	ExtrasKey string
+	// Unread only returns messages the user has not read yet.
+	Unread bool
+}
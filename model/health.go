@@ -16,6 +16,11 @@ type Health struct {
 	// required: true
 	// example: green
 	Database string `json:"database"`
+	// The number of messages dropped because the send queue of a stream connection was full.
+	//
+	// required: true
+	// example: 0
+	DroppedMessages uint64 `json:"droppedMessages"`
 }
 
 const (
@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// IdempotencyKey remembers the response to a CreateMessage request sent with an Idempotency-Key header,
+// so retries of the request within the idempotency window return the original response.
+type IdempotencyKey struct {
+	ID            uint      `gorm:"AUTO_INCREMENT;primary_key"`
+	ApplicationID uint      `gorm:"unique_index:uix_idempotency_keys_application_key"`
+	Key           string    `gorm:"type:varchar(255);unique_index:uix_idempotency_keys_application_key"`
+	Status        int       // 响应的状态码，为 0 时表示请求仍在处理中
+	Response      []byte    // 原始响应的内容
+	CreatedAt     time.Time `gorm:"index"`
+}
@@ -13,6 +13,9 @@ type Message struct {
 	Priority      int
 	Extras        []byte
 	Date          time.Time
+	ExpiresAt     *time.Time `gorm:"index"`                  // 为 nil 时永不过期
+	ReplaceKey    string     `gorm:"type:varchar(180)"`      // 同一应用内唯一，创建时替换已有的消息
+	ContentHash   string     `gorm:"type:varchar(64);index"` // 标题、内容和优先级的哈希，用于去除重复的消息
 }
 
 // MessageExternal Model
@@ -63,4 +66,34 @@ type MessageExternal struct {
 	// required: true
 	// example: 2018-02-27T19:36:10.5045044+01:00
 	Date time.Time `json:"date"`
+	// The time after which the message is deleted. Takes precedence over ttl.
+	//
+	// required: false
+	// example: 2018-02-27T20:36:10.5045044+01:00
+	ExpiresAt *time.Time `form:"expiresAt" query:"expiresAt" json:"expiresAt,omitempty"`
+	// The time to live of the message in seconds, only accepted in CreateMessage requests.
+	// If neither ttl nor expiresAt is set, then the default ttl of the application will be used.
+	//
+	// required: false
+	// example: 3600
+	TTL int `form:"ttl" query:"ttl" json:"ttl,omitempty"`
+	// The time the message should be delivered, only accepted in CreateMessage requests.
+	// Until then the message is not listed and can be cancelled.
+	//
+	// required: false
+	// example: 2018-02-28T07:00:00+01:00
+	DeliverAt *time.Time `form:"deliverAt" query:"deliverAt" json:"deliverAt,omitempty"`
+	// A key unique per application. Creating a message with the key of an existing message
+	// replaces that message instead of adding a new one. The replacement gets a new id,
+	// clients receive a deleted event for the old id and an updated event with the replacement.
+	//
+	// required: false
+	// example: ci::build::1234
+	ReplaceKey string `form:"replaceKey" query:"replaceKey" json:"replaceKey,omitempty" binding:"max=180"`
+	// Whether the current user has read the message.
+	//
+	// read only: true
+	// required: true
+	// example: false
+	Read bool `form:"-" query:"-" json:"read"`
 }
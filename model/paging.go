@@ -20,6 +20,9 @@ type Paging struct {
 	Size int `json:"size"`
 	// The ID of the last message returned in the current request. Use this as alternative to the next link.
 	//
+	// The message lists are ordered newest first and the since query parameter returns only messages
+	// with an ID less than since, the long poll is ordered oldest first and returns only messages with an ID greater than since.
+	//
 	// read only: true
 	// required: true
 	// example: 5
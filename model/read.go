@@ -0,0 +1,59 @@
+package model
+
+import "time"
+
+// MessageRead marks a single message as read by a user.
+// Messages up to AppUser.LastReadID are read as well without having a row here.
+type MessageRead struct {
+	UserID    uint `gorm:"primary_key;auto_increment:false"`
+	MessageID uint `gorm:"primary_key;auto_increment:false;index"`
+	ReadAt    time.Time
+}
+
+// ApplicationUnreadCount Model
+//
+// The amount of unread messages of an application.
+//
+// swagger:model ApplicationUnreadCount
+type ApplicationUnreadCount struct {
+	// The application id.
+	//
+	// required: true
+	// example: 5
+	ApplicationID uint `json:"appid"`
+	// The amount of unread messages.
+	//
+	// required: true
+	// example: 3
+	Count int `json:"count"`
+}
+
+// UnreadCount Model
+//
+// The unread messages of a user broken down by application.
+//
+// swagger:model UnreadCount
+type UnreadCount struct {
+	// The amount of all unread messages.
+	//
+	// required: true
+	// example: 3
+	Total int `json:"total"`
+	// The unread messages per application, applications without unread messages are omitted.
+	//
+	// required: true
+	Applications []*ApplicationUnreadCount `json:"applications"`
+}
+
+// MarkReadRequest Model
+//
+// The messages to mark as read.
+//
+// swagger:model MarkReadRequest
+type MarkReadRequest struct {
+	// The message ids.
+	//
+	// required: true
+	// example: [1, 2]
+	IDs []uint `json:"ids" binding:"required,min=1"`
+}
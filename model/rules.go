@@ -0,0 +1,97 @@
+package model
+
+import "time"
+
+// NotificationRules Model
+//
+// The rules which decide whether a message is pushed to the clients of the user right away.
+// Messages are always stored, during quiet hours only messages with at least minPriority are pushed,
+// the others are pushed when the quiet hours end. Messages below the digest threshold are not pushed
+// individually, they are summarized in a digest sent once per period.
+//
+// swagger:model NotificationRules
+type NotificationRules struct {
+	UserID uint `gorm:"primary_key;auto_increment:false" json:"-"`
+	// Whether the quiet hours are enabled.
+	//
+	// required: true
+	// example: true
+	QuietHours bool `json:"quietHours"`
+	// The start of the quiet hours in the time zone of the user, formatted as HH:MM.
+	//
+	// required: false
+	// example: 22:00
+	QuietStart string `gorm:"type:varchar(5)" json:"quietStart"`
+	// The end of the quiet hours in the time zone of the user, formatted as HH:MM.
+	// The quiet hours span midnight if the end is before the start.
+	//
+	// required: false
+	// example: 07:00
+	QuietEnd string `gorm:"type:varchar(5)" json:"quietEnd"`
+	// The IANA time zone of the quiet hours and the digest. Defaults to UTC.
+	//
+	// required: false
+	// example: Europe/Berlin
+	TimeZone string `gorm:"type:varchar(64)" json:"timeZone"`
+	// Messages with at least this priority are pushed during quiet hours. If unset, no message is pushed.
+	//
+	// required: false
+	// example: 8
+	MinPriority *int `json:"minPriority"`
+	// How often messages below the digest threshold are summarized: hourly or daily.
+	// If empty, no digest is sent.
+	//
+	// required: false
+	// example: daily
+	Digest string `gorm:"type:varchar(8)" json:"digest" binding:"omitempty,oneof=hourly daily"`
+	// Messages with a lower priority than this are summarized in the digest instead of being pushed.
+	//
+	// required: false
+	// example: 4
+	DigestThreshold int `json:"digestThreshold" binding:"min=0"`
+	// The hour of the day the daily digest is sent at.
+	//
+	// required: false
+	// example: 18
+	DigestHour int `json:"digestHour" binding:"min=0,max=23"`
+	// Priorities used instead of the message priority for messages of these applications.
+	//
+	// required: false
+	ApplicationPriorities []ApplicationPriority `gorm:"foreignkey:UserID;association_foreignkey:UserID" json:"applicationPriorities" binding:"dive"`
+}
+
+// ApplicationPriority Model
+//
+// Overrides the priority of all messages of an application for a user.
+//
+// swagger:model ApplicationPriority
+type ApplicationPriority struct {
+	UserID uint `gorm:"primary_key;auto_increment:false" json:"-"`
+	// The application id.
+	//
+	// required: true
+	// example: 5
+	ApplicationID uint `gorm:"primary_key;auto_increment:false" json:"appid" binding:"required"`
+	// The priority used for the messages of the application.
+	//
+	// required: true
+	// example: 2
+	Priority int `json:"priority"`
+}
+
+// DeferredNotification holds a message which was not pushed to the user during quiet hours,
+// or which is summarized in the next digest of the user.
+type DeferredNotification struct {
+	UserID    uint      `gorm:"primary_key;auto_increment:false"`
+	MessageID uint      `gorm:"primary_key;auto_increment:false"`
+	DeliverAt time.Time `gorm:"index"`              // 免打扰时间结束或发送摘要的时间
+	Digest    bool      `gorm:"not null;default:0"` // 是否汇总到摘要中，而不是单独推送
+	Message   Message   `gorm:"foreignkey:MessageID"`
+}
+
+// UserDigestApplication links a user to the application the digests of the user are saved under,
+// so that digests are listed, replayed and marked read like any other message.
+type UserDigestApplication struct {
+	UserID        uint `gorm:"primary_key;auto_increment:false"`
+	ApplicationID uint `gorm:"unique_index"`
+}
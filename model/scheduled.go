@@ -0,0 +1,74 @@
+package model
+
+import "time"
+
+// ScheduledMessage holds a message which is created and delivered at DeliverAt.
+type ScheduledMessage struct {
+	ID            uint   `gorm:"AUTO_INCREMENT;primary_key;index"`
+	ApplicationID uint   `gorm:"index"`
+	Message       string `gorm:"type:text"`
+	Title         string `gorm:"type:text"`
+	Priority      int
+	Extras        []byte
+	TTL           int        // 投递时计算过期时间
+	ExpiresAt     *time.Time // 为 nil 时按 TTL 或应用的默认 TTL 计算
+	DeliverAt     time.Time  `gorm:"index"`
+	ReplaceKey    string     `gorm:"type:varchar(180)"`
+	CreatedAt     time.Time
+	Attempts      int // 投递失败的次数，失败后推迟 DeliverAt 重试
+}
+
+// ScheduledMessageExternal Model
+//
+// A message which will be delivered at a later time.
+//
+// swagger:model ScheduledMessage
+type ScheduledMessageExternal struct {
+	// The id of the scheduled message, it differs from the id the message gets on delivery.
+	//
+	// read only: true
+	// required: true
+	// example: 25
+	ID uint `json:"id"`
+	// The application id that send this message.
+	//
+	// read only: true
+	// required: true
+	// example: 5
+	ApplicationID uint `json:"appid"`
+	// The message.
+	//
+	// required: true
+	// example: **Backup** was successfully finished.
+	Message string `json:"message"`
+	// The title of the message.
+	//
+	// example: Backup
+	Title string `json:"title"`
+	// The priority of the message.
+	//
+	// example: 2
+	Priority int `json:"priority"`
+	// The extra data sent along the message.
+	Extras map[string]interface{} `json:"extras,omitempty"`
+	// The time to live of the message in seconds counted from the delivery.
+	//
+	// example: 3600
+	TTL int `json:"ttl,omitempty"`
+	// The time after which the message is deleted.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// The key which replaces an existing message on delivery.
+	//
+	// example: ci::build::1234
+	ReplaceKey string `json:"replaceKey,omitempty"`
+	// The time the message will be delivered.
+	//
+	// required: true
+	// example: 2018-02-27T07:00:00+01:00
+	DeliverAt time.Time `json:"deliverAt"`
+	// The time the message was scheduled.
+	//
+	// read only: true
+	// required: true
+	CreatedAt time.Time `json:"createdAt"`
+}
@@ -0,0 +1,53 @@
+package model
+
+import "time"
+
+// UnifiedPushRegistration Model
+//
+// A UnifiedPush registration of an app on a client. Each registration has its own application, the app server
+// pushes to the endpoint and the messages are delivered only to the client which registered.
+//
+// swagger:model UnifiedPushRegistration
+type UnifiedPushRegistration struct {
+	// The registration id.
+	//
+	// read only: true
+	// required: true
+	// example: 4
+	ID uint `gorm:"primary_key;AUTO_INCREMENT" json:"id"`
+	// The token the UnifiedPush connector identifies the registration with.
+	//
+	// required: true
+	// example: 6d7c1b4f-2a6e-4cbb-9d1c-0f3a8f1f2d3e
+	Token string `gorm:"type:varchar(255);unique_index:uix_unified_push_registrations_client_token" json:"token" binding:"required,max=255"`
+	// The name of the registered app.
+	//
+	// required: true
+	// example: org.example.chat
+	Name string `gorm:"type:text" json:"name" binding:"required"`
+	// The id of the client the messages are delivered to.
+	//
+	// read only: true
+	// required: true
+	// example: 5
+	ClientID uint `gorm:"unique_index:uix_unified_push_registrations_client_token" json:"clientId"`
+	UserID   uint `gorm:"index" json:"-"`
+	// The id of the application created for the registration.
+	//
+	// read only: true
+	// required: true
+	// example: 12
+	ApplicationID uint `gorm:"unique_index" json:"appid"`
+	// The url the app server pushes to.
+	//
+	// read only: true
+	// required: true
+	// example: https://push.example.com/UP?token=AWH0wZ5r0Mbac.r
+	Endpoint string `gorm:"-" json:"endpoint"`
+	// The date the app was registered.
+	//
+	// read only: true
+	// required: true
+	// example: 2019-01-01T00:00:00Z
+	CreatedAt time.Time `json:"createdAt"`
+}
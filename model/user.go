@@ -86,6 +86,11 @@ type UpdateUserExternal struct {
 //
 // swagger:model UserPass
 type UserExternalPass struct {
+	// The current password of the user.
+	//
+	// required: true
+	// example: unicorn
+	OldPass string `json:"oldPass,omitempty" form:"oldPass" query:"oldPass" binding:"required"`
 	// The user password. For login.
 	//
 	// required: true
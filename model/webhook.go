@@ -0,0 +1,121 @@
+package model
+
+import "time"
+
+// Webhook Model
+//
+// The Webhook holds an URL which receives the messages of the user as HTTP callbacks.
+// Each message is POSTed as JSON, the X-Signature header contains the hex encoded
+// HMAC-SHA256 of the request body keyed with the secret, prefixed with "sha256=".
+//
+// swagger:model Webhook
+type Webhook struct {
+	// The webhook id.
+	//
+	// read only: true
+	// required: true
+	// example: 5
+	ID     uint `gorm:"primary_key;AUTO_INCREMENT" json:"id"`
+	UserID uint `gorm:"index" json:"-"`
+	// The URL the messages are POSTed to.
+	//
+	// required: true
+	// example: https://example.com/hooks/go-notify
+	URL string `gorm:"type:text" form:"url" query:"url" json:"url" binding:"required,url,max=2048"`
+	// The secret used to sign the request body.
+	//
+	// read only: true
+	// required: true
+	// example: 2f7Uu0yLd6sT8k1PqQ9vZc3aXe5bNw4m
+	Secret string `gorm:"type:varchar(64)" json:"secret"`
+	// Only messages of this application are sent. All applications if 0.
+	//
+	// required: false
+	// example: 5
+	ApplicationID uint `form:"appid" query:"appid" json:"appid"`
+	// Only messages with at least this priority are sent.
+	//
+	// required: false
+	// example: 4
+	MinPriority int `form:"minPriority" query:"minPriority" json:"minPriority"`
+	// Whether sending messages to the webhook is paused.
+	//
+	// required: false
+	// example: false
+	Disabled bool `form:"disabled" query:"disabled" json:"disabled"`
+	// The date the webhook was created.
+	//
+	// read only: true
+	// required: true
+	// example: 2018-02-27T19:36:10.5045044+01:00
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	// WebhookDeliveryPending is the status of a delivery which is not yet delivered and will be retried.
+	WebhookDeliveryPending = "pending"
+	// WebhookDeliveryDelivered is the status of a delivery which was accepted by the receiver.
+	WebhookDeliveryDelivered = "delivered"
+	// WebhookDeliveryDead is the status of a delivery which failed too often and is not retried anymore.
+	WebhookDeliveryDead = "dead"
+)
+
+// WebhookDelivery Model
+//
+// A message sent to a webhook, including the result of the last attempt.
+//
+// swagger:model WebhookDelivery
+type WebhookDelivery struct {
+	// The delivery id, sent in the X-Delivery-ID header.
+	//
+	// read only: true
+	// required: true
+	// example: 25
+	ID        uint `gorm:"primary_key;AUTO_INCREMENT" json:"id"`
+	WebhookID uint `gorm:"index" json:"webhookId"`
+	// The id of the message.
+	//
+	// read only: true
+	// required: true
+	// example: 12
+	MessageID uint   `json:"messageId"`
+	Payload   []byte `json:"-"` // 发送时的消息内容，不受之后修改或删除消息的影响
+	// The status of the delivery: pending, delivered or dead.
+	//
+	// read only: true
+	// required: true
+	// example: pending
+	Status string `gorm:"type:varchar(16);index" json:"status"`
+	// The number of attempts made.
+	//
+	// read only: true
+	// required: true
+	// example: 2
+	Attempts int `json:"attempts"`
+	// The time of the next attempt, only set for pending deliveries.
+	//
+	// read only: true
+	// example: 2018-02-27T19:36:10.5045044+01:00
+	NextAttemptAt *time.Time `gorm:"index" json:"nextAttemptAt,omitempty"`
+	// The time of the last attempt.
+	//
+	// read only: true
+	// example: 2018-02-27T19:36:10.5045044+01:00
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty"`
+	// The HTTP status code returned by the receiver on the last attempt, 0 if there was no response.
+	//
+	// read only: true
+	// example: 503
+	LastStatusCode int `json:"lastStatusCode"`
+	// The error of the last attempt.
+	//
+	// read only: true
+	// example: unexpected status 503 Service Unavailable
+	LastError string `gorm:"type:text" json:"lastError,omitempty"`
+	// The date the delivery was created.
+	//
+	// read only: true
+	// required: true
+	// example: 2018-02-27T19:36:10.5045044+01:00
+	CreatedAt time.Time `json:"createdAt"`
+}
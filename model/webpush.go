@@ -0,0 +1,69 @@
+package model
+
+import "time"
+
+// VAPIDKey holds the key pair the server identifies itself with to the web push services (RFC 8292).
+type VAPIDKey struct {
+	ID         uint   `gorm:"primary_key;AUTO_INCREMENT"`
+	PrivateKey string `gorm:"type:text"` // PKCS #8, base64 编码
+	PublicKey  string `gorm:"type:text"` // 未压缩的 P-256 公钥, base64url 编码
+	CreatedAt  time.Time
+}
+
+// WebPushSubscription Model
+//
+// The push subscription of a browser client, as returned by PushSubscription.toJSON(). Messages are
+// delivered to the endpoint even if no tab of the web app is open.
+//
+// swagger:model WebPushSubscription
+type WebPushSubscription struct {
+	// The subscription id.
+	//
+	// read only: true
+	// required: true
+	// example: 3
+	ID uint `gorm:"primary_key;AUTO_INCREMENT" json:"id"`
+	// The id of the client the subscription belongs to.
+	//
+	// read only: true
+	// required: true
+	// example: 5
+	ClientID uint `gorm:"unique_index" json:"clientId"`
+	UserID   uint `gorm:"index" json:"-"`
+	// The push service endpoint.
+	//
+	// required: true
+	// example: https://fcm.googleapis.com/fcm/send/c1KrmpTuRm0:APA91bG...
+	Endpoint string `gorm:"type:varchar(2048)" json:"endpoint" binding:"required,url,max=2048"`
+	// The keys used to encrypt the messages.
+	//
+	// required: true
+	Keys WebPushKeys `gorm:"embedded" json:"keys"`
+	// The date the subscription was registered.
+	//
+	// read only: true
+	// required: true
+	// example: 2019-01-01T00:00:00Z
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebPushKeys Model
+//
+// swagger:model WebPushKeys
+type WebPushKeys struct {
+	// The P-256 public key of the client, base64url encoded.
+	//
+	// required: true
+	// example: BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4
+	P256dh string `gorm:"type:varchar(255)" json:"p256dh" binding:"required,max=255"`
+	// The authentication secret of the client, base64url encoded.
+	//
+	// required: true
+	// example: BTBZMqHH6r4Tts7J_aSIgg
+	Auth string `gorm:"type:varchar(255)" json:"auth" binding:"required,max=255"`
+}
+
+// TableName 避免 gorm 把 VAPID 拆分为 v_api_d
+func (VAPIDKey) TableName() string {
+	return "vapid_keys"
+}
@@ -1,8 +1,16 @@
 package router
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"go-notify/auth"
+	"go-notify/config"
+	"go-notify/database"
+	gerror "go-notify/error"
+	"go-notify/model"
+	"go-notify/service"
+	websockettools "go-notify/service/stream"
 	"net/http"
 	"path/filepath"
 	"regexp"
@@ -45,7 +53,9 @@ func NotFound(ctx *gin.Context) {
 	})
 }
 
-func CreateRouter() (g *gin.Engine, exit func()) {
+// CreateRouter creates the gin engine with all middleware and routes, the returned exit function
+// stops everything the router started.
+func CreateRouter(db *database.GormDatabase, vInfo *model.VersionInfo, conf *config.Configuration) (g *gin.Engine, exit func()) {
 	g = gin.New()
 
 	// nginx相关配置
@@ -60,7 +70,200 @@ func CreateRouter() (g *gin.Engine, exit func()) {
 		}
 	})
 
-	g.Use(gin.LoggerWithFormatter(logFormatter), gin.Recovery(), gerror.Handler(), location.Default())
+	g.Use(gin.LoggerWithFormatter(logFormatter), gin.Recovery(), gerror.GinErrorHandler(), service.Location())
 	g.NoRoute(NotFound)
 
+	messageHandler := &service.MessageService{
+		DB:                db,
+		IdempotencyWindow: time.Duration(conf.Idempotency.WindowSeconds) * time.Second,
+	}
+	streamCtx, cancelStream := context.WithCancel(context.Background())
+	streamHandler := websockettools.NewWebSocketStream(streamCtx,
+		time.Duration(conf.Server.Stream.PingPeriodSeconds)*time.Second,
+		time.Duration(conf.Server.Stream.PongTimeoutSeconds)*time.Second,
+		conf.Server.Stream.ReadLimit,
+		conf.Server.Stream.AllowedOrigins,
+		websockettools.QueueConfig{
+			Size:   conf.Server.Stream.QueueSize,
+			Policy: websockettools.OverflowPolicy(conf.Server.Stream.OverflowPolicy),
+		},
+		messageHandler.MessagesSince)
+	poller := service.NewLongPoller()
+	messageHandler.Poller = poller
+	messageHandler.Scheduler = service.NewScheduler()
+	vapidKey, err := service.LoadVAPIDKey(db)
+	if err != nil {
+		panic(fmt.Errorf("failed to load the VAPID key: %w", err))
+	}
+	// webhook 和 Web Push 的地址都由用户提供，使用同一份内部网络的放行名单
+	webhookGuard, err := service.NewWebhookGuard(conf.Webhook.AllowedHosts)
+	if err != nil {
+		panic(fmt.Errorf("invalid webhook allowed hosts: %w", err))
+	}
+	webPushNotifier := service.NewWebPushNotifier(db,
+		webhookGuard.Client(time.Duration(conf.WebPush.TimeoutSeconds)*time.Second),
+		vapidKey,
+		conf.WebPush.Subject)
+	liveNotifier := service.Notifiers{streamHandler, poller, webPushNotifier}
+	rulesNotifier := service.NewRulesNotifier(db, liveNotifier)
+	webhookNotifier := service.NewWebhookNotifier(db,
+		webhookGuard.Client(time.Duration(conf.Webhook.TimeoutSeconds)*time.Second),
+		conf.Webhook.MaxAttempts,
+		time.Duration(conf.Webhook.BackoffSeconds)*time.Second)
+	// webhook 用于对接其它系统，不受用户免打扰时间和摘要的影响
+	notifiers := service.Notifiers{rulesNotifier, webhookNotifier}
+	var emailNotifier *service.EmailNotifier
+	if conf.SMTP.Host != "" {
+		// 邮件只发送高优先级的消息，同样不受免打扰时间和摘要的影响
+		emailNotifier = service.NewEmailNotifier(db,
+			service.NewSMTPMailer(conf.SMTP.Host, conf.SMTP.Port, conf.SMTP.Username, conf.SMTP.Password,
+				conf.SMTP.Security, time.Duration(conf.SMTP.TimeoutSeconds)*time.Second),
+			conf.SMTP.From,
+			time.Duration(conf.SMTP.BatchSeconds)*time.Second,
+			conf.SMTP.MaxAttempts,
+			time.Duration(conf.SMTP.BackoffSeconds)*time.Second)
+		notifiers = append(notifiers, emailNotifier)
+		go emailNotifier.Run(streamCtx)
+	}
+	messageHandler.Notifier = notifiers
+	streamHandler.SetMarkRead(messageHandler.MarkRead)
+	janitor := &service.Janitor{
+		DB:                  db,
+		Notifier:            liveNotifier,
+		Interval:            time.Duration(conf.Retention.IntervalSeconds) * time.Second,
+		BatchSize:           conf.Retention.BatchSize,
+		IdempotencyWindow:   time.Duration(conf.Idempotency.WindowSeconds) * time.Second,
+		WebhookLogRetention: time.Duration(conf.Webhook.LogRetentionDays) * 24 * time.Hour,
+	}
+	go janitor.Run(streamCtx)
+	go messageHandler.RunScheduler(streamCtx)
+	go rulesNotifier.Run(streamCtx)
+	go webhookNotifier.Run(streamCtx)
+	go webPushNotifier.Run(streamCtx)
+	// 定期把仍在连接中的客户端令牌的最后使用时间写回数据库
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				connectedTokens := streamHandler.CollectConnectedClientTokens()
+				if len(connectedTokens) == 0 {
+					continue
+				}
+				now := time.Now()
+				db.UpdateClientTokensLastUsed(connectedTokens, &now)
+			case <-streamCtx.Done():
+				return
+			}
+		}
+	}()
+
+	authentication := auth.Auth{DB: db}
+	applicationHandler := service.ApplicationService{DB: db, ImageDir: conf.UploadedImagesDir}
+	clientHandler := service.ClientService{DB: db, NotifyDeleted: streamHandler.RemoveClientByToken}
+	userHandler := service.UserService{
+		DB:             db,
+		PasswordPolicy: auth.PasswordPolicy{MinLength: conf.PassMinLength, Strength: conf.PassStrength},
+		NotifyDeleted:  streamHandler.RemoveClient,
+	}
+	rulesHandler := service.NotificationRulesService{DB: db, Notifier: rulesNotifier}
+	webhookHandler := service.WebhookService{DB: db, Notifier: webhookNotifier, Guard: webhookGuard}
+	emailHandler := service.EmailService{DB: db}
+	webPushHandler := service.WebPushService{DB: db, Key: vapidKey, Guard: webhookGuard}
+	unifiedPushHandler := service.UnifiedPushService{DB: db, Notifier: streamHandler}
+	healthHandler := service.HealthService{DB: db, Stream: streamHandler}
+	versionHandler := service.VersionService{Info: vInfo}
+
+	g.GET("/health", healthHandler.Health)
+	g.GET("/version", versionHandler.Version)
+	g.StaticFS("/image", gin.Dir(conf.UploadedImagesDir, false))
+
+	g.Group("/").Use(authentication.RequireApplicationToken()).POST("/message", messageHandler.CreateMessage)
+	// UnifiedPush 的推送地址，应用服务器使用注册创建的应用令牌推送
+	g.GET("/UP", unifiedPushHandler.Discover)
+	g.Group("/").Use(authentication.RequireApplicationToken()).POST("/UP", unifiedPushHandler.Push)
+
+	clientAuth := g.Group("")
+	{
+		clientAuth.Use(authentication.RequireClient())
+		app := clientAuth.Group("/application")
+		{
+			app.GET("", applicationHandler.GetApplications)
+			app.POST("", applicationHandler.CreateApplication)
+			app.PUT("/:id", applicationHandler.UpdateApplication)
+			app.DELETE("/:id", applicationHandler.DeleteApplication)
+			app.POST("/:id/token", applicationHandler.RotateApplicationToken)
+			app.POST("/:id/image", applicationHandler.UploadApplicationImage)
+			app.DELETE("/:id/image", applicationHandler.RemoveApplicationImage)
+			app.GET("/:id/message", messageHandler.GetMessageWithApplication)
+			app.POST("/:id/read", messageHandler.MarkApplicationMessagesRead)
+			app.GET("/:id/scheduled", messageHandler.GetScheduledMessages)
+			app.DELETE("/:id/scheduled/:scheduledId", messageHandler.CancelScheduledMessage)
+		}
+		client := clientAuth.Group("/client")
+		{
+			client.GET("", clientHandler.GetClients)
+			client.POST("", clientHandler.CreateClient)
+			client.PUT("/:id", clientHandler.UpdateClient)
+			client.DELETE("/:id", clientHandler.DeleteClient)
+			client.POST("/:id/token", clientHandler.RotateClientToken)
+			client.GET("/:id/webpush", webPushHandler.GetWebPushSubscription)
+			client.POST("/:id/webpush", webPushHandler.RegisterWebPushSubscription)
+			client.DELETE("/:id/webpush", webPushHandler.DeleteWebPushSubscription)
+		}
+		message := clientAuth.Group("/message")
+		{
+			message.GET("", messageHandler.GetMessages)
+			message.GET("/poll", messageHandler.PollMessages)
+			message.GET("/unread/count", messageHandler.GetUnreadCount)
+			message.POST("/read", messageHandler.MarkMessagesRead)
+			message.POST("/read/all", messageHandler.MarkAllMessagesRead)
+			message.POST("/:id/read", messageHandler.MarkMessageRead)
+			message.PUT("/:id", messageHandler.UpdateMessage)
+			message.DELETE("", messageHandler.DeleteMessages)
+		}
+		webhook := clientAuth.Group("/webhook")
+		{
+			webhook.GET("", webhookHandler.GetWebhooks)
+			webhook.POST("", webhookHandler.CreateWebhook)
+			webhook.GET("/deadletter", webhookHandler.GetDeadLetters)
+			webhook.POST("/delivery/:id/retry", webhookHandler.RetryWebhookDelivery)
+			webhook.PUT("/:id", webhookHandler.UpdateWebhook)
+			webhook.DELETE("/:id", webhookHandler.DeleteWebhook)
+			webhook.POST("/:id/secret", webhookHandler.RotateWebhookSecret)
+			webhook.GET("/:id/delivery", webhookHandler.GetWebhookDeliveries)
+		}
+		clientAuth.GET("/webpush/vapidkey", webPushHandler.GetVAPIDPublicKey)
+		unifiedPush := clientAuth.Group("/unifiedpush")
+		{
+			unifiedPush.GET("", unifiedPushHandler.GetRegistrations)
+			unifiedPush.POST("", unifiedPushHandler.Register)
+			unifiedPush.DELETE("/:id", unifiedPushHandler.Unregister)
+		}
+		clientAuth.GET("/stream", streamHandler.GinHandler)
+		clientAuth.GET("/stream/sse", streamHandler.SSEHandler)
+		clientAuth.GET("/current/user", userHandler.GetCurrentUser)
+		clientAuth.POST("/current/user/password", userHandler.ChangePassword)
+		clientAuth.GET("/current/user/rules", rulesHandler.GetNotificationRules)
+		clientAuth.PUT("/current/user/rules", rulesHandler.UpdateNotificationRules)
+		clientAuth.GET("/current/user/email", emailHandler.GetEmailSettings)
+		clientAuth.PUT("/current/user/email", emailHandler.UpdateEmailSettings)
+	}
+
+	authAdmin := g.Group("/user")
+	{
+		authAdmin.Use(authentication.RequireAdmin())
+		authAdmin.GET("", userHandler.GetUsers)
+		authAdmin.POST("", userHandler.CreateUser)
+		authAdmin.GET("/:id", userHandler.GetUserByID)
+		authAdmin.PUT("/:id", userHandler.UpdateUserByID)
+		authAdmin.DELETE("/:id", userHandler.DeleteUserByID)
+	}
+
+	return g, func() {
+		cancelStream()
+		streamHandler.Close()
+		poller.Close()
+	}
 }
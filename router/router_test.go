@@ -0,0 +1,176 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/config"
+	"go-notify/database"
+	"go-notify/model"
+)
+
+func newTestRouter(t *testing.T) (*gin.Engine, *database.GormDatabase) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	conf := config.Default()
+	conf.Database.Path = filepath.Join(dir, "test.db")
+	conf.UploadedImagesDir = filepath.Join(dir, "images")
+	db, err := database.NewGormDatabase(conf.Database.Path, "admin", "pw", 4)
+	require.NoError(t, err)
+	engine, exit := CreateRouter(db, &model.VersionInfo{Version: "1.0.0"}, conf)
+	t.Cleanup(func() {
+		exit()
+		db.Close()
+	})
+	return engine, db
+}
+
+func request(engine *gin.Engine, method, path string, prepare func(req *http.Request)) *httptest.ResponseRecorder {
+	return requestWithBody(engine, method, path, "", prepare)
+}
+
+func requestWithBody(engine *gin.Engine, method, path, body string, prepare func(req *http.Request)) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if prepare != nil {
+		prepare(req)
+	}
+	engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func asAdmin(req *http.Request) {
+	req.SetBasicAuth("admin", "pw")
+}
+
+func TestCreateRouter_publicRoutes(t *testing.T) {
+	engine, _ := newTestRouter(t)
+
+	recorder := request(engine, http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"health":"green","database":"green","droppedMessages":0}`, recorder.Body.String())
+	recorder = request(engine, http.MethodGet, "/version", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"version":"1.0.0"`)
+	recorder = request(engine, http.MethodGet, "/does/not/exist", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Route /does/not/exist not found")
+}
+
+// routeTable 是 REST API 的路由，除 /health 和 /version 外都需要认证
+var routeTable = []struct{ method, path string }{
+	{http.MethodPost, "/message"},
+	{http.MethodGet, "/message"},
+	{http.MethodDelete, "/message"},
+	{http.MethodGet, "/application"},
+	{http.MethodPost, "/application"},
+	{http.MethodPut, "/application/1"},
+	{http.MethodDelete, "/application/1"},
+	{http.MethodPost, "/application/1/token"},
+	{http.MethodGet, "/application/1/message"},
+	{http.MethodGet, "/client"},
+	{http.MethodPost, "/client"},
+	{http.MethodPut, "/client/1"},
+	{http.MethodDelete, "/client/1"},
+	{http.MethodGet, "/current/user"},
+	{http.MethodGet, "/user"},
+	{http.MethodPost, "/user"},
+	{http.MethodGet, "/user/1"},
+	{http.MethodPut, "/user/1"},
+	{http.MethodDelete, "/user/1"},
+	{http.MethodGet, "/stream"},
+}
+
+func TestCreateRouter_routeTable(t *testing.T) {
+	engine, _ := newTestRouter(t)
+
+	registered := make(map[string]bool)
+	for _, route := range engine.Routes() {
+		registered[route.Method+" "+strings.ReplaceAll(route.Path, ":id", "1")] = true
+	}
+	for _, route := range routeTable {
+		assert.True(t, registered[route.method+" "+route.path], "%s %s is registered", route.method, route.path)
+	}
+	assert.True(t, registered["GET /health"])
+	assert.True(t, registered["GET /version"])
+}
+
+func TestCreateRouter_requiresAuthentication(t *testing.T) {
+	engine, _ := newTestRouter(t)
+
+	for _, route := range routeTable {
+		assert.Equal(t, http.StatusUnauthorized, request(engine, route.method, route.path, nil).Code, "%s %s", route.method, route.path)
+	}
+	wrongPassword := func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }
+	assert.Equal(t, http.StatusUnauthorized, request(engine, http.MethodGet, "/message", wrongPassword).Code)
+	// 用户凭证不能用来发送消息
+	assert.Equal(t, http.StatusForbidden, request(engine, http.MethodPost, "/message", asAdmin).Code)
+	assert.Equal(t, http.StatusOK, request(engine, http.MethodGet, "/message", asAdmin).Code)
+}
+
+func TestCreateRouter_applicationRoutes(t *testing.T) {
+	engine, _ := newTestRouter(t)
+
+	recorder := requestWithBody(engine, http.MethodPost, "/application", `{"name":"backup"}`, asAdmin)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var app model.Application
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &app))
+	assert.True(t, strings.HasPrefix(app.Token, "A"))
+
+	withAppToken := func(req *http.Request) { req.Header.Set("X-Gotify-Key", app.Token) }
+	recorder = requestWithBody(engine, http.MethodPost, "/message", `{"message":"done"}`, withAppToken)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = request(engine, http.MethodGet, "/application", asAdmin)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"name":"backup"`)
+	recorder = request(engine, http.MethodGet, "/application/"+strconv.Itoa(int(app.ID))+"/message", asAdmin)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"message":"done"`)
+}
+
+func TestCreateRouter_clientRoutes(t *testing.T) {
+	engine, _ := newTestRouter(t)
+
+	recorder := requestWithBody(engine, http.MethodPost, "/client", `{"name":"phone"}`, asAdmin)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var client model.Client
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &client))
+	withToken := func(token string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("X-Gotify-Key", token) }
+	}
+	assert.Equal(t, http.StatusOK, request(engine, http.MethodGet, "/client", withToken(client.Token)).Code)
+
+	clientPath := "/client/" + strconv.Itoa(int(client.ID))
+	recorder = request(engine, http.MethodPost, clientPath+"/token", withToken(client.Token))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var rotated model.Client
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &rotated))
+	assert.Equal(t, http.StatusUnauthorized, request(engine, http.MethodGet, "/client", withToken(client.Token)).Code)
+	assert.Equal(t, http.StatusOK, request(engine, http.MethodGet, "/client", withToken(rotated.Token)).Code)
+
+	assert.Equal(t, http.StatusOK, request(engine, http.MethodDelete, clientPath, asAdmin).Code)
+	assert.Equal(t, http.StatusUnauthorized, request(engine, http.MethodGet, "/client", withToken(rotated.Token)).Code)
+}
+
+func TestCreateRouter_userRoutes(t *testing.T) {
+	engine, _ := newTestRouter(t)
+
+	recorder := requestWithBody(engine, http.MethodPost, "/user", `{"name":"normal","pass":"long enough","admin":false}`, asAdmin)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	asNormal := func(req *http.Request) { req.SetBasicAuth("normal", "long enough") }
+
+	assert.Equal(t, http.StatusOK, request(engine, http.MethodGet, "/user", asAdmin).Code)
+	assert.Equal(t, http.StatusForbidden, request(engine, http.MethodGet, "/user", asNormal).Code, "the user routes require an admin")
+	recorder = request(engine, http.MethodGet, "/current/user", asNormal)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"name":"normal"`)
+}
@@ -0,0 +1,90 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-notify/config"
+)
+
+// Run starts the http (and if enabled the https) server and blocks until ctx is canceled or a server fails.
+// Afterwards closeStreams is called to end long-lived connections and the servers are shut down gracefully,
+// waiting at most the configured shutdown timeout.
+func Run(ctx context.Context, router http.Handler, conf *config.Configuration, closeStreams func()) error {
+	var servers []*http.Server
+	errs := make(chan error, 2)
+
+	if conf.Server.SSL.Enabled {
+		httpsServer := &http.Server{
+			Addr:    net.JoinHostPort(conf.Server.SSL.ListenAddr, strconv.Itoa(conf.Server.SSL.Port)),
+			Handler: router,
+		}
+		servers = append(servers, httpsServer)
+		go func() {
+			log.Println("Started listening for TLS connection on " + httpsServer.Addr)
+			errs <- httpsServer.ListenAndServeTLS(conf.Server.SSL.CertFile, conf.Server.SSL.CertKey)
+		}()
+	}
+
+	handler := router
+	if conf.Server.SSL.Enabled && conf.Server.SSL.RedirectToHTTPS {
+		handler = redirectToHTTPS(strconv.Itoa(conf.Server.SSL.Port))
+	}
+	httpServer := &http.Server{
+		Addr:    net.JoinHostPort(conf.Server.ListenAddr, strconv.Itoa(conf.Server.Port)),
+		Handler: handler,
+	}
+	servers = append(servers, httpServer)
+	go func() {
+		log.Println("Started listening for plain connection on " + httpServer.Addr)
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Println("Shutting down server")
+	case err := <-errs:
+		runErr = fmt.Errorf("could not start server: %w", err)
+	}
+
+	// SSE 等长连接请求不会自行结束，需要先关闭，否则 Shutdown 会一直等到超时
+	closeStreams()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(conf.Server.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Server %s shutdown: %v", server.Addr, err)
+		}
+	}
+	return runErr
+}
+
+func redirectToHTTPS(port string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+
+		target := "https://" + changePort(r.Host, port) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusFound)
+	}
+}
+
+func changePort(hostPort, port string) string {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		// Host 中没有端口
+		host = hostPort
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-notify/auth"
+	"go-notify/model"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// 应用图标的最大边长，上传的图片会被等比缩小到该尺寸以内
+	applicationImageSize = 256
+	// 上传图片的最大字节数
+	maxApplicationImageBytes = 10 << 20
+	// 上传图片的最大像素数，解码后的图片每个像素占用 4 字节
+	maxApplicationImagePixels = 4096 * 4096
+)
+
+type ApplicationDatabaseService interface {
+	CreateApplicationForUser(application *model.Application, userID uint) error
+	GetApplicationByToken(token string) (*model.Application, error)
+	GetApplicationByID(id uint) (*model.Application, error)
+	GetUnmanagedApplicationsByUser(userID uint) ([]*model.Application, error)
+	IsManagedApplication(id uint) (bool, error)
+	DeleteApplicationByID(id uint) error
+	UpdateApplication(application *model.Application) error
+	JudgeUserOwnsApplication(userID, appID uint) (bool, error)
+}
+
+type ApplicationService struct {
+	DB       ApplicationDatabaseService
+	ImageDir string // 上传的应用图标的存放目录，通过 /image 提供访问
+}
+
+// withResolvedImage 把数据库中保存的图标文件名转换为可访问的路径
+func withResolvedImage(app *model.Application) *model.Application {
+	if app.Image != "" {
+		resolved := *app
+		resolved.Image = "image/" + app.Image
+		return &resolved
+	}
+	return app
+}
+
+// 创建应用，创建者自动关注该应用
+func (a *ApplicationService) CreateApplication(ctx *gin.Context) {
+	app := model.Application{}
+	if err := ctx.Bind(&app); err == nil {
+		app.ID = 0
+		app.Token = auth.GenerateNotExistingToken(auth.GenerateApplicationToken, a.applicationExists)
+		app.Internal = false
+		app.Image = ""
+		app.LastUsed = nil
+		if success := successOrAbort(ctx, 500, a.DB.CreateApplicationForUser(&app, auth.GetUserID(ctx))); !success {
+			return
+		}
+		ctx.JSON(200, withResolvedImage(&app))
+	}
+}
+
+// 获取当前用户关注的所有应用，不包括 UnifiedPush 注册和消息摘要等由服务器管理的应用
+func (a *ApplicationService) GetApplications(ctx *gin.Context) {
+	apps, err := a.DB.GetUnmanagedApplicationsByUser(auth.GetUserID(ctx))
+	if success := successOrAbort(ctx, 500, err); !success {
+		return
+	}
+	for i, app := range apps {
+		apps[i] = withResolvedImage(app)
+	}
+	ctx.JSON(200, apps)
+}
+
+// 删除应用，会一并删除应用的所有消息和图标；内部应用不允许删除
+func (a *ApplicationService) DeleteApplication(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		app, ok := a.ownedApplication(ctx, id)
+		if !ok {
+			return
+		}
+		if app.Internal {
+			ctx.AbortWithError(400, errors.New("cannot delete internal application"))
+			return
+		}
+		if success := successOrAbort(ctx, 500, a.DB.DeleteApplicationByID(id)); !success {
+			return
+		}
+		a.removeImageFile(app.Image)
+	})
+}
+
+// 轮换应用令牌，旧令牌立即失效
+func (a *ApplicationService) RotateApplicationToken(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		app, ok := a.ownedApplication(ctx, id)
+		if !ok {
+			return
+		}
+		app.Token = auth.GenerateNotExistingToken(auth.GenerateApplicationToken, a.applicationExists)
+		app.LastUsed = nil
+		if success := successOrAbort(ctx, 500, a.DB.UpdateApplication(app)); !success {
+			return
+		}
+		ctx.JSON(200, withResolvedImage(app))
+	})
+}
+
+// 上传应用图标（表单字段 file），图片会被缩小并统一保存为 png
+func (a *ApplicationService) UploadApplicationImage(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		app, ok := a.ownedApplication(ctx, id)
+		if !ok {
+			return
+		}
+		file, err := ctx.FormFile("file")
+		if err == http.ErrMissingFile {
+			ctx.AbortWithError(400, errors.New("file with key 'file' must be present"))
+			return
+		} else if success := successOrAbort(ctx, 500, err); !success {
+			return
+		}
+		if file.Size > maxApplicationImageBytes {
+			ctx.AbortWithError(400, fmt.Errorf("file must not be larger than %d bytes", maxApplicationImageBytes))
+			return
+		}
+		src, err := file.Open()
+		if success := successOrAbort(ctx, 500, err); !success {
+			return
+		}
+		defer src.Close()
+		img, err := decodeImage(src, maxApplicationImagePixels)
+		if err != nil {
+			ctx.AbortWithError(400, err)
+			return
+		}
+
+		name, err := a.saveImage(resizeImage(img, applicationImageSize))
+		if success := successOrAbort(ctx, 500, err); !success {
+			return
+		}
+		oldImage := app.Image
+		app.Image = name
+		if success := successOrAbort(ctx, 500, a.DB.UpdateApplication(app)); !success {
+			a.removeImageFile(name)
+			return
+		}
+		a.removeImageFile(oldImage)
+		ctx.JSON(200, withResolvedImage(app))
+	})
+}
+
+// 删除应用图标
+func (a *ApplicationService) RemoveApplicationImage(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		app, ok := a.ownedApplication(ctx, id)
+		if !ok {
+			return
+		}
+		if app.Image == "" {
+			ctx.AbortWithError(400, fmt.Errorf("app with id %d does not have a customized image", id))
+			return
+		}
+		oldImage := app.Image
+		app.Image = ""
+		if success := successOrAbort(ctx, 500, a.DB.UpdateApplication(app)); !success {
+			return
+		}
+		a.removeImageFile(oldImage)
+		ctx.JSON(200, app)
+	})
+}
+
+// saveImage 以随机文件名保存图片，返回文件名
+func (a *ApplicationService) saveImage(img image.Image) (string, error) {
+	if err := os.MkdirAll(a.ImageDir, 0o755); err != nil {
+		return "", err
+	}
+	name := auth.GenerateNotExistingToken(func() string {
+		return auth.GenerateImageName() + ".png"
+	}, func(name string) bool {
+		_, err := os.Stat(filepath.Join(a.ImageDir, name))
+		return err == nil
+	})
+	out, err := os.Create(filepath.Join(a.ImageDir, name))
+	if err != nil {
+		return "", err
+	}
+	if err := png.Encode(out, img); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	return name, out.Close()
+}
+
+func (a *ApplicationService) removeImageFile(name string) {
+	if name == "" {
+		return
+	}
+	// 只删除图片目录下的文件
+	os.Remove(filepath.Join(a.ImageDir, filepath.Base(name)))
+}
+
+// 更新应用的名称、描述、默认优先级和消息保留设置
+func (a *ApplicationService) UpdateApplication(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		app, ok := a.ownedApplication(ctx, id)
+		if !ok {
+			return
+		}
+		newValues := &model.Application{}
+		if err := ctx.Bind(newValues); err == nil {
+			app.Name = newValues.Name
+			app.Description = newValues.Description
+			app.DefaultPriority = newValues.DefaultPriority
+			app.DefaultTTL = newValues.DefaultTTL
+			app.MaxMessages = newValues.MaxMessages
+			app.DedupWindowSeconds = newValues.DedupWindowSeconds
+			if success := successOrAbort(ctx, 500, a.DB.UpdateApplication(app)); !success {
+				return
+			}
+			ctx.JSON(200, withResolvedImage(app))
+		}
+	})
+}
+
+// ownedApplication 返回当前用户关注的应用，不存在或无权限时中止请求
+func (a *ApplicationService) ownedApplication(ctx *gin.Context, id uint) (*model.Application, bool) {
+	app, err := a.DB.GetApplicationByID(id)
+	if success := successOrAbort(ctx, 500, err); !success {
+		return nil, false
+	}
+	if app == nil {
+		ctx.AbortWithError(404, fmt.Errorf("app with id %d doesn't exists", id))
+		return nil, false
+	}
+	owns, err := a.DB.JudgeUserOwnsApplication(auth.GetUserID(ctx), id)
+	if success := successOrAbort(ctx, 500, err); !success {
+		return nil, false
+	}
+	if !owns {
+		ctx.AbortWithError(404, fmt.Errorf("app with id %d doesn't exists", id))
+		return nil, false
+	}
+	// 由服务器管理的应用只能通过对应的接口修改，例如删除 UnifiedPush 注册
+	managed, err := a.DB.IsManagedApplication(id)
+	if success := successOrAbort(ctx, 500, err); !success {
+		return nil, false
+	}
+	if managed {
+		ctx.AbortWithError(404, fmt.Errorf("app with id %d doesn't exists", id))
+		return nil, false
+	}
+	return app, true
+}
+
+func (a *ApplicationService) applicationExists(token string) bool {
+	app, _ := a.DB.GetApplicationByToken(token)
+	return app != nil
+}
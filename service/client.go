@@ -0,0 +1,121 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-notify/auth"
+	"go-notify/model"
+)
+
+type ClientDatabaseService interface {
+	CreateClient(client *model.Client) error
+	GetClientByToken(token string) (*model.Client, error)
+	GetClientByID(id uint) (*model.Client, error)
+	GetClientsByUser(userID uint) ([]*model.Client, error)
+	DeleteClientByID(id uint) error
+	UpdateClient(client *model.Client) error
+}
+
+type ClientService struct {
+	DB ClientDatabaseService
+	// NotifyDeleted 在客户端令牌失效（删除或轮换）时调用，用于断开使用这些令牌的推送连接
+	NotifyDeleted func(userID uint, tokens ...string)
+}
+
+// 获取当前用户的所有客户端（设备）
+func (c *ClientService) GetClients(ctx *gin.Context) {
+	clients, err := c.DB.GetClientsByUser(auth.GetUserID(ctx))
+	if success := successOrAbort(ctx, 500, err); !success {
+		return
+	}
+	ctx.JSON(200, clients)
+}
+
+// 为当前用户创建客户端，并生成客户端令牌
+func (c *ClientService) CreateClient(ctx *gin.Context) {
+	client := model.Client{}
+	if err := ctx.Bind(&client); err == nil {
+		client.ID = 0
+		client.Token = auth.GenerateNotExistingToken(auth.GenerateClientToken, c.clientExists)
+		client.UserID = auth.GetUserID(ctx)
+		client.LastUsed = nil
+		if success := successOrAbort(ctx, 500, c.DB.CreateClient(&client)); !success {
+			return
+		}
+		ctx.JSON(200, client)
+	}
+}
+
+// 重命名客户端
+func (c *ClientService) UpdateClient(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		client, ok := c.ownedClient(ctx, id)
+		if !ok {
+			return
+		}
+		newValues := &model.Client{}
+		if err := ctx.Bind(newValues); err == nil {
+			client.Name = newValues.Name
+			if success := successOrAbort(ctx, 500, c.DB.UpdateClient(client)); !success {
+				return
+			}
+			ctx.JSON(200, client)
+		}
+	})
+}
+
+// 删除客户端，并断开该客户端的推送连接
+func (c *ClientService) DeleteClient(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		client, ok := c.ownedClient(ctx, id)
+		if !ok {
+			return
+		}
+		if success := successOrAbort(ctx, 500, c.DB.DeleteClientByID(id)); !success {
+			return
+		}
+		c.notifyDeleted(client.UserID, client.Token)
+	})
+}
+
+// 轮换客户端令牌，使用旧令牌的推送连接会被立即断开
+func (c *ClientService) RotateClientToken(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		client, ok := c.ownedClient(ctx, id)
+		if !ok {
+			return
+		}
+		oldToken := client.Token
+		client.Token = auth.GenerateNotExistingToken(auth.GenerateClientToken, c.clientExists)
+		client.LastUsed = nil
+		if success := successOrAbort(ctx, 500, c.DB.UpdateClient(client)); !success {
+			return
+		}
+		c.notifyDeleted(client.UserID, oldToken)
+		ctx.JSON(200, client)
+	})
+}
+
+func (c *ClientService) notifyDeleted(userID uint, tokens ...string) {
+	if c.NotifyDeleted != nil {
+		c.NotifyDeleted(userID, tokens...)
+	}
+}
+
+// ownedClient 返回属于当前用户的客户端，不存在或无权限时中止请求
+func (c *ClientService) ownedClient(ctx *gin.Context, id uint) (*model.Client, bool) {
+	client, err := c.DB.GetClientByID(id)
+	if success := successOrAbort(ctx, 500, err); !success {
+		return nil, false
+	}
+	if client == nil || client.UserID != auth.GetUserID(ctx) {
+		ctx.AbortWithError(404, fmt.Errorf("client with id %d doesn't exists", id))
+		return nil, false
+	}
+	return client, true
+}
+
+func (c *ClientService) clientExists(token string) bool {
+	client, _ := c.DB.GetClientByToken(token)
+	return client != nil
+}
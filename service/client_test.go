@@ -0,0 +1,105 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/auth"
+	"go-notify/model"
+)
+
+// performRequest 以 userID 和 token 的身份调用处理函数，params 为路由参数
+func performRequest(handler gin.HandlerFunc, method, body string, userID uint, token string, params gin.Params) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(method, "/", strings.NewReader(body))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	ctx.Params = params
+	auth.RegisterAuthentication(ctx, nil, userID, token)
+	handler(ctx)
+	return recorder
+}
+
+func idParam(id uint) gin.Params {
+	return gin.Params{{Key: "id", Value: strconv.Itoa(int(id))}}
+}
+
+type revokedTokens struct {
+	userID uint
+	tokens []string
+}
+
+func newClientTestService(t *testing.T) (*ClientService, *[]revokedTokens) {
+	var revoked []revokedTokens
+	service := &ClientService{DB: newWebhookTestDatabase(t), NotifyDeleted: func(userID uint, tokens ...string) {
+		revoked = append(revoked, revokedTokens{userID: userID, tokens: tokens})
+	}}
+	return service, &revoked
+}
+
+func createTestClient(t *testing.T, service *ClientService, userID uint) *model.Client {
+	recorder := performRequest(service.CreateClient, http.MethodPost, `{"name":"phone"}`, userID, "", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	client := new(model.Client)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), client))
+	assert.True(t, strings.HasPrefix(client.Token, "C"))
+	stored, err := service.DB.GetClientByID(client.ID)
+	require.NoError(t, err)
+	assert.Equal(t, userID, stored.UserID)
+	return client
+}
+
+func TestClientService_rotateToken(t *testing.T) {
+	service, revoked := newClientTestService(t)
+	client := createTestClient(t, service, 1)
+
+	recorder := performRequest(service.RotateClientToken, http.MethodPost, "", 2, "", idParam(client.ID))
+	assert.Equal(t, http.StatusNotFound, recorder.Code, "clients of other users are not visible")
+	assert.Empty(t, *revoked)
+
+	recorder = performRequest(service.RotateClientToken, http.MethodPost, "", 1, "", idParam(client.ID))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var rotated model.Client
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &rotated))
+	assert.Equal(t, client.ID, rotated.ID)
+	assert.NotEqual(t, client.Token, rotated.Token)
+	assert.True(t, strings.HasPrefix(rotated.Token, "C"))
+	assert.Equal(t, []revokedTokens{{userID: 1, tokens: []string{client.Token}}}, *revoked,
+		"the streams of the old token are disconnected")
+
+	old, err := service.DB.GetClientByToken(client.Token)
+	require.NoError(t, err)
+	assert.Nil(t, old, "the old token is no longer valid")
+	current, err := service.DB.GetClientByToken(rotated.Token)
+	require.NoError(t, err)
+	require.NotNil(t, current)
+	assert.Equal(t, client.ID, current.ID)
+}
+
+func TestClientService_delete(t *testing.T) {
+	service, revoked := newClientTestService(t)
+	client := createTestClient(t, service, 1)
+
+	recorder := performRequest(service.DeleteClient, http.MethodDelete, "", 2, "", idParam(client.ID))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Empty(t, *revoked)
+
+	recorder = performRequest(service.DeleteClient, http.MethodDelete, "", 1, "", idParam(client.ID))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []revokedTokens{{userID: 1, tokens: []string{client.Token}}}, *revoked)
+	deleted, err := service.DB.GetClientByID(client.ID)
+	require.NoError(t, err)
+	assert.Nil(t, deleted)
+
+	recorder = performRequest(service.DeleteClient, http.MethodDelete, "", 1, "", idParam(client.ID))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Len(t, *revoked, 1)
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"go-notify/auth"
+	"go-notify/model"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	digestHourly = "hourly"
+	digestDaily  = "daily"
+	// digestExtrasKey 是摘要的 extras 中列出各应用消息ID的键
+	digestExtrasKey = "server::digest"
+	// maxDigestLines 摘要中每个应用最多列出的消息数量，其余的只计数
+	maxDigestLines = 10
+	// digestApplicationName 保存用户摘要的应用的名称
+	digestApplicationName = "Digest"
+)
+
+// DigestApplication 是摘要中一个应用的消息
+type DigestApplication struct {
+	ApplicationID uint   `json:"appid"`
+	Name          string `json:"name"`
+	MessageIDs    []uint `json:"messageIds"`
+}
+
+// digestUntil 返回消息应被汇总到的摘要的发送时间，消息不需要汇总时返回 false
+func digestUntil(rules *model.NotificationRules, message *model.MessageExternal, now time.Time) (time.Time, bool) {
+	if rules == nil || effectivePriority(rules, message) >= rules.DigestThreshold {
+		return time.Time{}, false
+	}
+	return nextDigest(rules, now)
+}
+
+// nextDigest 返回 now 之后下一次发送摘要的时间，没有开启摘要时返回 false
+func nextDigest(rules *model.NotificationRules, now time.Time) (time.Time, bool) {
+	if rules == nil || rules.Digest == "" {
+		return time.Time{}, false
+	}
+	loc, err := time.LoadLocation(rules.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	switch rules.Digest {
+	case digestHourly:
+		return time.Date(local.Year(), local.Month(), local.Day(), local.Hour()+1, 0, 0, 0, loc), true
+	case digestDaily:
+		next := time.Date(local.Year(), local.Month(), local.Day(), rules.DigestHour, 0, 0, 0, loc)
+		if !next.After(local) {
+			next = time.Date(local.Year(), local.Month(), local.Day()+1, rules.DigestHour, 0, 0, 0, loc)
+		}
+		return next, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// deliverDigests 把到期的摘要推送给用户，免打扰时间内的摘要推迟到免打扰时间结束
+func (r *RulesNotifier) deliverDigests() error {
+	now := timeNow()
+	userIDs, err := r.DB.GetDueDeferredUserIDs(now, true)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, userID := range userIDs {
+		if err := r.deliverDigest(userID, now); err != nil {
+			errs = append(errs, fmt.Errorf("digest of user %d: %w", userID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *RulesNotifier) deliverDigest(userID uint, now time.Time) error {
+	rules, err := r.DB.GetNotificationRules(userID)
+	if err != nil {
+		return err
+	}
+	if until, quiet := quietHoursEnd(rules, now); quiet {
+		return r.DB.RescheduleDeferredNotifications(userID, true, until)
+	}
+	due, err := r.DB.GetDueDeferredNotifications(userID, true, now)
+	if err != nil {
+		return err
+	}
+	if messages := pendingMessages(due, now); len(messages) > 0 {
+		return r.sendDigest(userID, due, messages, now)
+	}
+	return r.DB.DeleteDeferredNotifications(due)
+}
+
+// sendDigest 把摘要保存为用户摘要应用的消息，同时删除被汇总的通知，保存成功后再推送，
+// 保存失败时通知保留到下次重试，不会重复推送
+func (r *RulesNotifier) sendDigest(userID uint, deferred []*model.DeferredNotification, messages []*model.Message, now time.Time) error {
+	application, err := r.digestApplication(userID)
+	if err != nil {
+		return err
+	}
+	digest := toInternalMessage(r.buildDigest(messages, now))
+	digest.ApplicationID = application.ID
+	if err := r.DB.CreateDigestMessage(digest, deferred); err != nil {
+		return err
+	}
+	r.Next.Notify(userID, toExternalMessage(digest))
+	return nil
+}
+
+// digestApplication 返回保存用户摘要的应用，第一次发送摘要或者应用被删除后重新创建
+func (r *RulesNotifier) digestApplication(userID uint) (*model.Application, error) {
+	application, err := r.DB.GetDigestApplication(userID)
+	if err != nil || application != nil {
+		return application, err
+	}
+	application = &model.Application{
+		Name:        digestApplicationName,
+		Description: "Summaries of deferred and low-priority messages",
+		Token:       auth.GenerateNotExistingToken(auth.GenerateApplicationToken, r.applicationExists),
+	}
+	return application, r.DB.CreateDigestApplication(userID, application)
+}
+
+func (r *RulesNotifier) applicationExists(token string) bool {
+	app, _ := r.DB.GetApplicationByToken(token)
+	return app != nil
+}
+
+// buildDigest 按应用分组汇总消息，生成摘要消息，extras 中列出各应用的消息ID
+func (r *RulesNotifier) buildDigest(messages []*model.Message, now time.Time) *model.MessageExternal {
+	byApp := make(map[uint][]*model.Message)
+	var appIDs []uint
+	priority := 0
+	for _, m := range messages {
+		if _, ok := byApp[m.ApplicationID]; !ok {
+			appIDs = append(appIDs, m.ApplicationID)
+		}
+		byApp[m.ApplicationID] = append(byApp[m.ApplicationID], m)
+		priority = max(priority, m.Priority)
+	}
+	sort.Slice(appIDs, func(i, j int) bool { return appIDs[i] < appIDs[j] })
+
+	var body strings.Builder
+	applications := make([]*DigestApplication, 0, len(appIDs))
+	for _, appID := range appIDs {
+		app := &DigestApplication{ApplicationID: appID, Name: fmt.Sprintf("Application %d", appID)}
+		if application, err := r.DB.GetApplicationByID(appID); err == nil && application != nil {
+			app.Name = application.Name
+		}
+		appMessages := byApp[appID]
+		fmt.Fprintf(&body, "**%s** (%d)\n\n", app.Name, len(appMessages))
+		for i, m := range appMessages {
+			app.MessageIDs = append(app.MessageIDs, m.ID)
+			if i < maxDigestLines {
+				fmt.Fprintf(&body, "- #%d %s\n", m.ID, digestLine(m))
+			}
+		}
+		if len(appMessages) > maxDigestLines {
+			fmt.Fprintf(&body, "- and %d more\n", len(appMessages)-maxDigestLines)
+		}
+		body.WriteString("\n")
+		applications = append(applications, app)
+	}
+
+	title := fmt.Sprintf("%d new messages", len(messages))
+	if len(messages) == 1 {
+		title = "1 new message"
+	}
+	return &model.MessageExternal{
+		Title:    title,
+		Message:  strings.TrimSpace(body.String()),
+		Priority: priority,
+		Date:     now,
+		Extras:   map[string]interface{}{digestExtrasKey: map[string]interface{}{"applications": applications}},
+	}
+}
+
+// digestLine 返回摘要中代表一条消息的单行文本
+func digestLine(m *model.Message) string {
+	line := m.Message
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if runes := []rune(line); len(runes) > 80 {
+		line = string(runes[:80]) + "…"
+	}
+	if m.Title == "" {
+		return line
+	}
+	return m.Title + ": " + line
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go-notify/model"
+)
+
+func TestNextDigest(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	assert.NoError(t, err)
+	now := time.Date(2024, 5, 1, 10, 10, 0, 0, time.UTC) // 15:40 in Kolkata
+
+	next, ok := nextDigest(&model.NotificationRules{Digest: digestHourly, TimeZone: "Asia/Kolkata"}, now)
+	assert.True(t, ok)
+	assert.True(t, time.Date(2024, 5, 1, 16, 0, 0, 0, kolkata).Equal(next), next)
+
+	next, ok = nextDigest(&model.NotificationRules{Digest: digestDaily, DigestHour: 18, TimeZone: "Asia/Kolkata"}, now)
+	assert.True(t, ok)
+	assert.True(t, time.Date(2024, 5, 1, 18, 0, 0, 0, kolkata).Equal(next), next)
+
+	next, ok = nextDigest(&model.NotificationRules{Digest: digestDaily, DigestHour: 8}, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 5, 2, 8, 0, 0, 0, time.UTC), next)
+
+	_, ok = nextDigest(&model.NotificationRules{DigestThreshold: 5}, now)
+	assert.False(t, ok)
+}
+
+func TestDigestUntil(t *testing.T) {
+	rules := &model.NotificationRules{Digest: digestHourly, DigestThreshold: 4,
+		ApplicationPriorities: []model.ApplicationPriority{{ApplicationID: 2, Priority: 0}}}
+	now := time.Date(2024, 5, 1, 10, 10, 0, 0, time.UTC)
+
+	until, ok := digestUntil(rules, &model.MessageExternal{ApplicationID: 1, Priority: 3}, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), until)
+	_, ok = digestUntil(rules, &model.MessageExternal{ApplicationID: 1, Priority: 4}, now)
+	assert.False(t, ok)
+	_, ok = digestUntil(rules, &model.MessageExternal{ApplicationID: 2, Priority: 9}, now)
+	assert.True(t, ok)
+	_, ok = digestUntil(nil, &model.MessageExternal{ApplicationID: 1}, now)
+	assert.False(t, ok)
+}
+
+type fakeDigestDatabase struct {
+	NotificationRulesDatabaseService
+	apps map[uint]*model.Application
+}
+
+func (f *fakeDigestDatabase) GetApplicationByID(id uint) (*model.Application, error) {
+	return f.apps[id], nil
+}
+
+func TestBuildDigest(t *testing.T) {
+	notifier := NewRulesNotifier(&fakeDigestDatabase{apps: map[uint]*model.Application{2: {ID: 2, Name: "backup"}}}, nil)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	messages := []*model.Message{
+		{ID: 1, ApplicationID: 2, Title: "Backup", Message: "done\nin 5 minutes", Priority: 1},
+		{ID: 2, ApplicationID: 7, Message: "orphan", Priority: 3},
+		{ID: 3, ApplicationID: 2, Message: "again"},
+	}
+
+	digest := notifier.buildDigest(messages, now)
+	assert.Equal(t, "3 new messages", digest.Title)
+	assert.Equal(t, 3, digest.Priority)
+	assert.Equal(t, now, digest.Date)
+	assert.Equal(t, "**backup** (2)\n\n- #1 Backup: done\n- #3 again\n\n**Application 7** (1)\n\n- #2 orphan", digest.Message)
+	assert.Equal(t, map[string]interface{}{"applications": []*DigestApplication{
+		{ApplicationID: 2, Name: "backup", MessageIDs: []uint{1, 3}},
+		{ApplicationID: 7, Name: "Application 7", MessageIDs: []uint{2}},
+	}}, digest.Extras[digestExtrasKey])
+}
@@ -0,0 +1,417 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-notify/auth"
+	"go-notify/model"
+	"html"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// SMTP 连接的加密方式
+	SMTPSecurityNone     = "none"
+	SMTPSecuritySTARTTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+
+	// maxEmailWait 没有更早的邮件时也定期检查，避免系统时间调整后错过发送
+	maxEmailWait = time.Minute
+	// maxEmailBackoff 两次重试之间最长的等待时间
+	maxEmailBackoff = time.Hour
+)
+
+// Mailer 发送一封邮件
+type Mailer interface {
+	Send(from, to string, message []byte) error
+}
+
+// SMTPMailer 通过 SMTP 服务器发送邮件，支持 STARTTLS、隐式 TLS 以及 PLAIN 认证
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Security string
+	Timeout  time.Duration
+	// TLSConfig 为 nil 时按 Host 校验服务器证书
+	TLSConfig *tls.Config
+}
+
+func NewSMTPMailer(host string, port int, username, password, security string, timeout time.Duration) *SMTPMailer {
+	switch security {
+	case SMTPSecurityNone, SMTPSecuritySTARTTLS, SMTPSecurityTLS:
+	default:
+		panic("unknown SMTP security " + security)
+	}
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		Security: security,
+		Timeout:  timeout,
+	}
+}
+
+func (m *SMTPMailer) Send(from, to string, message []byte) error {
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	dialer := &net.Dialer{Timeout: m.Timeout}
+	var conn net.Conn
+	var err error
+	if m.Security == SMTPSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, m.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if m.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(m.Timeout))
+	}
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if m.Security == SMTPSecuritySTARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("the SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(m.tlsConfig()); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (m *SMTPMailer) tlsConfig() *tls.Config {
+	if m.TLSConfig != nil {
+		return m.TLSConfig
+	}
+	return &tls.Config{ServerName: m.Host}
+}
+
+// isPermanentMailError 判断发送失败是否不需要重试，SMTP 的 5xx 回复表示永久错误，其它错误都可以重试
+func isPermanentMailError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
+
+type EmailDatabaseService interface {
+	GetEmailSettings(userID uint) (*model.EmailSettings, error)
+	GetAllEmailSettings() ([]*model.EmailSettings, error)
+	SaveEmailSettings(settings *model.EmailSettings) error
+	CreateEmailNotification(notification *model.EmailNotification) error
+	GetDueEmailUserIDs(now time.Time) ([]uint, error)
+	GetEmailNotificationsByUser(userID uint) ([]*model.EmailNotification, error)
+	GetNextEmailNotification() (*model.EmailNotification, error)
+	RescheduleEmailNotifications(notifications []*model.EmailNotification, attempts int, next time.Time) error
+	DeleteEmailNotifications(notifications []*model.EmailNotification) error
+}
+
+// EmailNotifier 把不低于用户设置的优先级的消息发送到用户的邮箱。短时间内的多条消息合并为一封邮件，
+// 临时错误时按指数退避重试，待发送的消息保存在数据库中，重启后继续发送
+type EmailNotifier struct {
+	DB          EmailDatabaseService
+	Mailer      Mailer
+	From        string
+	BatchWindow time.Duration // 第一条消息到达后等待这段时间，期间到达的消息合并发送
+	MaxAttempts int
+	Backoff     time.Duration // 第一次重试前等待的时间，之后每次翻倍
+	wake        chan struct{}
+}
+
+func NewEmailNotifier(db EmailDatabaseService, mailer Mailer, from string, batchWindow time.Duration, maxAttempts int, backoff time.Duration) *EmailNotifier {
+	if maxAttempts < 1 || backoff <= 0 || batchWindow < 0 {
+		panic("the email attempts and backoff must be positive and the batch window must not be negative")
+	}
+	return &EmailNotifier{
+		DB:          db,
+		Mailer:      mailer,
+		From:        from,
+		BatchWindow: batchWindow,
+		MaxAttempts: maxAttempts,
+		Backoff:     backoff,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func (e *EmailNotifier) Notify(userID uint, message *model.MessageExternal) {
+	settings, err := e.DB.GetEmailSettings(userID)
+	if err != nil {
+		log.Printf("Failed to load the email settings of user %d: %v", userID, err)
+		return
+	}
+	e.enqueue(settings, message)
+}
+
+func (e *EmailNotifier) BroadcastNotify(message *model.MessageExternal) {
+	all, err := e.DB.GetAllEmailSettings()
+	if err != nil {
+		log.Printf("Failed to load email settings: %v", err)
+		return
+	}
+	for _, settings := range all {
+		e.enqueue(settings, message)
+	}
+}
+
+func (e *EmailNotifier) enqueue(settings *model.EmailSettings, message *model.MessageExternal) {
+	if settings == nil || settings.Address == "" || message.Priority < settings.MinPriority {
+		return
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to encode message %d for email: %v", message.ID, err)
+		return
+	}
+	now := timeNow()
+	err = e.DB.CreateEmailNotification(&model.EmailNotification{
+		UserID:        settings.UserID,
+		MessageID:     message.ID,
+		Payload:       payload,
+		NextAttemptAt: now.Add(e.BatchWindow),
+		CreatedAt:     now,
+	})
+	if err != nil {
+		log.Printf("Failed to queue message %d for email to user %d: %v", message.ID, settings.UserID, err)
+		return
+	}
+	wake(e.wake)
+}
+
+// Run 发送到期的邮件，直到 ctx 结束
+func (e *EmailNotifier) Run(ctx context.Context) {
+	for {
+		e.sendDue()
+		wait := maxEmailWait
+		next, err := e.DB.GetNextEmailNotification()
+		if err != nil {
+			log.Printf("Failed to query queued emails: %v", err)
+		} else if next != nil {
+			wait = max(min(next.NextAttemptAt.Sub(timeNow()), wait), 0)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-e.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (e *EmailNotifier) sendDue() {
+	userIDs, err := e.DB.GetDueEmailUserIDs(timeNow())
+	if err != nil {
+		log.Printf("Failed to query queued emails: %v", err)
+		return
+	}
+	for _, userID := range userIDs {
+		if err := e.sendToUser(userID); err != nil {
+			log.Printf("Failed to send email to user %d: %v", userID, err)
+		}
+	}
+}
+
+// sendToUser 把用户所有待发送的消息合并为一封邮件发送
+func (e *EmailNotifier) sendToUser(userID uint) error {
+	queued, err := e.DB.GetEmailNotificationsByUser(userID)
+	if err != nil || len(queued) == 0 {
+		return err
+	}
+	settings, err := e.DB.GetEmailSettings(userID)
+	if err != nil {
+		return err
+	}
+	if settings == nil || settings.Address == "" {
+		// 用户已经删除了邮箱地址
+		return e.DB.DeleteEmailNotifications(queued)
+	}
+	messages := make([]*model.MessageExternal, 0, len(queued))
+	attempts := 0
+	for _, n := range queued {
+		message := new(model.MessageExternal)
+		if err := json.Unmarshal(n.Payload, message); err != nil {
+			log.Printf("Dropping undecodable email notification %d: %v", n.ID, err)
+			continue
+		}
+		messages = append(messages, message)
+		attempts = max(attempts, n.Attempts)
+	}
+	var sendErr error
+	if len(messages) > 0 {
+		body, err := composeEmail(e.From, settings.Address, messages, timeNow())
+		if err != nil {
+			return err
+		}
+		sendErr = e.Mailer.Send(e.From, settings.Address, body)
+	}
+	attempts++
+	if sendErr == nil {
+		return e.DB.DeleteEmailNotifications(queued)
+	}
+	if isPermanentMailError(sendErr) || attempts >= e.MaxAttempts {
+		if err := e.DB.DeleteEmailNotifications(queued); err != nil {
+			return err
+		}
+		return fmt.Errorf("giving up after %d attempts: %w", attempts, sendErr)
+	}
+	if err := e.DB.RescheduleEmailNotifications(queued, attempts, timeNow().Add(e.backoff(attempts))); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// backoff 返回第 attempts 次失败后到下一次重试的等待时间
+func (e *EmailNotifier) backoff(attempts int) time.Duration {
+	wait := e.Backoff
+	for i := 1; i < attempts && wait < maxEmailBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxEmailBackoff)
+}
+
+// composeEmail 生成包含纯文本和 HTML 两部分的邮件，多条消息合并在一封邮件中
+func composeEmail(from, to string, messages []*model.MessageExternal, now time.Time) ([]byte, error) {
+	subject := messages[0].Title
+	if len(messages) > 1 {
+		subject = fmt.Sprintf("%d new messages", len(messages))
+	}
+	var text, htmlBody strings.Builder
+	htmlBody.WriteString("<!DOCTYPE html>\n<html><body>\n")
+	for i, m := range messages {
+		if i > 0 {
+			text.WriteString("\n\n----\n\n")
+			htmlBody.WriteString("<hr>\n")
+		}
+		if len(messages) > 1 {
+			text.WriteString(m.Title + "\n\n")
+			htmlBody.WriteString("<h2>" + html.EscapeString(m.Title) + "</h2>\n")
+		}
+		text.WriteString(m.Message)
+		text.WriteString("\n\n" + m.Date.Format(time.RFC1123Z))
+		htmlBody.WriteString(renderMarkdown(m.Message) + "\n")
+		htmlBody.WriteString("<p><small>" + html.EscapeString(m.Date.Format(time.RFC1123Z)) + "</small></p>\n")
+	}
+	htmlBody.WriteString("</body></html>\n")
+
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+	header := textproto.MIMEHeader{}
+	header.Set("From", from)
+	header.Set("To", to)
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header.Set("Date", now.Format(time.RFC1123Z))
+	header.Set("Message-ID", "<"+randomHex(16)+"@go-notify>")
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	for _, key := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"} {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, header.Get(key))
+	}
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text.String()},
+		{"text/html; charset=utf-8", htmlBody.String()},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// EmailService 管理当前用户的邮件通知设置
+type EmailService struct {
+	DB EmailDatabaseService
+}
+
+// 获取当前用户的邮件通知设置
+func (s *EmailService) GetEmailSettings(ctx *gin.Context) {
+	userID := auth.GetUserID(ctx)
+	settings, err := s.DB.GetEmailSettings(userID)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if settings == nil {
+		settings = &model.EmailSettings{UserID: userID}
+	}
+	ctx.JSON(http.StatusOK, settings)
+}
+
+// 修改当前用户的邮件通知设置，地址为空时不再发送邮件
+func (s *EmailService) UpdateEmailSettings(ctx *gin.Context) {
+	settings := &model.EmailSettings{}
+	if err := ctx.Bind(settings); err != nil {
+		return
+	}
+	settings.UserID = auth.GetUserID(ctx)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, s.DB.SaveEmailSettings(settings)); !success {
+		return
+	}
+	ctx.JSON(http.StatusOK, settings)
+}
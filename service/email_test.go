@@ -0,0 +1,365 @@
+package service
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+// fakeSMTPServer 是测试用的 SMTP 服务器，记录收到的邮件，mailReply 不为空时用它回复 MAIL 命令
+type fakeSMTPServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config // 不为 nil 时支持 STARTTLS
+
+	mu        sync.Mutex
+	mailReply string
+	auth      string
+	tls       bool
+	mails     []fakeMail
+}
+
+type fakeMail struct {
+	from, to string
+	data     string
+}
+
+func newFakeSMTPServer(t *testing.T, tlsConfig *tls.Config) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeSMTPServer{listener: listener, tlsConfig: tlsConfig}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) received() []fakeMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMail(nil), s.mails...)
+}
+
+func (s *fakeSMTPServer) setMailReply(reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mailReply = reply
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 127.0.0.1 ESMTP fake")
+	var current fakeMail
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO":
+			reply("250-127.0.0.1")
+			if s.tlsConfig != nil {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+			s.mu.Lock()
+			s.tls = true
+			s.mu.Unlock()
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			s.mu.Lock()
+			s.auth = string(credentials)
+			s.mu.Unlock()
+			reply("235 authenticated")
+		case "MAIL":
+			s.mu.Lock()
+			mailReply := s.mailReply
+			s.mu.Unlock()
+			if mailReply != "" {
+				reply(mailReply)
+				continue
+			}
+			current = fakeMail{from: line}
+			reply("250 ok")
+		case "RCPT":
+			current.to = line
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			current.data = data.String()
+			s.mu.Lock()
+			s.mails = append(s.mails, current)
+			s.mu.Unlock()
+			reply("250 queued")
+		case "RSET", "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+// testCertificate 生成 127.0.0.1 的自签名证书
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// parseTestEmail 返回邮件的标题以及纯文本和 HTML 两部分的内容
+func parseTestEmail(t *testing.T, data string) (subject, text, htmlBody string) {
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	require.NoError(t, err)
+	subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, "quoted-printable", part.Header.Get("Content-Transfer-Encoding"))
+		raw, err := io.ReadAll(quotedprintable.NewReader(part))
+		require.NoError(t, err)
+		content := strings.ReplaceAll(string(raw), "\r\n", "\n")
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "text/html") {
+			htmlBody = content
+		} else {
+			text = content
+		}
+	}
+	return subject, text, htmlBody
+}
+
+func TestSMTPMailer_startTLSAndAuth(t *testing.T) {
+	cert, pool := testCertificate(t)
+	server := newFakeSMTPServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	mailer := NewSMTPMailer("127.0.0.1", server.port(), "user", "pass", SMTPSecuritySTARTTLS, 5*time.Second)
+	mailer.TLSConfig = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+
+	require.NoError(t, mailer.Send("from@example.com", "to@example.com", []byte("Subject: hi\r\n\r\nhello\r\n")))
+	mails := server.received()
+	require.Len(t, mails, 1)
+	assert.Contains(t, mails[0].from, "<from@example.com>")
+	assert.Contains(t, mails[0].to, "<to@example.com>")
+	assert.Equal(t, "Subject: hi\r\n\r\nhello\r\n", mails[0].data)
+	server.mu.Lock()
+	assert.True(t, server.tls)
+	assert.Equal(t, "\x00user\x00pass", server.auth)
+	server.mu.Unlock()
+
+	plain := newFakeSMTPServer(t, nil)
+	mailer = NewSMTPMailer("127.0.0.1", plain.port(), "", "", SMTPSecuritySTARTTLS, 5*time.Second)
+	assert.ErrorContains(t, mailer.Send("from@example.com", "to@example.com", []byte("x")), "STARTTLS")
+	assert.Empty(t, plain.received())
+}
+
+func TestSMTPMailer_errors(t *testing.T) {
+	server := newFakeSMTPServer(t, nil)
+	mailer := NewSMTPMailer("127.0.0.1", server.port(), "", "", SMTPSecurityNone, 5*time.Second)
+
+	server.setMailReply("421 try again later")
+	err := mailer.Send("from@example.com", "to@example.com", []byte("x"))
+	require.Error(t, err)
+	assert.False(t, isPermanentMailError(err))
+
+	server.setMailReply("550 mailbox unavailable")
+	err = mailer.Send("from@example.com", "to@example.com", []byte("x"))
+	require.Error(t, err)
+	assert.True(t, isPermanentMailError(err))
+
+	assert.Panics(t, func() { NewSMTPMailer("127.0.0.1", 25, "", "", "ssl", time.Second) })
+}
+
+func TestEmailNotifier_batchesMessages(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	server := newFakeSMTPServer(t, nil)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	require.NoError(t, db.SaveEmailSettings(&model.EmailSettings{UserID: 1, Address: "admin@example.com", MinPriority: 5}))
+	require.NoError(t, db.SaveEmailSettings(&model.EmailSettings{UserID: 2, MinPriority: 0}))
+	mailer := NewSMTPMailer("127.0.0.1", server.port(), "", "", SMTPSecurityNone, 5*time.Second)
+	notifier := NewEmailNotifier(db, mailer, "go-notify@example.com", 30*time.Second, 3, time.Minute)
+
+	notifier.Notify(1, &model.MessageExternal{ID: 1, Title: "low", Message: "ignored", Priority: 4, Date: now})
+	notifier.Notify(1, &model.MessageExternal{ID: 2, Title: "Disk full", Message: "**sda1** is <full>", Priority: 8, Date: now})
+	notifier.Notify(2, &model.MessageExternal{ID: 3, Title: "no address", Message: "ignored", Priority: 10, Date: now})
+
+	// 在合并窗口内还不发送
+	notifier.sendDue()
+	assert.Empty(t, server.received())
+
+	now = now.Add(10 * time.Second)
+	notifier.Notify(1, &model.MessageExternal{ID: 4, Title: "Überhitzung", Message: "- cpu\n- gpu", Priority: 9, Date: now})
+	now = now.Add(20 * time.Second)
+	notifier.sendDue()
+
+	mails := server.received()
+	require.Len(t, mails, 1)
+	assert.Contains(t, mails[0].to, "<admin@example.com>")
+	subject, text, htmlBody := parseTestEmail(t, mails[0].data)
+	assert.Equal(t, "2 new messages", subject)
+	assert.Contains(t, text, "Disk full\n\n**sda1** is <full>")
+	assert.Contains(t, text, "Überhitzung")
+	assert.NotContains(t, text, "ignored")
+	assert.Contains(t, htmlBody, "<p><strong>sda1</strong> is &lt;full&gt;</p>")
+	assert.Contains(t, htmlBody, "<ul>\n<li>cpu</li>\n<li>gpu</li>\n</ul>")
+
+	next, err := db.GetNextEmailNotification()
+	require.NoError(t, err)
+	assert.Nil(t, next)
+
+	notifier.Notify(1, &model.MessageExternal{ID: 5, Title: "Grüße", Message: "single", Priority: 5, Date: now})
+	now = now.Add(30 * time.Second)
+	notifier.sendDue()
+	mails = server.received()
+	require.Len(t, mails, 2)
+	subject, _, _ = parseTestEmail(t, mails[1].data)
+	assert.Equal(t, "Grüße", subject)
+}
+
+func TestEmailNotifier_retriesTransientErrors(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	server := newFakeSMTPServer(t, nil)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	require.NoError(t, db.SaveEmailSettings(&model.EmailSettings{UserID: 1, Address: "admin@example.com"}))
+	mailer := NewSMTPMailer("127.0.0.1", server.port(), "", "", SMTPSecurityNone, 5*time.Second)
+	notifier := NewEmailNotifier(db, mailer, "go-notify@example.com", 0, 3, time.Minute)
+
+	server.setMailReply("421 try again later")
+	notifier.Notify(1, &model.MessageExternal{ID: 1, Title: "hello", Message: "world", Date: now})
+	notifier.sendDue()
+	queued, err := db.GetEmailNotificationsByUser(1)
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	assert.Equal(t, 1, queued[0].Attempts)
+	assert.True(t, now.Add(time.Minute).Equal(queued[0].NextAttemptAt))
+
+	// 还没到重试的时间
+	notifier.sendDue()
+	queued, _ = db.GetEmailNotificationsByUser(1)
+	assert.Equal(t, 1, queued[0].Attempts)
+
+	now = now.Add(time.Minute)
+	server.setMailReply("")
+	notifier.sendDue()
+	require.Len(t, server.received(), 1)
+	queued, _ = db.GetEmailNotificationsByUser(1)
+	assert.Empty(t, queued)
+
+	// 永久错误不再重试
+	server.setMailReply("550 mailbox unavailable")
+	notifier.Notify(1, &model.MessageExternal{ID: 2, Title: "hello", Message: "again", Date: now})
+	notifier.sendDue()
+	queued, _ = db.GetEmailNotificationsByUser(1)
+	assert.Empty(t, queued)
+	assert.Len(t, server.received(), 1)
+}
+
+func TestEmailNotifier_givesUpAfterMaxAttempts(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	require.NoError(t, db.SaveEmailSettings(&model.EmailSettings{UserID: 1, Address: "admin@example.com"}))
+	// 没有服务器监听的端口，连接失败属于临时错误
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	mailer := NewSMTPMailer("127.0.0.1", port, "", "", SMTPSecurityNone, time.Second)
+	notifier := NewEmailNotifier(db, mailer, "go-notify@example.com", 0, 2, time.Minute)
+
+	notifier.Notify(1, &model.MessageExternal{ID: 1, Title: "hello", Date: now})
+	notifier.sendDue()
+	queued, _ := db.GetEmailNotificationsByUser(1)
+	require.Len(t, queued, 1)
+	assert.Equal(t, 1, queued[0].Attempts)
+
+	now = now.Add(time.Minute)
+	notifier.sendDue()
+	queued, _ = db.GetEmailNotificationsByUser(1)
+	assert.Empty(t, queued, "dropped after "+strconv.Itoa(notifier.MaxAttempts)+" attempts")
+}
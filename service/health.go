@@ -0,0 +1,41 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-notify/model"
+)
+
+type HealthDatabaseService interface {
+	Ping() error
+}
+
+// StreamStats 提供推送连接的统计信息
+type StreamStats interface {
+	DroppedMessages() uint64
+}
+
+type HealthService struct {
+	DB     HealthDatabaseService
+	Stream StreamStats
+}
+
+// 健康检查，数据库不可用时返回500；同时返回因推送连接的发送队列已满而丢弃的消息总数
+func (h *HealthService) Health(ctx *gin.Context) {
+	var dropped uint64
+	if h.Stream != nil {
+		dropped = h.Stream.DroppedMessages()
+	}
+	if err := h.DB.Ping(); err != nil {
+		ctx.JSON(500, model.Health{
+			Health:          model.StatusOrange,
+			Database:        model.StatusRed,
+			DroppedMessages: dropped,
+		})
+		return
+	}
+	ctx.JSON(200, model.Health{
+		Health:          model.StatusGreen,
+		Database:        model.StatusGreen,
+		DroppedMessages: dropped,
+	})
+}
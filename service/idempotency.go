@@ -0,0 +1,116 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-notify/model"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// idempotencyKeyHeader 标识一次创建消息的请求，重试时带上相同的值不会重复创建消息
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader 标记返回的是第一次请求的响应
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	// 处理中的请求超过这个时间仍未完成时，认为该请求已经丢失，允许重新处理
+	idempotencyAbandonAfter = time.Minute
+)
+
+var (
+	errIdempotencyKeyTooLong    = fmt.Errorf("the %s header must not exceed %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	errIdempotencyKeyInProgress = errors.New("a request with the same " + idempotencyKeyHeader + " is still in progress")
+)
+
+type IdempotencyDatabaseService interface {
+	ReserveIdempotencyKey(appID uint, key string, since, abandonedBefore time.Time) (*model.IdempotencyKey, bool, error)
+	CompleteIdempotencyKey(id uint, status int, response []byte) error
+	DeleteIdempotencyKeyByID(id uint) error
+	FindDuplicateMessage(appID uint, contentHash string, since time.Time) (*model.Message, error)
+}
+
+// responseRecorder 在写出响应的同时记录响应的内容
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// withIdempotencyKey 处理带有 Idempotency-Key 请求头的请求：时间窗口内使用相同键的请求直接返回第一次请求的响应，
+// 第一次请求失败时释放该键，客户端可以重试
+func (mess *MessageService) withIdempotencyKey(ctx *gin.Context, appID uint, f func()) {
+	key := ctx.GetHeader(idempotencyKeyHeader)
+	if key == "" || mess.IdempotencyWindow <= 0 {
+		f()
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		ctx.AbortWithError(http.StatusBadRequest, errIdempotencyKeyTooLong)
+		return
+	}
+	now := timeNow()
+	record, reserved, err := mess.DB.ReserveIdempotencyKey(appID, key, now.Add(-mess.IdempotencyWindow), now.Add(-idempotencyAbandonAfter))
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if !reserved {
+		if record.Status == 0 {
+			ctx.AbortWithError(http.StatusConflict, errIdempotencyKeyInProgress)
+			return
+		}
+		ctx.Header(idempotentReplayedHeader, "true")
+		ctx.Data(record.Status, gin.MIMEJSON+"; charset=utf-8", record.Response)
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: ctx.Writer}
+	ctx.Writer = recorder
+	returned := false
+	defer func() {
+		// f 发生 panic 时同样恢复原来的 Writer 并释放该键，panic 继续交给 Recovery 中间件处理
+		ctx.Writer = recorder.ResponseWriter
+		var err error
+		if status := recorder.Status(); returned && !ctx.IsAborted() && status >= 200 && status < 300 {
+			err = mess.DB.CompleteIdempotencyKey(record.ID, status, recorder.body.Bytes())
+		} else {
+			err = mess.DB.DeleteIdempotencyKeyByID(record.ID)
+		}
+		if err != nil {
+			log.Printf("Failed to store the response for idempotency key %q of application %d: %v", key, appID, err)
+		}
+	}()
+	f()
+	returned = true
+}
+
+// findDuplicate 返回应用在去重时间窗口内创建的相同消息，没有开启去重或没有相同消息时返回 nil
+func (mess *MessageService) findDuplicate(application *model.Application, msg *model.Message) (*model.Message, error) {
+	if application.DedupWindowSeconds <= 0 || msg.ReplaceKey != "" {
+		return nil, nil
+	}
+	since := msg.Date.Add(-time.Duration(application.DedupWindowSeconds) * time.Second)
+	return mess.DB.FindDuplicateMessage(application.ID, msg.ContentHash, since)
+}
+
+// contentHash 计算标题、内容和优先级的哈希，用于找出重复的消息
+func contentHash(msg *model.Message) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", msg.Title, msg.Message, msg.Priority)
+	return hex.EncodeToString(h.Sum(nil))
+}
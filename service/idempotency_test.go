@@ -0,0 +1,132 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/auth"
+	"go-notify/database"
+	"go-notify/model"
+)
+
+func newIdempotencyTestService(t *testing.T, dedupWindowSeconds int) (*MessageService, *model.Application, *recordingNotifier) {
+	db := newWebhookTestDatabase(t)
+	app := &model.Application{Name: "backup", Token: "Abackup", DedupWindowSeconds: dedupWindowSeconds}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+	notifier := &recordingNotifier{}
+	return &MessageService{DB: db, Notifier: notifier, IdempotencyWindow: time.Hour}, app, notifier
+}
+
+// newMessageRequest 创建以应用令牌 Abackup 发送的创建消息请求，key 不为空时带上 Idempotency-Key 请求头
+func newMessageRequest(body, key string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(body))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		ctx.Request.Header.Set(idempotencyKeyHeader, key)
+	}
+	auth.RegisterAuthentication(ctx, nil, 1, "Abackup")
+	return ctx, recorder
+}
+
+func createMessageWithKey(service *MessageService, body, key string) *httptest.ResponseRecorder {
+	ctx, recorder := newMessageRequest(body, key)
+	service.CreateMessage(ctx)
+	return recorder
+}
+
+func TestIdempotencyKey_replaysTheFirstResponse(t *testing.T) {
+	service, _, notifier := newIdempotencyTestService(t, 0)
+
+	first := createMessageWithKey(service, `{"message":"backup done"}`, "run-1")
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Empty(t, first.Header().Get(idempotentReplayedHeader))
+	second := createMessageWithKey(service, `{"message":"backup done"}`, "run-1")
+	require.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "true", second.Header().Get(idempotentReplayedHeader))
+	assert.JSONEq(t, first.Body.String(), second.Body.String())
+	assert.Len(t, notifier.notifications, 1, "the retry does not create another message")
+
+	other := createMessageWithKey(service, `{"message":"backup done"}`, "run-2")
+	require.Equal(t, http.StatusOK, other.Code)
+	assert.Len(t, notifier.notifications, 2)
+}
+
+func TestIdempotencyKey_conflictWhileInProgress(t *testing.T) {
+	service, app, notifier := newIdempotencyTestService(t, 0)
+	now := time.Now()
+	_, reserved, err := service.DB.ReserveIdempotencyKey(app.ID, "busy", now.Add(-time.Hour), now.Add(-time.Minute))
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	recorder := createMessageWithKey(service, `{"message":"backup done"}`, "busy")
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Empty(t, notifier.notifications)
+}
+
+func TestIdempotencyKey_releasedOnFailure(t *testing.T) {
+	service, app, notifier := newIdempotencyTestService(t, 0)
+
+	recorder := createMessageWithKey(service, `{"message":"backup done","ttl":-1}`, "retry")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = createMessageWithKey(service, `{"message":"backup done"}`, "retry")
+	require.Equal(t, http.StatusOK, recorder.Code, "the client may retry after a client error")
+	assert.Empty(t, recorder.Header().Get(idempotentReplayedHeader))
+	assert.Len(t, notifier.notifications, 1)
+
+	ctx, recorder := newMessageRequest("", "server-error")
+	service.withIdempotencyKey(ctx, app.ID, func() {
+		ctx.AbortWithError(http.StatusInternalServerError, errors.New("database is locked"))
+	})
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	recorder = createMessageWithKey(service, `{"message":"backup done"}`, "server-error")
+	assert.Equal(t, http.StatusOK, recorder.Code, "the client may retry after a server error")
+
+	ctx, _ = newMessageRequest("", "panic")
+	writer := ctx.Writer
+	assert.Panics(t, func() {
+		service.withIdempotencyKey(ctx, app.ID, func() {
+			panic("boom")
+		})
+	})
+	assert.Equal(t, writer, ctx.Writer, "the original writer is restored for the recovery middleware")
+	recorder = createMessageWithKey(service, `{"message":"backup done"}`, "panic")
+	assert.Equal(t, http.StatusOK, recorder.Code, "the key is released after a panic")
+}
+
+func TestCreateMessage_dedupByContentHash(t *testing.T) {
+	service, _, notifier := newIdempotencyTestService(t, 60)
+
+	first := createMessageWithKey(service, `{"title":"Backup","message":"done","priority":2}`, "")
+	require.Equal(t, http.StatusOK, first.Code)
+	second := createMessageWithKey(service, `{"title":"Backup","message":"done","priority":2}`, "")
+	require.Equal(t, http.StatusOK, second.Code)
+	var firstMessage, secondMessage model.MessageExternal
+	require.NoError(t, json.Unmarshal(first.Body.Bytes(), &firstMessage))
+	require.NoError(t, json.Unmarshal(second.Body.Bytes(), &secondMessage))
+	assert.Equal(t, firstMessage.ID, secondMessage.ID, "the duplicate returns the existing message")
+	assert.Len(t, notifier.notifications, 1)
+
+	third := createMessageWithKey(service, `{"title":"Backup","message":"done","priority":5}`, "")
+	require.Equal(t, http.StatusOK, third.Code)
+	assert.Len(t, notifier.notifications, 2, "a different priority is not a duplicate")
+}
+
+func TestCreateMessage_applicationDeletedAfterAuthentication(t *testing.T) {
+	service, app, notifier := newIdempotencyTestService(t, 0)
+	require.NoError(t, service.DB.(*database.GormDatabase).DeleteApplicationByID(app.ID))
+
+	recorder := createMessageWithKey(service, `{"message":"backup done"}`, "run-1")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Empty(t, notifier.notifications)
+}
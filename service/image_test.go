@@ -0,0 +1,49 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 1024, 512))
+	for y := 0; y < 512; y++ {
+		for x := 0; x < 1024; x++ {
+			src.SetRGBA(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	resized := resizeImage(src, 256)
+	assert.Equal(t, image.Rect(0, 0, 256, 128), resized.Bounds())
+	assert.Equal(t, color.RGBA{R: 200, G: 100, B: 50, A: 255}, resized.At(100, 100))
+
+	small := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	assert.Same(t, small, resizeImage(small, 256))
+}
+
+func TestDecodeImage_rejectsHugeDimensions(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+	img, err := decodeImage(bytes.NewReader(buf.Bytes()), 16)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 1, 1), img.Bounds())
+
+	// 把 IHDR 中的尺寸改为 50000x50000，文件仍然只有几十字节
+	huge := bytes.Clone(buf.Bytes())
+	binary.BigEndian.PutUint32(huge[16:20], 50000)
+	binary.BigEndian.PutUint32(huge[20:24], 50000)
+	binary.BigEndian.PutUint32(huge[29:33], crc32.ChecksumIEEE(huge[12:29]))
+	_, err = decodeImage(bytes.NewReader(huge), maxApplicationImagePixels)
+	assert.EqualError(t, err, "image must not have more than 16777216 pixels")
+
+	_, err = decodeImage(bytes.NewReader([]byte("not an image")), maxApplicationImagePixels)
+	assert.Equal(t, errNotAnImage, err)
+}
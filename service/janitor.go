@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"go-notify/model"
+	"log"
+	"time"
+)
+
+type JanitorDatabaseService interface {
+	GetExpiredMessages(now time.Time, limit int) ([]*model.Message, error)
+	GetApplicationsWithMessageLimit() ([]*model.Application, error)
+	GetMessagesBeyondLimit(appID uint, keep, limit int) ([]*model.Message, error)
+	DeleteMessageByID(id []uint) error
+	GetApplicationUserIDs(appID uint) ([]uint, error)
+	DeleteIdempotencyKeysBefore(t time.Time) error
+	DeleteWebhookDeliveriesBefore(t time.Time) error
+}
+
+// Janitor 定期删除过期的消息和超出应用保留数量的旧消息，并通知在线的客户端；
+// 同时删除超出时间窗口的 Idempotency-Key 记录和旧的 webhook 投递记录
+type Janitor struct {
+	DB        JanitorDatabaseService
+	Notifier  DeletionNotifier
+	Interval  time.Duration
+	BatchSize int // 每次删除的最大消息数量，避免长时间占用数据库
+	// 超出这段时间的 Idempotency-Key 记录会被删除，为 0 时不清理
+	IdempotencyWindow time.Duration
+	// 超出这段时间的已完成的 webhook 投递记录会被删除，为 0 时不清理
+	WebhookLogRetention time.Duration
+}
+
+// Run 定期清理消息，直到 ctx 结束；间隔和批量大小在加载配置时已校验，这里的检查只防止错误的调用
+func (j *Janitor) Run(ctx context.Context) {
+	if j.Interval <= 0 || j.BatchSize < 1 {
+		panic("the retention interval and batch size must be positive")
+	}
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		if err := j.Clean(); err != nil {
+			log.Printf("Failed to clean up messages: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Clean 删除所有过期的消息和超出保留数量的消息，以及超出时间窗口的 Idempotency-Key 记录和旧的 webhook 投递记录
+func (j *Janitor) Clean() error {
+	now := timeNow()
+	if j.IdempotencyWindow > 0 {
+		if err := j.DB.DeleteIdempotencyKeysBefore(now.Add(-j.IdempotencyWindow)); err != nil {
+			return err
+		}
+	}
+	if j.WebhookLogRetention > 0 {
+		if err := j.DB.DeleteWebhookDeliveriesBefore(now.Add(-j.WebhookLogRetention)); err != nil {
+			return err
+		}
+	}
+	for {
+		messages, err := j.DB.GetExpiredMessages(now, j.BatchSize)
+		if err != nil {
+			return err
+		}
+		if err := j.delete(messages); err != nil {
+			return err
+		}
+		if len(messages) < j.BatchSize {
+			break
+		}
+	}
+	apps, err := j.DB.GetApplicationsWithMessageLimit()
+	if err != nil {
+		return err
+	}
+	for _, app := range apps {
+		for {
+			messages, err := j.DB.GetMessagesBeyondLimit(app.ID, app.MaxMessages, j.BatchSize)
+			if err != nil {
+				return err
+			}
+			if err := j.delete(messages); err != nil {
+				return err
+			}
+			if len(messages) < j.BatchSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// delete 删除一批消息，并通知关注这些应用的用户
+func (j *Janitor) delete(messages []*model.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(messages))
+	byApp := make(map[uint][]uint)
+	for i, m := range messages {
+		ids[i] = m.ID
+		byApp[m.ApplicationID] = append(byApp[m.ApplicationID], m.ID)
+	}
+	if err := j.DB.DeleteMessageByID(ids); err != nil {
+		return err
+	}
+	byUser := make(map[uint][]uint)
+	for appID, appMessageIDs := range byApp {
+		userIDs, err := j.DB.GetApplicationUserIDs(appID)
+		if err != nil {
+			log.Printf("Failed to resolve subscribers of application %d: %v", appID, err)
+			continue
+		}
+		for _, userID := range userIDs {
+			byUser[userID] = append(byUser[userID], appMessageIDs...)
+		}
+	}
+	for userID, userMessageIDs := range byUser {
+		j.Notifier.NotifyDeleted(userID, userMessageIDs)
+	}
+	return nil
+}
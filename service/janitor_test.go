@@ -0,0 +1,108 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go-notify/model"
+)
+
+type fakeJanitorDatabase struct {
+	messages         map[uint]*model.Message
+	apps             []*model.Application
+	users            map[uint][]uint
+	keysBefore       time.Time
+	deliveriesBefore time.Time
+}
+
+func (f *fakeJanitorDatabase) GetExpiredMessages(now time.Time, limit int) ([]*model.Message, error) {
+	var res []*model.Message
+	for id := uint(1); id <= 100 && len(res) < limit; id++ {
+		if m, ok := f.messages[id]; ok && m.ExpiresAt != nil && !m.ExpiresAt.After(now) {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeJanitorDatabase) GetApplicationsWithMessageLimit() ([]*model.Application, error) {
+	return f.apps, nil
+}
+
+func (f *fakeJanitorDatabase) GetMessagesBeyondLimit(appID uint, keep, limit int) ([]*model.Message, error) {
+	var res []*model.Message
+	kept := 0
+	for id := uint(100); id > 0 && len(res) < limit; id-- {
+		if m, ok := f.messages[id]; ok && m.ApplicationID == appID {
+			if kept < keep {
+				kept++
+				continue
+			}
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeJanitorDatabase) DeleteMessageByID(ids []uint) error {
+	for _, id := range ids {
+		delete(f.messages, id)
+	}
+	return nil
+}
+
+func (f *fakeJanitorDatabase) GetApplicationUserIDs(appID uint) ([]uint, error) {
+	return f.users[appID], nil
+}
+
+func (f *fakeJanitorDatabase) DeleteIdempotencyKeysBefore(t time.Time) error {
+	f.keysBefore = t
+	return nil
+}
+
+func (f *fakeJanitorDatabase) DeleteWebhookDeliveriesBefore(t time.Time) error {
+	f.deliveriesBefore = t
+	return nil
+}
+
+type recordingDeletionNotifier map[uint][]uint
+
+func (r recordingDeletionNotifier) NotifyDeleted(userID uint, messageIDs []uint) {
+	r[userID] = append(r[userID], messageIDs...)
+}
+
+func TestJanitorClean(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	db := &fakeJanitorDatabase{
+		messages: map[uint]*model.Message{},
+		apps:     []*model.Application{{ID: 2, MaxMessages: 2}},
+		users:    map[uint][]uint{1: {10}, 2: {10, 20}},
+	}
+	for id := uint(1); id <= 5; id++ {
+		db.messages[id] = &model.Message{ID: id, ApplicationID: 1, ExpiresAt: &past}
+	}
+	db.messages[6] = &model.Message{ID: 6, ApplicationID: 1, ExpiresAt: &future}
+	for id := uint(7); id <= 11; id++ {
+		db.messages[id] = &model.Message{ID: id, ApplicationID: 2}
+	}
+	notifier := recordingDeletionNotifier{}
+	janitor := &Janitor{DB: db, Notifier: notifier, Interval: time.Minute, BatchSize: 2, IdempotencyWindow: time.Hour,
+		WebhookLogRetention: 24 * time.Hour}
+
+	assert.NoError(t, janitor.Clean())
+
+	var remaining []uint
+	for id := range db.messages {
+		remaining = append(remaining, id)
+	}
+	assert.ElementsMatch(t, []uint{6, 10, 11}, remaining)
+	assert.ElementsMatch(t, []uint{1, 2, 3, 4, 5, 7, 8, 9}, notifier[10])
+	assert.ElementsMatch(t, []uint{7, 8, 9}, notifier[20])
+	assert.Equal(t, now.Add(-time.Hour), db.keysBefore)
+	assert.Equal(t, now.Add(-24*time.Hour), db.deliveriesBefore)
+}
@@ -2,13 +2,40 @@ package service
 
 import (
 	"github.com/gin-gonic/gin"
+	"net/http"
 	"net/url"
+	"strings"
 )
 
 const (
 	key = "location"
 )
 
+// Location returns a middleware which resolves the scheme and host the request was sent to and stores them
+// in the context. The X-Forwarded-Proto and X-Forwarded-Host headers of reverse proxies are honoured.
+func Location() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(key, resolveLocation(c.Request))
+		c.Next()
+	}
+}
+
+func resolveLocation(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		// 多级代理时取第一个值
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return &url.URL{Scheme: scheme, Host: host}
+}
+
 // Get returns the Location information for the incoming http.Request from the
 // context. If the location is not set a nil value is returned.
 func Get(c *gin.Context) *url.URL {
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// 消息使用的 markdown 子集：标题、段落、列表、引用、代码块，以及行内的代码、粗体、斜体和链接。
+// 消息中的 HTML 不被解释，一律转义
+var (
+	headingPattern     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	unorderedPattern   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	orderedPattern     = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	quotePattern       = regexp.MustCompile(`^\s*>\s?(.*)$`)
+	linkPattern        = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	strongPattern      = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	emphasisPattern    = regexp.MustCompile(`\*(\S(?:.*?\S)?)\*|\b_(\S(?:.*?\S)?)_\b`)
+	allowedLinkSchemes = []string{"http://", "https://", "mailto:"}
+)
+
+// renderMarkdown 把 markdown 转为 HTML
+func renderMarkdown(source string) string {
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	var out strings.Builder
+	var paragraph []string
+	list := ""
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + strings.Join(paragraph, "<br>\n") + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			out.WriteString("<" + tag + ">\n")
+			list = tag
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushParagraph()
+			closeList()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, html.EscapeString(lines[i]))
+			}
+			out.WriteString("<pre><code>" + strings.Join(code, "\n") + "</code></pre>\n")
+		case trimmed == "":
+			flushParagraph()
+			closeList()
+		case headingPattern.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			m := headingPattern.FindStringSubmatch(trimmed)
+			level := string(rune('0' + len(m[1])))
+			out.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+		case unorderedPattern.MatchString(line):
+			flushParagraph()
+			openList("ul")
+			out.WriteString("<li>" + renderInline(unorderedPattern.FindStringSubmatch(line)[1]) + "</li>\n")
+		case orderedPattern.MatchString(line):
+			flushParagraph()
+			openList("ol")
+			out.WriteString("<li>" + renderInline(orderedPattern.FindStringSubmatch(line)[1]) + "</li>\n")
+		case quotePattern.MatchString(line):
+			flushParagraph()
+			closeList()
+			var quote []string
+			for ; i < len(lines) && quotePattern.MatchString(lines[i]); i++ {
+				quote = append(quote, renderInline(quotePattern.FindStringSubmatch(lines[i])[1]))
+			}
+			i--
+			out.WriteString("<blockquote><p>" + strings.Join(quote, "<br>\n") + "</p></blockquote>\n")
+		default:
+			closeList()
+			paragraph = append(paragraph, renderInline(trimmed))
+		}
+	}
+	flushParagraph()
+	closeList()
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// renderInline 转换行内的标记，代码片段中的内容保持原样
+func renderInline(text string) string {
+	parts := strings.Split(text, "`")
+	var out strings.Builder
+	for i, part := range parts {
+		switch {
+		case i%2 == 1 && i < len(parts)-1:
+			out.WriteString("<code>" + html.EscapeString(part) + "</code>")
+		case i%2 == 1:
+			// 没有闭合的反引号按普通文本处理
+			out.WriteString("`" + renderEmphasis(part))
+		default:
+			out.WriteString(renderEmphasis(part))
+		}
+	}
+	return out.String()
+}
+
+// renderEmphasis 转换链接、粗体和斜体，粗体和斜体只在链接以外和链接文字中转换，避免改动链接地址
+func renderEmphasis(text string) string {
+	text = html.EscapeString(text)
+	var out strings.Builder
+	last := 0
+	for _, m := range linkPattern.FindAllStringSubmatchIndex(text, -1) {
+		href := text[m[4]:m[5]]
+		if !allowedLink(href) {
+			continue
+		}
+		out.WriteString(renderStrongAndEmphasis(text[last:m[0]]))
+		out.WriteString(`<a href="` + href + `">` + renderStrongAndEmphasis(text[m[2]:m[3]]) + "</a>")
+		last = m[1]
+	}
+	out.WriteString(renderStrongAndEmphasis(text[last:]))
+	return out.String()
+}
+
+func allowedLink(href string) bool {
+	for _, scheme := range allowedLinkSchemes {
+		if strings.HasPrefix(strings.ToLower(href), scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func renderStrongAndEmphasis(text string) string {
+	text = strongPattern.ReplaceAllString(text, "<strong>$1$2</strong>")
+	return emphasisPattern.ReplaceAllString(text, "<em>$1$2</em>")
+}
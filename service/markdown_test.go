@@ -0,0 +1,31 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	cases := []struct {
+		name, source, expected string
+	}{
+		{"paragraphs", "first\nline\n\nsecond", "<p>first<br>\nline</p>\n<p>second</p>"},
+		{"escapes html", "<script>alert(1)</script> & more", "<p>&lt;script&gt;alert(1)&lt;/script&gt; &amp; more</p>"},
+		{"heading", "## Backup *done* ##", "<h2>Backup <em>done</em></h2>"},
+		{"emphasis", "**bold** and _em_ but snake_case_name", "<p><strong>bold</strong> and <em>em</em> but snake_case_name</p>"},
+		{"code span", "run `rm **x**` now", "<p>run <code>rm **x**</code> now</p>"},
+		{"unclosed code span", "a ` b", "<p>a ` b</p>"},
+		{"link", "[status](https://example.com/?a=1&b=2)", `<p><a href="https://example.com/?a=1&amp;b=2">status</a></p>`},
+		{"emphasis in link", "[the *new* logs](https://example.com/_x_/a*b*c) and *more*", `<p><a href="https://example.com/_x_/a*b*c">the <em>new</em> logs</a> and <em>more</em></p>`},
+		{"unsafe link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"lists", "- a\n- b\n1. c", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol>\n<li>c</li>\n</ol>"},
+		{"quote", "> a\n> b\nc", "<blockquote><p>a<br>\nb</p></blockquote>\n<p>c</p>"},
+		{"code block", "```\n<b>**x**</b>\n```", "<pre><code>&lt;b&gt;**x**&lt;/b&gt;</code></pre>"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, renderMarkdown(c.source))
+		})
+	}
+}
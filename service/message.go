@@ -17,16 +17,26 @@ import (
 type MessageDatabaseService interface {
 	GetMessagesByApplicationSince(appID uint, limit int, since uint) ([]*model.Message, error)
 	GetApplicationByID(id uint) (*model.Application, error)
-	GetMessagesByUserSince(userID uint, limit int, since uint) ([]*model.Message, error)
+	GetMessagesByUserSince(userID uint, clientToken string, limit int, since uint) ([]*model.Message, error)
+	GetMessagesByUserAfter(userID uint, clientToken string, after uint, limit int) ([]*model.Message, error)
 	GetBroadcastMessage(limit int) ([]*model.Message, error)
 	DeleteMessageByID(id []uint) error
 	GetMessageByID(id uint) (*model.Message, error)
 	DeleteMessagesByUser(userID uint) error
 	DeleteMessagesByApplication(applicationID uint) error
 	CreateMessage(message *model.Message) error
+	CreateOrReplaceMessage(message *model.Message) (uint, error)
+	ReplaceMessage(replacedID uint, message *model.Message) error
 	GetApplicationByToken(token string) (*model.Application, error)
+	IsManagedApplication(id uint) (bool, error)
 	JudgeUserOwnsApplication(userID, appID uint) (bool, error)
 	IsUserAlloweOpMessage(userID uint, msgID []uint) (bool, error)
+	GetApplicationUserIDs(appID uint) ([]uint, error)
+	SearchMessagesByUser(userID uint, clientToken string, filter *model.MessageFilter, limit int, since uint) ([]*model.Message, error)
+	SearchMessagesByApplication(userID uint, clientToken string, appID uint, filter *model.MessageFilter, limit int, since uint) ([]*model.Message, error)
+	ReadDatabaseService
+	ScheduledDatabaseService
+	IdempotencyDatabaseService
 }
 
 var timeNow = time.Now
@@ -37,10 +47,18 @@ type Notifier interface {
 }
 
 type MessageService struct {
-	DB       MessageDatabaseService
-	Notifier Notifier
+	DB        MessageDatabaseService
+	Notifier  Notifier
+	Poller    *LongPoller // 长轮询请求的等待队列，需要同时注册到 Notifier 中
+	Scheduler *Scheduler  // 唤醒投递定时消息的协程
+	// 相同 Idempotency-Key 的请求在这段时间内返回第一次请求的响应，为 0 时忽略该请求头
+	IdempotencyWindow time.Duration
 }
 
+// pagingParams 是消息列表的分页参数。GET /message 和 GET /application/:id/message 按 ID 从新到旧分页，
+// since 不为 0 时只返回 ID 小于 since 的消息，和 next 链接中的 since 含义一致；
+// 之前的版本返回 ID 大于 since 的最新消息，按 next 链接翻页时会重复返回第一页。
+// 长轮询 GET /message/poll 按 ID 从旧到新分页，since 表示只返回 ID 大于 since 的消息
 type pagingParams struct {
 	Limit int  `form:"limit" binding:"min=1,max=200"`
 	Since uint `form:"since" binding:"min=0"`
@@ -49,7 +67,7 @@ type pagingParams struct {
 // 获取分页参数的信息并执行回调函数
 func withPaging(ctx *gin.Context, f func(params *pagingParams)) {
 	params := &pagingParams{
-		Since: 1, // 增加默认页码
+		Since: 0, // 0 表示不限制
 		Limit: 100,
 	}
 
@@ -75,6 +93,8 @@ func toExternalMessage(msg *model.Message) *model.MessageExternal {
 		Title:         msg.Title,
 		Priority:      msg.Priority,
 		Date:          msg.Date,
+		ExpiresAt:     msg.ExpiresAt,
+		ReplaceKey:    msg.ReplaceKey,
 	}
 	if len(msg.Extras) != 0 {
 		res.Extras = make(map[string]interface{})
@@ -97,11 +117,12 @@ func buildWithPaging(ctx *gin.Context, paging *pagingParams, messages []*model.M
 	if len(messages) > paging.Limit {
 		useMessages = messages[:len(messages)-1]
 		since = useMessages[len(useMessages)-1].ID
-		url := Get(ctx)
+		url := *Get(ctx)
 		url.Path = ctx.Request.URL.Path
-		query := url.Query()
-		query.Add("limit", strconv.Itoa(paging.Limit))
-		query.Add("since", strconv.FormatUint(uint64(since), 10))
+		// 保留过滤条件，只替换分页参数
+		query := ctx.Request.URL.Query()
+		query.Set("limit", strconv.Itoa(paging.Limit))
+		query.Set("since", strconv.FormatUint(uint64(since), 10))
 		url.RawQuery = query.Encode()
 		next = url.String()
 	}
@@ -112,19 +133,33 @@ func buildWithPaging(ctx *gin.Context, paging *pagingParams, messages []*model.M
 }
 
 // 获取指定用户ID的所有消息
-// 用户可能关注了不同的板块(应用程序)，需要返回所有板块的消息，包含系统信息
+// 用户可能关注了不同的板块(应用程序)，需要返回所有板块的消息，包含系统信息；UnifiedPush 注册的消息只返回给注册的客户端
+// 支持的过滤条件见 parseMessageFilter
 func (mess *MessageService) GetMessages(ctx *gin.Context) {
 	userID := auth.TryGetUserID(ctx)
+	filter, err := parseMessageFilter(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
 	withPaging(ctx, func(params *pagingParams) {
-		messages, err := mess.DB.GetMessagesByUserSince(userID, params.Limit+1, params.Since)
+		messages, err := mess.DB.SearchMessagesByUser(userID, auth.GetTokenID(ctx), filter, params.Limit+1, params.Since)
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
 			return
 		}
-		ctx.JSON(http.StatusOK, buildWithPaging(ctx, params, messages))
+		mess.respondWithReadState(ctx, userID, buildWithPaging(ctx, params, messages))
 	})
 }
 
+// respondWithReadState 设置消息的已读状态后返回分页结果
+func (mess *MessageService) respondWithReadState(ctx *gin.Context, userID uint, paged *model.PagedMessages) {
+	if success := successOrAbort(ctx, http.StatusInternalServerError, mess.withReadState(userID, paged.Messages)); !success {
+		return
+	}
+	ctx.JSON(http.StatusOK, paged)
+}
+
 func withIntegerParam(ctx *gin.Context, param string, f func(id uint)) {
 	if id, err := strconv.ParseUint(ctx.Param(param), 10, bits.UintSize); err == nil {
 		f(uint(id))
@@ -133,18 +168,33 @@ func withIntegerParam(ctx *gin.Context, param string, f func(id uint)) {
 	}
 }
 
-// 需要有用户信息和待求的应用程序ID
+// MessagesSince 返回用户ID大于 since 的最早 limit 条消息，按ID从小到大排列，用于推送连接重连时分页补发；
+// 其它客户端的 UnifiedPush 注册的消息不补发
+func (mess *MessageService) MessagesSince(userID uint, clientToken string, since uint, limit int) ([]*model.MessageExternal, error) {
+	messages, err := mess.DB.GetMessagesByUserAfter(userID, clientToken, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	return toExternalMessages(messages), nil
+}
+
+// 需要有用户信息和待求的应用程序ID，支持的过滤条件见 parseMessageFilter
 func (mess *MessageService) GetMessageWithApplication(ctx *gin.Context) {
+	filter, err := parseMessageFilter(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
 	withIntegerParam(ctx, "id", func(id uint) {
 		withPaging(ctx, func(params *pagingParams) {
 			userID := auth.GetUserID(ctx)
 			if res, err := mess.DB.JudgeUserOwnsApplication(userID, id); res == true && err == nil {
 				// the +1 is used to check if there are more messages and will be removed on buildWithPaging
-				messages, err := mess.DB.GetMessagesByApplicationSince(id, params.Limit+1, params.Since)
+				messages, err := mess.DB.SearchMessagesByApplication(userID, auth.GetTokenID(ctx), id, filter, params.Limit+1, params.Since)
 				if success := successOrAbort(ctx, 500, err); !success {
 					return
 				}
-				ctx.JSON(200, buildWithPaging(ctx, params, messages))
+				mess.respondWithReadState(ctx, userID, buildWithPaging(ctx, params, messages))
 			} else {
 				ctx.AbortWithError(404, errors.New("application does not exist"))
 			}
@@ -194,6 +244,8 @@ func toInternalMessage(msg *model.MessageExternal) *model.Message {
 		Message:       msg.Message,
 		Title:         msg.Title,
 		Date:          msg.Date,
+		ExpiresAt:     msg.ExpiresAt,
+		ReplaceKey:    msg.ReplaceKey,
 	}
 	if msg.Priority != 0 {
 		res.Priority = msg.Priority
@@ -205,7 +257,10 @@ func toInternalMessage(msg *model.MessageExternal) *model.Message {
 	return res
 }
 
-// 创建消息，创建成功后会通知用户
+// 创建消息，创建成功后会通知用户；deliverAt 晚于当前时间时保存为定时消息，到时再创建并通知。
+// 应用中已有相同 replaceKey 的消息时替换该消息，并通知客户端更新。
+// 带有 Idempotency-Key 请求头的重复请求返回第一次请求的响应；应用开启去重时，
+// 时间窗口内标题、内容和优先级都相同的消息不再重复创建，直接返回已有的消息
 // 只有管理员能创建，需要通过中间件验证管理员身份
 func (mess *MessageService) CreateMessage(ctx *gin.Context) {
 	message := model.MessageExternal{}
@@ -214,22 +269,188 @@ func (mess *MessageService) CreateMessage(ctx *gin.Context) {
 		if success := successOrAbort(ctx, 500, err); !success {
 			return
 		}
-		message.ApplicationID = application.ID
-		if strings.TrimSpace(message.Title) == "" {
-			message.Title = application.Name
+		if application == nil {
+			// 应用在认证之后被删除
+			ctx.AbortWithError(http.StatusUnauthorized, errors.New("the application does not exist"))
+			return
 		}
+		// UnifiedPush 注册的应用只能通过 /UP 推送消息，摘要应用的消息只由服务器生成
+		managed, err := mess.DB.IsManagedApplication(application.ID)
+		if success := successOrAbort(ctx, 500, err); !success {
+			return
+		}
+		if managed {
+			ctx.AbortWithError(http.StatusForbidden, errors.New("the application is managed by the server and cannot be used to create messages"))
+			return
+		}
+		mess.withIdempotencyKey(ctx, application.ID, func() {
+			mess.createMessage(ctx, application, &message)
+		})
+	}
+}
+
+func (mess *MessageService) createMessage(ctx *gin.Context, application *model.Application, message *model.MessageExternal) {
+	message.ApplicationID = application.ID
+	if strings.TrimSpace(message.Title) == "" {
+		message.Title = application.Name
+	}
 
-		if message.Priority == 0 { // 如果没有指定优先级，则使用应用程序的默认优先级
-			message.Priority = application.DefaultPriority
+	if message.Priority == 0 { // 如果没有指定优先级，则使用应用程序的默认优先级
+		message.Priority = application.DefaultPriority
+	}
+
+	message.Date = timeNow()
+	if message.DeliverAt != nil && message.DeliverAt.After(message.Date) {
+		mess.scheduleMessage(ctx, message)
+		return
+	}
+	message.DeliverAt = nil
+	expiresAt, err := resolveExpiry(message, application, message.Date)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	message.ExpiresAt = expiresAt
+	message.ID = 0 // 随意设置ID，防止客户端指定ID，数据库ID自增
+	msgInternal := toInternalMessage(message)
+	msgInternal.ContentHash = contentHash(msgInternal)
+	duplicate, err := mess.findDuplicate(application, msgInternal)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if duplicate != nil {
+		ctx.JSON(200, toExternalMessage(duplicate))
+		return
+	}
+	replacedID, err := mess.DB.CreateOrReplaceMessage(msgInternal)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if replacedID != 0 {
+		mess.notifyReplaced(application, replacedID, toExternalMessage(msgInternal))
+	} else {
+		mess.notify(application, toExternalMessage(msgInternal))
+	}
+	ctx.JSON(200, toExternalMessage(msgInternal))
+}
+
+// resolveExpiry 计算消息的过期时间：expiresAt 优先，其次是 ttl，最后是应用的默认 ttl，都没有时永不过期
+func resolveExpiry(message *model.MessageExternal, application *model.Application, now time.Time) (*time.Time, error) {
+	if message.TTL < 0 {
+		return nil, errors.New("ttl must not be negative")
+	}
+	if message.ExpiresAt != nil {
+		if !message.ExpiresAt.After(now) {
+			return nil, errors.New("expiresAt must be in the future")
 		}
+		return message.ExpiresAt, nil
+	}
+	ttl := message.TTL
+	if ttl == 0 {
+		ttl = application.DefaultTTL
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+	expiresAt := now.Add(time.Duration(ttl) * time.Second)
+	return &expiresAt, nil
+}
 
-		message.Date = timeNow()
-		message.ID = 0 // 随意设置ID，防止客户端指定ID，数据库ID自增
-		msgInternal := toInternalMessage(&message)
-		if success := successOrAbort(ctx, http.StatusInternalServerError, mess.DB.CreateMessage(msgInternal)); !success {
-			return
+// notify 把消息推送给所有关注该应用的用户，内部（系统）应用的消息推送给所有在线用户
+func (mess *MessageService) notify(application *model.Application, message *model.MessageExternal) {
+	if application.Internal {
+		mess.Notifier.BroadcastNotify(message)
+		return
+	}
+	userIDs, err := mess.DB.GetApplicationUserIDs(application.ID)
+	if err != nil {
+		log.Printf("Failed to resolve subscribers of application %d: %v", application.ID, err)
+		return
+	}
+	for _, userID := range userIDs {
+		mess.Notifier.Notify(userID, message)
+	}
+}
+
+// notifyReplaced 通知关注该应用的用户删除被替换的消息，并以 updated 事件推送替换后的新消息。
+// 替换后的消息使用新的ID，按ID增量拉取或补发的客户端也能收到新的内容
+func (mess *MessageService) notifyReplaced(application *model.Application, replacedID uint, message *model.MessageExternal) {
+	deletions, canDelete := mess.Notifier.(DeletionNotifier)
+	updates, canUpdate := mess.Notifier.(UpdateNotifier)
+	if !canDelete && !canUpdate {
+		return
+	}
+	userIDs, err := mess.DB.GetApplicationUserIDs(application.ID)
+	if err != nil {
+		log.Printf("Failed to resolve subscribers of application %d: %v", application.ID, err)
+		return
+	}
+	for _, userID := range userIDs {
+		if canDelete {
+			deletions.NotifyDeleted(userID, []uint{replacedID})
+		}
+		if canUpdate {
+			updates.NotifyUpdated(userID, message)
 		}
-		mess.Notifier.Notify(auth.GetUserID(ctx), toExternalMessage(msgInternal))
-		ctx.JSON(200, toExternalMessage(msgInternal))
 	}
 }
+
+// 更新消息的标题、内容、优先级和附加数据，只有关注该应用的用户可以更新，更新后通知客户端替换该消息。
+// 更新后的消息使用新的ID并重新变为未读，未指定 ttl 和 expiresAt 时保留原来的过期时间
+func (mess *MessageService) UpdateMessage(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		msg, err := mess.DB.GetMessageByID(id)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		var owns bool
+		if msg != nil {
+			owns, err = mess.DB.JudgeUserOwnsApplication(auth.GetUserID(ctx), msg.ApplicationID)
+			if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+				return
+			}
+		}
+		if !owns {
+			ctx.AbortWithError(http.StatusNotFound, errMessageNotFound)
+			return
+		}
+		application, err := mess.DB.GetApplicationByID(msg.ApplicationID)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		if application == nil {
+			ctx.AbortWithError(http.StatusNotFound, errMessageNotFound)
+			return
+		}
+		newValues := model.MessageExternal{}
+		if err := ctx.Bind(&newValues); err != nil {
+			return
+		}
+		msg.Message = newValues.Message
+		msg.Title = newValues.Title
+		if strings.TrimSpace(msg.Title) == "" {
+			msg.Title = application.Name
+		}
+		msg.Priority = newValues.Priority
+		if msg.Priority == 0 {
+			msg.Priority = application.DefaultPriority
+		}
+		msg.Extras = nil
+		if newValues.Extras != nil {
+			msg.Extras, _ = json.Marshal(newValues.Extras)
+		}
+		msg.ContentHash = contentHash(msg)
+		if newValues.TTL != 0 || newValues.ExpiresAt != nil {
+			if msg.ExpiresAt, err = resolveExpiry(&newValues, application, timeNow()); err != nil {
+				ctx.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+		}
+		if success := successOrAbort(ctx, http.StatusInternalServerError, mess.DB.ReplaceMessage(id, msg)); !success {
+			return
+		}
+		ext := toExternalMessage(msg)
+		mess.notifyReplaced(application, id, ext)
+		ctx.JSON(http.StatusOK, ext)
+	})
+}
@@ -1,19 +1,174 @@
 package service
 
 import (
-	"go-notify/database"
+	"net/http"
 	"testing"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
 )
 
 func TestBroadcastMessage(t *testing.T) {
-	db, err := database.NewGormDatabase("D:\\GolandProjects\\go-notify\\data\\go-notify.db")
-	if err != nil {
-		t.Error(err)
-		return
-	}
+	db := newWebhookTestDatabase(t)
+	// 广播消息属于 id 为 1 的系统应用
+	require.NoError(t, db.CreateApplication(&model.Application{Name: "system", Token: "Asystem", Internal: true}))
+	require.NoError(t, db.CreateApplication(&model.Application{Name: "other", Token: "Aother"}))
+	require.NoError(t, db.CreateMessage(&model.Message{ApplicationID: 1, Message: "maintenance tonight"}))
+	require.NoError(t, db.CreateMessage(&model.Message{ApplicationID: 2, Message: "not a broadcast"}))
+	require.NoError(t, db.CreateMessage(&model.Message{ApplicationID: 1, Message: "maintenance done"}))
+
 	messages, err := db.GetBroadcastMessage(10)
-	if err != nil {
-		t.Error(err)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "maintenance done", messages[0].Message)
+	assert.Equal(t, "maintenance tonight", messages[1].Message)
+
+	messages, err = db.GetBroadcastMessage(1)
+	require.NoError(t, err)
+	assert.Len(t, messages, 1)
+}
+
+type notification struct {
+	userID  uint
+	message *model.MessageExternal
+}
+
+// recordingNotifier 记录推送给每个用户的消息、广播的消息以及删除和替换的通知
+type recordingNotifier struct {
+	notifications []notification
+	broadcasts    []*model.MessageExternal
+	deletions     map[uint][]uint
+	updates       []notification
+}
+
+func (r *recordingNotifier) Notify(userID uint, message *model.MessageExternal) {
+	r.notifications = append(r.notifications, notification{userID: userID, message: message})
+}
+
+func (r *recordingNotifier) BroadcastNotify(message *model.MessageExternal) {
+	r.broadcasts = append(r.broadcasts, message)
+}
+
+func (r *recordingNotifier) NotifyDeleted(userID uint, messageIDs []uint) {
+	if r.deletions == nil {
+		r.deletions = make(map[uint][]uint)
+	}
+	r.deletions[userID] = append(r.deletions[userID], messageIDs...)
+}
+
+func (r *recordingNotifier) NotifyUpdated(userID uint, message *model.MessageExternal) {
+	r.updates = append(r.updates, notification{userID: userID, message: message})
+}
+
+func (r *recordingNotifier) notifiedUsers() []uint {
+	userIDs := make([]uint, 0, len(r.notifications))
+	for _, n := range r.notifications {
+		userIDs = append(userIDs, n.userID)
 	}
-	t.Log(messages[0].Message)
+	return userIDs
+}
+
+func TestCreateMessage_notifiesAllSubscribers(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	for _, name := range []string{"second", "third"} {
+		require.NoError(t, db.CreateUser(&model.User{Name: name}))
+	}
+	app := &model.Application{Name: "backup", Token: "Abackup"}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+	now := time.Now()
+	require.NoError(t, db.DB.Create(&model.AppUser{AppID: app.ID, UserID: 2, CreateAt: &now}).Error)
+	notifier := &recordingNotifier{}
+	service := &MessageService{DB: db, Notifier: notifier}
+
+	recorder := performRequest(service.CreateMessage, http.MethodPost, `{"message":"done"}`, 1, "Abackup", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.ElementsMatch(t, []uint{1, 2}, notifier.notifiedUsers(), "every subscriber is notified, not only the owner")
+	assert.Equal(t, "done", notifier.notifications[0].message.Message)
+	assert.Equal(t, app.ID, notifier.notifications[0].message.ApplicationID)
+	assert.Empty(t, notifier.broadcasts)
+}
+
+func TestCreateMessage_broadcastsInternalMessages(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	app := &model.Application{Name: "system", Token: "Asystem", Internal: true}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+	notifier := &recordingNotifier{}
+	service := &MessageService{DB: db, Notifier: notifier}
+
+	recorder := performRequest(service.CreateMessage, http.MethodPost, `{"message":"maintenance"}`, 1, "Asystem", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Len(t, notifier.broadcasts, 1)
+	assert.Equal(t, "maintenance", notifier.broadcasts[0].Message)
+	assert.Empty(t, notifier.notifications, "internal messages are only broadcast")
+}
+
+func TestUpdateMessage_replacesWithNewID(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	for _, name := range []string{"subscriber", "stranger"} {
+		require.NoError(t, db.CreateUser(&model.User{Name: name}))
+	}
+	app := &model.Application{Name: "ci", Token: "Aci"}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+	now := time.Now()
+	require.NoError(t, db.DB.Create(&model.AppUser{AppID: app.ID, UserID: 2, CreateAt: &now}).Error)
+	original := &model.Message{ApplicationID: app.ID, Title: "ci", Message: "build running", Date: now}
+	require.NoError(t, db.CreateMessage(original))
+	require.NoError(t, db.MarkMessagesRead(2, []uint{original.ID}, now))
+	notifier := &recordingNotifier{}
+	service := &MessageService{DB: db, Notifier: notifier}
+
+	recorder := performRequest(service.UpdateMessage, http.MethodPut, `{"message":"build passed"}`, 3, "", idParam(original.ID))
+	assert.Equal(t, http.StatusNotFound, recorder.Code, "only subscribers of the application may update its messages")
+	assert.Empty(t, notifier.updates)
+
+	recorder = performRequest(service.UpdateMessage, http.MethodPut, `{"message":"build passed","priority":4}`, 2, "", idParam(original.ID))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var updated model.MessageExternal
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &updated))
+	assert.Greater(t, updated.ID, original.ID, "cursor clients fetch the replacement by its new id")
+	assert.Equal(t, "build passed", updated.Message)
+	assert.Equal(t, "ci", updated.Title)
+	assert.Equal(t, 4, updated.Priority)
+
+	assert.Equal(t, map[uint][]uint{1: {original.ID}, 2: {original.ID}}, notifier.deletions)
+	require.Len(t, notifier.updates, 2)
+	for _, update := range notifier.updates {
+		assert.Equal(t, updated.ID, update.message.ID)
+	}
+	assert.ElementsMatch(t, []uint{1, 2}, []uint{notifier.updates[0].userID, notifier.updates[1].userID})
+	assert.Empty(t, notifier.notifications, "an update is not announced as a new message")
+
+	old, err := db.GetMessageByID(original.ID)
+	require.NoError(t, err)
+	assert.Nil(t, old)
+	read, err := db.GetReadMessageIDs(2, []uint{updated.ID})
+	require.NoError(t, err)
+	assert.Empty(t, read, "the replacement is unread")
+
+	recorder = performRequest(service.UpdateMessage, http.MethodPut, `{"message":"again"}`, 1, "", idParam(original.ID))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestCreateMessage_replaceKeyReplacesTheMessage(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	app := &model.Application{Name: "ci", Token: "Aci"}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+	notifier := &recordingNotifier{}
+	service := &MessageService{DB: db, Notifier: notifier}
+
+	recorder := performRequest(service.CreateMessage, http.MethodPost, `{"message":"build running","replaceKey":"build-1"}`, 1, "Aci", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Len(t, notifier.notifications, 1)
+	running := notifier.notifications[0].message
+
+	recorder = performRequest(service.CreateMessage, http.MethodPost, `{"message":"build passed","replaceKey":"build-1"}`, 1, "Aci", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, notifier.notifications, 1, "the replacement is sent as an update")
+	assert.Equal(t, map[uint][]uint{1: {running.ID}}, notifier.deletions)
+	require.Len(t, notifier.updates, 1)
+	assert.Equal(t, "build passed", notifier.updates[0].message.Message)
+	assert.Greater(t, notifier.updates[0].message.ID, running.ID)
 }
@@ -0,0 +1,51 @@
+package service
+
+import "go-notify/model"
+
+// DeletionNotifier 由能够通知客户端消息已被删除的推送渠道实现
+type DeletionNotifier interface {
+	NotifyDeleted(userID uint, messageIDs []uint)
+}
+
+// UpdateNotifier 由能够通知客户端消息已被替换的推送渠道实现
+type UpdateNotifier interface {
+	NotifyUpdated(userID uint, message *model.MessageExternal)
+}
+
+// ClientNotifier 由能够把消息只推送给某个客户端（设备）的推送渠道实现
+type ClientNotifier interface {
+	NotifyClient(userID uint, clientToken string, message *model.MessageExternal)
+}
+
+// Notifiers 把通知依次转发给多个推送渠道
+type Notifiers []Notifier
+
+func (n Notifiers) Notify(userID uint, message *model.MessageExternal) {
+	for _, notifier := range n {
+		notifier.Notify(userID, message)
+	}
+}
+
+func (n Notifiers) BroadcastNotify(message *model.MessageExternal) {
+	for _, notifier := range n {
+		notifier.BroadcastNotify(message)
+	}
+}
+
+// NotifyDeleted 转发给实现了 DeletionNotifier 的推送渠道
+func (n Notifiers) NotifyDeleted(userID uint, messageIDs []uint) {
+	for _, notifier := range n {
+		if deletion, ok := notifier.(DeletionNotifier); ok {
+			deletion.NotifyDeleted(userID, messageIDs)
+		}
+	}
+}
+
+// NotifyUpdated 转发给实现了 UpdateNotifier 的推送渠道
+func (n Notifiers) NotifyUpdated(userID uint, message *model.MessageExternal) {
+	for _, notifier := range n {
+		if update, ok := notifier.(UpdateNotifier); ok {
+			update.NotifyUpdated(userID, message)
+		}
+	}
+}
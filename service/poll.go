@@ -0,0 +1,144 @@
+package service
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go-notify/auth"
+	"go-notify/model"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+)
+
+// LongPoller 实现 Notifier，唤醒正在长轮询等待新消息的请求
+type LongPoller struct {
+	lock    sync.Mutex
+	waiters map[uint]map[chan struct{}]struct{}
+	closed  bool
+	done    chan struct{}
+}
+
+func NewLongPoller() *LongPoller {
+	return &LongPoller{
+		waiters: make(map[uint]map[chan struct{}]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (p *LongPoller) Notify(userID uint, message *model.MessageExternal) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for ch := range p.waiters[userID] {
+		wake(ch)
+	}
+}
+
+func (p *LongPoller) BroadcastNotify(message *model.MessageExternal) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, chs := range p.waiters {
+		for ch := range chs {
+			wake(ch)
+		}
+	}
+}
+
+// Close 结束所有等待中的请求，之后的请求不再等待
+func (p *LongPoller) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// subscribe 注册等待者，返回的通道在该用户收到通知时被唤醒
+func (p *LongPoller) subscribe(userID uint) (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.waiters[userID] == nil {
+		p.waiters[userID] = make(map[chan struct{}]struct{})
+	}
+	p.waiters[userID][ch] = struct{}{}
+	return ch, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		delete(p.waiters[userID], ch)
+		if len(p.waiters[userID]) == 0 {
+			delete(p.waiters, userID)
+		}
+	}
+}
+
+func parsePollTimeout(raw string) (time.Duration, error) {
+	if raw == "" {
+		return defaultPollTimeout, nil
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil {
+		// 也支持不带单位的秒数
+		seconds, convErr := strconv.Atoi(raw)
+		if convErr != nil {
+			return 0, errors.New("invalid timeout")
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout < 0 {
+		return 0, errors.New("invalid timeout")
+	}
+	return min(timeout, maxPollTimeout), nil
+}
+
+// 长轮询获取新消息：有比 since 更新的消息时立即返回，否则等待新消息通知或超时，超时返回空列表。
+// 消息按 ID 升序分页，一次收到的消息超过 limit 时 next 中的 since 是本页最大的消息 ID，客户端依次请求即可取回所有消息
+func (mess *MessageService) PollMessages(ctx *gin.Context) {
+	timeout, err := parsePollTimeout(ctx.Query("timeout"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	userID := auth.GetUserID(ctx)
+	withPaging(ctx, func(params *pagingParams) {
+		// 先注册再查询，避免查询和等待之间到达的通知被遗漏
+		wakeup, cancel := mess.Poller.subscribe(userID)
+		defer cancel()
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		for {
+			messages, err := mess.DB.GetMessagesByUserAfter(userID, auth.GetTokenID(ctx), params.Since, params.Limit+1)
+			if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+				return
+			}
+			if len(messages) > 0 {
+				mess.respondWithReadState(ctx, userID, buildWithPaging(ctx, params, messages))
+				return
+			}
+			select {
+			case <-wakeup:
+			case <-deadline.C:
+				ctx.JSON(http.StatusOK, buildWithPaging(ctx, params, messages))
+				return
+			case <-mess.Poller.done:
+				ctx.JSON(http.StatusOK, buildWithPaging(ctx, params, messages))
+				return
+			case <-ctx.Request.Context().Done():
+				return
+			}
+		}
+	})
+}
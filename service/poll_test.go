@@ -0,0 +1,75 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/auth"
+	"go-notify/model"
+)
+
+func performPollRequest(service *MessageService, query string) *model.PagedMessages {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/message/poll?"+query, nil)
+	ctx.Set(key, &url.URL{Scheme: "http", Host: "example.com"})
+	auth.RegisterAuthentication(ctx, nil, 1, "")
+	service.PollMessages(ctx)
+	if recorder.Code != http.StatusOK {
+		return nil
+	}
+	paged := new(model.PagedMessages)
+	if err := json.Unmarshal(recorder.Body.Bytes(), paged); err != nil {
+		return nil
+	}
+	return paged
+}
+
+func TestPollMessages_pagesThroughMoreThanLimitMessages(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	application := &model.Application{Name: "backup", Token: "Abackup"}
+	require.NoError(t, db.CreateApplicationForUser(application, 1))
+	var ids []uint
+	for _, text := range []string{"one", "two", "three", "four", "five"} {
+		message := &model.Message{ApplicationID: application.ID, Message: text}
+		require.NoError(t, db.CreateMessage(message))
+		ids = append(ids, message.ID)
+	}
+	poller := NewLongPoller()
+	defer poller.Close()
+	service := &MessageService{DB: db, Poller: poller}
+
+	var received []string
+	query := "limit=2&since=0"
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		paged := performPollRequest(service, query)
+		require.NotNil(t, paged)
+		for _, m := range paged.Messages {
+			received = append(received, m.Message)
+		}
+		if paged.Paging.Next == "" {
+			assert.Len(t, paged.Messages, 1)
+			break
+		}
+		assert.Len(t, paged.Messages, 2)
+		assert.Equal(t, paged.Messages[1].ID, paged.Paging.Since, "since is the largest id of the page")
+		next, err := url.Parse(paged.Paging.Next)
+		require.NoError(t, err)
+		assert.Equal(t, "/message/poll", next.Path)
+		query = next.RawQuery
+	}
+	assert.Equal(t, []string{"one", "two", "three", "four", "five"}, received, "no message is skipped")
+
+	paged := performPollRequest(service, "limit=2&timeout=1ms&since="+strconv.Itoa(int(ids[4])))
+	require.NotNil(t, paged)
+	assert.Empty(t, paged.Messages, "the poll times out without new messages")
+}
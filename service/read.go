@@ -0,0 +1,112 @@
+package service
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go-notify/auth"
+	"go-notify/model"
+	"net/http"
+	"time"
+)
+
+var errMessageNotFound = errors.New("message does not exist")
+
+type ReadDatabaseService interface {
+	MarkMessagesRead(userID uint, messageIDs []uint, readAt time.Time) error
+	MarkApplicationMessagesRead(userID, appID uint) error
+	MarkAllMessagesRead(userID uint) error
+	CountUnreadMessages(userID uint, clientToken string) ([]*model.ApplicationUnreadCount, error)
+	GetReadMessageIDs(userID uint, messageIDs []uint) ([]uint, error)
+}
+
+// MarkRead 把用户可见的消息标记为已读，任何一条消息不属于该用户时返回 errMessageNotFound
+func (mess *MessageService) MarkRead(userID uint, messageIDs []uint) error {
+	allowed, err := mess.DB.IsUserAlloweOpMessage(userID, messageIDs)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return errMessageNotFound
+	}
+	return mess.DB.MarkMessagesRead(userID, messageIDs, timeNow())
+}
+
+func (mess *MessageService) markReadOrAbort(ctx *gin.Context, messageIDs []uint) {
+	err := mess.MarkRead(auth.GetUserID(ctx), messageIDs)
+	if errors.Is(err, errMessageNotFound) {
+		ctx.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// 把一条消息标记为已读
+func (mess *MessageService) MarkMessageRead(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		mess.markReadOrAbort(ctx, []uint{id})
+	})
+}
+
+// 把多条消息标记为已读，请求体为 {"ids":[...]}
+func (mess *MessageService) MarkMessagesRead(ctx *gin.Context) {
+	req := model.MarkReadRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	mess.markReadOrAbort(ctx, req.IDs)
+}
+
+// 把该用户的所有消息标记为已读
+func (mess *MessageService) MarkAllMessagesRead(ctx *gin.Context) {
+	if success := successOrAbort(ctx, http.StatusInternalServerError, mess.DB.MarkAllMessagesRead(auth.GetUserID(ctx))); !success {
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// 把应用的所有消息标记为已读
+func (mess *MessageService) MarkApplicationMessagesRead(ctx *gin.Context) {
+	mess.withOwnedApplication(ctx, func(appID uint) {
+		if success := successOrAbort(ctx, http.StatusInternalServerError, mess.DB.MarkApplicationMessagesRead(auth.GetUserID(ctx), appID)); !success {
+			return
+		}
+		ctx.Status(http.StatusOK)
+	})
+}
+
+// 获取未读消息数量，按应用分别统计
+func (mess *MessageService) GetUnreadCount(ctx *gin.Context) {
+	counts, err := mess.DB.CountUnreadMessages(auth.GetUserID(ctx), auth.GetTokenID(ctx))
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	res := &model.UnreadCount{Applications: counts}
+	for _, c := range counts {
+		res.Total += c.Count
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+// withReadState 设置消息对该用户是否已读
+func (mess *MessageService) withReadState(userID uint, messages []*model.MessageExternal) error {
+	ids := make([]uint, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	readIDs, err := mess.DB.GetReadMessageIDs(userID, ids)
+	if err != nil {
+		return err
+	}
+	read := make(map[uint]struct{}, len(readIDs))
+	for _, id := range readIDs {
+		read[id] = struct{}{}
+	}
+	for _, m := range messages {
+		_, m.Read = read[m.ID]
+	}
+	return nil
+}
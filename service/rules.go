@@ -0,0 +1,329 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-notify/auth"
+	"go-notify/model"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// quietHoursClock 是免打扰时间的格式
+	quietHoursClock = "15:04"
+	// maxDeferredWait 没有更早到期的通知时也定期检查，避免系统时间调整后错过推送
+	maxDeferredWait = time.Minute
+	// deferredRetryWait 推送被推迟的消息出错后等待多久再重试
+	deferredRetryWait = 10 * time.Second
+)
+
+type NotificationRulesDatabaseService interface {
+	GetNotificationRules(userID uint) (*model.NotificationRules, error)
+	SaveNotificationRules(rules *model.NotificationRules) error
+	DeferNotification(deferred *model.DeferredNotification) error
+	GetDueDeferredUserIDs(now time.Time, digest bool) ([]uint, error)
+	GetDueDeferredNotifications(userID uint, digest bool, now time.Time) ([]*model.DeferredNotification, error)
+	GetNextDeferredNotification() (*model.DeferredNotification, error)
+	DeleteDeferredNotifications(deferred []*model.DeferredNotification) error
+	RescheduleDeferredNotifications(userID uint, digest bool, deliverAt time.Time) error
+	GetDigestApplication(userID uint) (*model.Application, error)
+	CreateDigestApplication(userID uint, application *model.Application) error
+	CreateDigestMessage(digest *model.Message, deferred []*model.DeferredNotification) error
+	JudgeUserOwnsApplication(userID, appID uint) (bool, error)
+	GetApplicationByID(id uint) (*model.Application, error)
+	GetApplicationByToken(token string) (*model.Application, error)
+}
+
+// RulesNotifier 在推送前应用用户的通知规则：免打扰时间内优先级不够的消息只保存，不实时推送，
+// 免打扰时间结束后汇总成一条摘要推送给用户；低于摘要阈值的消息不单独推送，每个周期汇总成一条摘要。
+// 摘要保存为用户摘要应用的消息，和普通消息一样推送、补发和查询。删除、替换和广播的通知不受影响
+type RulesNotifier struct {
+	DB   NotificationRulesDatabaseService
+	Next Notifier
+	wake chan struct{}
+}
+
+func NewRulesNotifier(db NotificationRulesDatabaseService, next Notifier) *RulesNotifier {
+	return &RulesNotifier{DB: db, Next: next, wake: make(chan struct{}, 1)}
+}
+
+func (r *RulesNotifier) Notify(userID uint, message *model.MessageExternal) {
+	rules, err := r.DB.GetNotificationRules(userID)
+	if err != nil {
+		// 无法判断时宁可打扰用户，也不丢失推送
+		log.Printf("Failed to load the notification rules of user %d: %v", userID, err)
+		r.Next.Notify(userID, message)
+		return
+	}
+	now := timeNow()
+	until, digest := digestUntil(rules, message, now)
+	if !digest {
+		var deferred bool
+		if until, deferred = deferUntil(rules, message, now); !deferred {
+			r.Next.Notify(userID, message)
+			return
+		}
+	}
+	err = r.DB.DeferNotification(&model.DeferredNotification{UserID: userID, MessageID: message.ID, DeliverAt: until, Digest: digest})
+	if err != nil {
+		log.Printf("Failed to defer message %d for user %d: %v", message.ID, userID, err)
+		r.Next.Notify(userID, message)
+		return
+	}
+	wake(r.wake)
+}
+
+func (r *RulesNotifier) BroadcastNotify(message *model.MessageExternal) {
+	r.Next.BroadcastNotify(message)
+}
+
+func (r *RulesNotifier) NotifyDeleted(userID uint, messageIDs []uint) {
+	Notifiers{r.Next}.NotifyDeleted(userID, messageIDs)
+}
+
+func (r *RulesNotifier) NotifyUpdated(userID uint, message *model.MessageExternal) {
+	Notifiers{r.Next}.NotifyUpdated(userID, message)
+}
+
+// Run 在免打扰时间结束时推送被推迟的消息，在摘要周期结束时推送摘要，直到 ctx 结束
+func (r *RulesNotifier) Run(ctx context.Context) {
+	for {
+		wait := maxDeferredWait
+		if err := errors.Join(r.deliverDue(), r.deliverDigests()); err != nil {
+			// 出错时等待一段时间再重试，避免空转
+			log.Printf("Failed to deliver deferred notifications: %v", err)
+			wait = deferredRetryWait
+		} else if next, err := r.DB.GetNextDeferredNotification(); err != nil {
+			log.Printf("Failed to query deferred notifications: %v", err)
+			wait = deferredRetryWait
+		} else if next != nil {
+			wait = max(min(next.DeliverAt.Sub(timeNow()), wait), 0)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// deliverDue 推送免打扰时间已经结束的用户被推迟的消息
+func (r *RulesNotifier) deliverDue() error {
+	now := timeNow()
+	userIDs, err := r.DB.GetDueDeferredUserIDs(now, false)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, userID := range userIDs {
+		if err := r.deliverDeferred(userID, now); err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", userID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliverDeferred 推送用户在免打扰时间内被推迟的消息，只有一条时直接推送，多条时汇总成一条摘要，避免连续打扰用户
+func (r *RulesNotifier) deliverDeferred(userID uint, now time.Time) error {
+	due, err := r.DB.GetDueDeferredNotifications(userID, false, now)
+	if err != nil {
+		return err
+	}
+	messages := pendingMessages(due, now)
+	if len(messages) > 1 {
+		return r.sendDigest(userID, due, messages, now)
+	}
+	// 先删除再推送，删除失败时不会重复推送
+	if err := r.DB.DeleteDeferredNotifications(due); err != nil {
+		return err
+	}
+	if len(messages) == 1 {
+		r.Next.Notify(userID, toExternalMessage(messages[0]))
+	}
+	return nil
+}
+
+// pendingMessages 返回仍需推送的消息，期间被删除或已经过期的消息不再推送
+func pendingMessages(deferred []*model.DeferredNotification, now time.Time) []*model.Message {
+	var messages []*model.Message
+	for _, d := range deferred {
+		if d.Message.ID == 0 || (d.Message.ExpiresAt != nil && !d.Message.ExpiresAt.After(now)) {
+			continue
+		}
+		messages = append(messages, &d.Message)
+	}
+	return messages
+}
+
+// reschedule 在用户修改通知规则后按新的免打扰时间和摘要周期重新安排被推迟的消息，
+// 关闭摘要后立即推送已汇总的消息
+func (r *RulesNotifier) reschedule(rules *model.NotificationRules) error {
+	now := timeNow()
+	until, quiet := quietHoursEnd(rules, now)
+	if !quiet {
+		until = now
+	}
+	if err := r.DB.RescheduleDeferredNotifications(rules.UserID, false, until); err != nil {
+		return err
+	}
+	next, ok := nextDigest(rules, now)
+	if !ok {
+		next = now
+	}
+	if err := r.DB.RescheduleDeferredNotifications(rules.UserID, true, next); err != nil {
+		return err
+	}
+	wake(r.wake)
+	return nil
+}
+
+// deferUntil 返回消息应被推迟到的时间，不需要推迟时返回 false
+func deferUntil(rules *model.NotificationRules, message *model.MessageExternal, now time.Time) (time.Time, bool) {
+	until, quiet := quietHoursEnd(rules, now)
+	if !quiet {
+		return time.Time{}, false
+	}
+	if rules.MinPriority != nil && effectivePriority(rules, message) >= *rules.MinPriority {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// effectivePriority 返回用户为该应用设置的优先级，没有设置时返回消息的优先级
+func effectivePriority(rules *model.NotificationRules, message *model.MessageExternal) int {
+	for _, override := range rules.ApplicationPriorities {
+		if override.ApplicationID == message.ApplicationID {
+			return override.Priority
+		}
+	}
+	return message.Priority
+}
+
+// quietHoursEnd 判断 now 是否处于免打扰时间内，是则返回免打扰时间结束的时间
+func quietHoursEnd(rules *model.NotificationRules, now time.Time) (time.Time, bool) {
+	if rules == nil || !rules.QuietHours {
+		return time.Time{}, false
+	}
+	loc, err := time.LoadLocation(rules.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	start, errStart := time.Parse(quietHoursClock, rules.QuietStart)
+	end, errEnd := time.Parse(quietHoursClock, rules.QuietEnd)
+	if errStart != nil || errEnd != nil {
+		return time.Time{}, false
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	startMinute, endMinute := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	var quiet bool
+	if startMinute < endMinute {
+		quiet = minute >= startMinute && minute < endMinute
+	} else {
+		// 跨越午夜的免打扰时间
+		quiet = minute >= startMinute || minute < endMinute
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+	until := time.Date(local.Year(), local.Month(), local.Day(), end.Hour(), end.Minute(), 0, 0, loc)
+	if !until.After(local) {
+		until = time.Date(local.Year(), local.Month(), local.Day()+1, end.Hour(), end.Minute(), 0, 0, loc)
+	}
+	return until, true
+}
+
+// NotificationRulesService 管理当前用户的通知规则
+type NotificationRulesService struct {
+	DB       NotificationRulesDatabaseService
+	Notifier *RulesNotifier
+}
+
+// 获取当前用户的通知规则，没有设置时返回默认规则
+func (n *NotificationRulesService) GetNotificationRules(ctx *gin.Context) {
+	rules, err := n.DB.GetNotificationRules(auth.GetUserID(ctx))
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if rules == nil {
+		rules = &model.NotificationRules{}
+	}
+	if rules.ApplicationPriorities == nil {
+		rules.ApplicationPriorities = []model.ApplicationPriority{}
+	}
+	ctx.JSON(http.StatusOK, rules)
+}
+
+// 修改当前用户的通知规则，按新的免打扰时间重新安排被推迟的消息
+func (n *NotificationRulesService) UpdateNotificationRules(ctx *gin.Context) {
+	rules := &model.NotificationRules{}
+	if err := ctx.Bind(rules); err != nil {
+		return
+	}
+	userID := auth.GetUserID(ctx)
+	rules.UserID = userID
+	if err := validateNotificationRules(rules); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	seen := make(map[uint]bool, len(rules.ApplicationPriorities))
+	for _, override := range rules.ApplicationPriorities {
+		if seen[override.ApplicationID] {
+			ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("duplicate priority for application %d", override.ApplicationID))
+			return
+		}
+		seen[override.ApplicationID] = true
+		owns, err := n.DB.JudgeUserOwnsApplication(userID, override.ApplicationID)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		if !owns {
+			ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("application %d does not exist", override.ApplicationID))
+			return
+		}
+	}
+	if success := successOrAbort(ctx, http.StatusInternalServerError, n.DB.SaveNotificationRules(rules)); !success {
+		return
+	}
+	if n.Notifier != nil {
+		if err := n.Notifier.reschedule(rules); err != nil {
+			log.Printf("Failed to reschedule the deferred notifications of user %d: %v", userID, err)
+		}
+	}
+	if rules.ApplicationPriorities == nil {
+		rules.ApplicationPriorities = []model.ApplicationPriority{}
+	}
+	ctx.JSON(http.StatusOK, rules)
+}
+
+func validateNotificationRules(rules *model.NotificationRules) error {
+	if _, err := time.LoadLocation(rules.TimeZone); err != nil {
+		return fmt.Errorf("unknown time zone %q", rules.TimeZone)
+	}
+	if rules.Digest != "" && rules.DigestThreshold == 0 {
+		return errors.New("digestThreshold must be positive when a digest is enabled")
+	}
+	if !rules.QuietHours && rules.QuietStart == "" && rules.QuietEnd == "" {
+		return nil
+	}
+	start, err := time.Parse(quietHoursClock, rules.QuietStart)
+	if err != nil {
+		return errors.New("quietStart must be formatted as HH:MM")
+	}
+	end, err := time.Parse(quietHoursClock, rules.QuietEnd)
+	if err != nil {
+		return errors.New("quietEnd must be formatted as HH:MM")
+	}
+	if start.Equal(end) {
+		return errors.New("quietStart and quietEnd must differ")
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/database"
+	"go-notify/model"
+)
+
+func TestQuietHoursEnd(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+	overnight := &model.NotificationRules{QuietHours: true, QuietStart: "22:00", QuietEnd: "07:00", TimeZone: "Europe/Berlin"}
+	daytime := &model.NotificationRules{QuietHours: true, QuietStart: "09:00", QuietEnd: "17:30", TimeZone: "Europe/Berlin"}
+
+	tests := []struct {
+		name  string
+		rules *model.NotificationRules
+		now   time.Time
+		until time.Time
+		quiet bool
+	}{
+		{"before midnight", overnight, time.Date(2024, 5, 1, 23, 0, 0, 0, berlin), time.Date(2024, 5, 2, 7, 0, 0, 0, berlin), true},
+		{"after midnight", overnight, time.Date(2024, 5, 2, 6, 59, 0, 0, berlin), time.Date(2024, 5, 2, 7, 0, 0, 0, berlin), true},
+		{"at the end", overnight, time.Date(2024, 5, 2, 7, 0, 0, 0, berlin), time.Time{}, false},
+		{"in another zone", overnight, time.Date(2024, 5, 1, 20, 30, 0, 0, time.UTC), time.Date(2024, 5, 2, 7, 0, 0, 0, berlin), true},
+		{"daytime", daytime, time.Date(2024, 5, 1, 12, 0, 0, 0, berlin), time.Date(2024, 5, 1, 17, 30, 0, 0, berlin), true},
+		{"outside daytime", daytime, time.Date(2024, 5, 1, 8, 59, 0, 0, berlin), time.Time{}, false},
+		{"disabled", &model.NotificationRules{QuietStart: "00:00", QuietEnd: "23:59"}, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), time.Time{}, false},
+		{"no rules", nil, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, quiet := quietHoursEnd(tt.rules, tt.now)
+			assert.Equal(t, tt.quiet, quiet)
+			assert.True(t, tt.until.Equal(until), "expected %v, got %v", tt.until, until)
+		})
+	}
+}
+
+func TestDeferUntil(t *testing.T) {
+	minPriority := 8
+	rules := &model.NotificationRules{
+		QuietHours: true, QuietStart: "22:00", QuietEnd: "07:00", MinPriority: &minPriority,
+		ApplicationPriorities: []model.ApplicationPriority{{ApplicationID: 2, Priority: 10}, {ApplicationID: 3, Priority: 0}},
+	}
+	night := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+
+	_, deferred := deferUntil(rules, &model.MessageExternal{ApplicationID: 1, Priority: 8}, night)
+	assert.False(t, deferred)
+	until, deferred := deferUntil(rules, &model.MessageExternal{ApplicationID: 1, Priority: 7}, night)
+	assert.True(t, deferred)
+	assert.Equal(t, time.Date(2024, 5, 2, 7, 0, 0, 0, time.UTC), until)
+	_, deferred = deferUntil(rules, &model.MessageExternal{ApplicationID: 2, Priority: 1}, night)
+	assert.False(t, deferred)
+	_, deferred = deferUntil(rules, &model.MessageExternal{ApplicationID: 3, Priority: 10}, night)
+	assert.True(t, deferred)
+	_, deferred = deferUntil(rules, &model.MessageExternal{ApplicationID: 1, Priority: 0}, night.Add(12*time.Hour))
+	assert.False(t, deferred)
+
+	rules.MinPriority = nil
+	_, deferred = deferUntil(rules, &model.MessageExternal{ApplicationID: 2, Priority: 10}, night)
+	assert.True(t, deferred)
+}
+
+// failingDeleteDatabase 删除被推迟的通知或保存摘要时返回错误
+type failingDeleteDatabase struct {
+	*database.GormDatabase
+	fail bool
+}
+
+func (d *failingDeleteDatabase) DeleteDeferredNotifications(deferred []*model.DeferredNotification) error {
+	if d.fail {
+		return errors.New("database is locked")
+	}
+	return d.GormDatabase.DeleteDeferredNotifications(deferred)
+}
+
+func (d *failingDeleteDatabase) CreateDigestMessage(digest *model.Message, deferred []*model.DeferredNotification) error {
+	if d.fail {
+		return errors.New("database is locked")
+	}
+	return d.GormDatabase.CreateDigestMessage(digest, deferred)
+}
+
+// newQuietHoursTest 返回在 23:00 处于免打扰时间（22:00 到 07:00）的用户1的通知规则，以及在免打扰时间内创建消息的函数
+func newQuietHoursTest(t *testing.T, now *time.Time) (*RulesNotifier, *failingDeleteDatabase, *recordingNotifier, func(text string) *model.MessageExternal) {
+	*now = time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return *now }
+	t.Cleanup(func() { timeNow = time.Now })
+	db := &failingDeleteDatabase{GormDatabase: newWebhookTestDatabase(t)}
+	app := &model.Application{Name: "backup", Token: "Abackup"}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+	require.NoError(t, db.SaveNotificationRules(&model.NotificationRules{UserID: 1, QuietHours: true, QuietStart: "22:00", QuietEnd: "07:00", TimeZone: "UTC"}))
+	next := &recordingNotifier{}
+	rules := NewRulesNotifier(db, next)
+	notify := func(text string) *model.MessageExternal {
+		message := &model.Message{ApplicationID: app.ID, Title: "backup", Message: text, Date: *now}
+		require.NoError(t, db.CreateMessage(message))
+		external := toExternalMessage(message)
+		rules.Notify(1, external)
+		return external
+	}
+	return rules, db, next, notify
+}
+
+// assertSavedDigest 检查推送的摘要保存为用户摘要应用的消息，补发时能够查到
+func assertSavedDigest(t *testing.T, db *failingDeleteDatabase, digest *model.MessageExternal, after uint) {
+	application, err := db.GetDigestApplication(1)
+	require.NoError(t, err)
+	require.NotNil(t, application)
+	assert.Equal(t, digestApplicationName, application.Name)
+	assert.Equal(t, application.ID, digest.ApplicationID)
+	assert.Contains(t, digest.Extras, digestExtrasKey)
+	replayed, err := db.GetMessagesByUserAfter(1, "", after, 10)
+	require.NoError(t, err)
+	require.Len(t, replayed, 1)
+	assert.Equal(t, digest.ID, replayed[0].ID)
+	assert.Equal(t, digest.Message, replayed[0].Message)
+}
+
+func TestRulesNotifier_collapsesTheQuietHoursBacklog(t *testing.T) {
+	var now time.Time
+	rules, db, next, notify := newQuietHoursTest(t, &now)
+	var ids []uint
+	for _, text := range []string{"first", "second", "third"} {
+		ids = append(ids, notify(text).ID)
+	}
+	require.NoError(t, rules.deliverDue())
+	assert.Empty(t, next.notifications, "messages are deferred during quiet hours")
+
+	now = time.Date(2024, 5, 2, 7, 0, 0, 0, time.UTC)
+	require.NoError(t, rules.deliverDue())
+	require.Len(t, next.notifications, 1, "the backlog is not pushed message by message")
+	summary := next.notifications[0].message
+	assert.Equal(t, "3 new messages", summary.Title)
+	assert.Equal(t, fmt.Sprintf("**backup** (3)\n\n- #%d backup: first\n- #%d backup: second\n- #%d backup: third", ids[0], ids[1], ids[2]),
+		summary.Message)
+	assertSavedDigest(t, db, summary, ids[2])
+
+	require.NoError(t, rules.deliverDue())
+	assert.Len(t, next.notifications, 1, "the backlog is delivered once")
+}
+
+func TestRulesNotifier_pushesASingleDeferredMessage(t *testing.T) {
+	var now time.Time
+	rules, db, next, notify := newQuietHoursTest(t, &now)
+	message := notify("only")
+
+	now = time.Date(2024, 5, 2, 7, 0, 0, 0, time.UTC)
+	require.NoError(t, rules.deliverDue())
+	require.Len(t, next.notifications, 1)
+	assert.Equal(t, message.ID, next.notifications[0].message.ID)
+	application, err := db.GetDigestApplication(1)
+	require.NoError(t, err)
+	assert.Nil(t, application, "no digest is saved for a single message")
+}
+
+func TestRulesNotifier_doesNotPushWhenTheBacklogCannotBeDeleted(t *testing.T) {
+	var now time.Time
+	rules, db, next, notify := newQuietHoursTest(t, &now)
+	notify("first")
+	last := notify("second")
+
+	now = time.Date(2024, 5, 2, 7, 0, 0, 0, time.UTC)
+	db.fail = true
+	assert.Error(t, rules.deliverDue())
+	assert.Error(t, rules.deliverDue())
+	assert.Empty(t, next.notifications, "nothing is pushed until the backlog is removed")
+
+	db.fail = false
+	require.NoError(t, rules.deliverDue())
+	require.NoError(t, rules.deliverDue())
+	require.Len(t, next.notifications, 1)
+	assertSavedDigest(t, db, next.notifications[0].message, last.ID)
+}
+
+func TestRulesNotifier_savesThePeriodicDigest(t *testing.T) {
+	var now time.Time
+	rules, db, next, notify := newQuietHoursTest(t, &now)
+	now = time.Date(2024, 5, 1, 12, 10, 0, 0, time.UTC)
+	require.NoError(t, db.SaveNotificationRules(&model.NotificationRules{UserID: 1, Digest: digestHourly, DigestThreshold: 5, TimeZone: "UTC"}))
+	notify("first")
+	last := notify("second")
+	require.NoError(t, rules.deliverDigests())
+	assert.Empty(t, next.notifications, "low-priority messages wait for the digest")
+
+	now = time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	require.NoError(t, rules.deliverDigests())
+	require.Len(t, next.notifications, 1)
+	assertSavedDigest(t, db, next.notifications[0].message, last.ID)
+	digestApp := next.notifications[0].message.ApplicationID
+
+	// 删除摘要应用后，下一次摘要保存到新创建的应用中
+	require.NoError(t, db.DeleteApplicationByID(digestApp))
+	last = notify("third")
+	now = time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	require.NoError(t, rules.deliverDigests())
+	require.Len(t, next.notifications, 2)
+	assert.Equal(t, "1 new message", next.notifications[1].message.Title)
+	assert.NotEqual(t, digestApp, next.notifications[1].message.ApplicationID)
+	assertSavedDigest(t, db, next.notifications[1].message, last.ID)
+}
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"context"
+	"errors"
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"go-notify/auth"
+	"go-notify/model"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxSchedulerWait 没有更早的定时消息时也定期检查，避免系统时间调整后错过投递
+	maxSchedulerWait = time.Minute
+	// scheduledBatchSize 每次从数据库取出的到期消息数量
+	scheduledBatchSize = 100
+	// scheduledRetryWait 投递失败或查询出错后第一次重试前的等待时间，之后每次翻倍
+	scheduledRetryWait = 10 * time.Second
+	// maxScheduledAttempts 定时消息最多尝试投递的次数，超过后被丢弃
+	maxScheduledAttempts = 8
+)
+
+type ScheduledDatabaseService interface {
+	CreateScheduledMessage(message *model.ScheduledMessage) error
+	GetScheduledMessageByID(id uint) (*model.ScheduledMessage, error)
+	GetScheduledMessagesByApplication(appID uint) ([]*model.ScheduledMessage, error)
+	GetDueScheduledMessages(now time.Time, limit int) ([]*model.ScheduledMessage, error)
+	GetNextScheduledMessage() (*model.ScheduledMessage, error)
+	DeleteScheduledMessageByID(id uint) error
+	RetryScheduledMessage(id uint, deliverAt time.Time) error
+	DeliverScheduledMessage(scheduled *model.ScheduledMessage, message *model.Message) (delivered bool, replacedID uint, err error)
+}
+
+// Scheduler 唤醒投递定时消息的协程，定时消息保存在数据库中，重启后继续投递
+type Scheduler struct {
+	wake chan struct{}
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{wake: make(chan struct{}, 1)}
+}
+
+// Wake 在新增定时消息后调用，重新计算下一次投递的时间
+func (s *Scheduler) Wake() {
+	wake(s.wake)
+}
+
+// RunScheduler 在定时消息的投递时间到达时创建消息并通知用户，直到 ctx 结束
+func (mess *MessageService) RunScheduler(ctx context.Context) {
+	for {
+		wait := maxSchedulerWait
+		if err := mess.deliverDueMessages(); err != nil {
+			// 数据库出错时等待一段时间再重试，避免空转
+			log.Printf("Failed to deliver scheduled messages: %v", err)
+			wait = scheduledRetryWait
+		} else if next, err := mess.DB.GetNextScheduledMessage(); err != nil {
+			log.Printf("Failed to query scheduled messages: %v", err)
+			wait = scheduledRetryWait
+		} else if next != nil {
+			wait = max(min(next.DeliverAt.Sub(timeNow()), wait), 0)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-mess.Scheduler.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// deliverDueMessages 投递所有到期的定时消息，投递失败的消息被推迟重试，不影响其它消息
+func (mess *MessageService) deliverDueMessages() error {
+	for {
+		now := timeNow()
+		due, err := mess.DB.GetDueScheduledMessages(now, scheduledBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, scheduled := range due {
+			if err := mess.deliverScheduled(scheduled, now); err != nil {
+				log.Printf("Failed to deliver scheduled message %d: %v", scheduled.ID, err)
+				if err := mess.retryScheduled(scheduled, now); err != nil {
+					return err
+				}
+			}
+		}
+		if len(due) < scheduledBatchSize {
+			return nil
+		}
+	}
+}
+
+// retryScheduled 推迟投递失败的定时消息，等待时间随失败次数翻倍，达到最大尝试次数后丢弃
+func (mess *MessageService) retryScheduled(scheduled *model.ScheduledMessage, now time.Time) error {
+	if scheduled.Attempts+1 >= maxScheduledAttempts {
+		log.Printf("Dropping scheduled message %d after %d failed attempts", scheduled.ID, maxScheduledAttempts)
+		return mess.DB.DeleteScheduledMessageByID(scheduled.ID)
+	}
+	return mess.DB.RetryScheduledMessage(scheduled.ID, now.Add(scheduledRetryWait<<scheduled.Attempts))
+}
+
+// deliverScheduled 把定时消息转为普通消息，消息的ID和时间以投递时为准，保证客户端按ID增量拉取时不会遗漏
+func (mess *MessageService) deliverScheduled(scheduled *model.ScheduledMessage, now time.Time) error {
+	if scheduled.ExpiresAt != nil && !scheduled.ExpiresAt.After(now) {
+		// 服务停止期间已经过期的消息不再投递
+		return mess.DB.DeleteScheduledMessageByID(scheduled.ID)
+	}
+	application, err := mess.DB.GetApplicationByID(scheduled.ApplicationID)
+	if err != nil {
+		return err
+	}
+	if application == nil {
+		return mess.DB.DeleteScheduledMessageByID(scheduled.ID)
+	}
+	message := &model.Message{
+		ApplicationID: scheduled.ApplicationID,
+		Message:       scheduled.Message,
+		Title:         scheduled.Title,
+		Priority:      scheduled.Priority,
+		Extras:        scheduled.Extras,
+		Date:          now,
+		ReplaceKey:    scheduled.ReplaceKey,
+	}
+	message.ContentHash = contentHash(message)
+	message.ExpiresAt, err = resolveExpiry(&model.MessageExternal{TTL: scheduled.TTL, ExpiresAt: scheduled.ExpiresAt}, application, now)
+	if err != nil {
+		return err
+	}
+	delivered, replacedID, err := mess.DB.DeliverScheduledMessage(scheduled, message)
+	if err != nil || !delivered {
+		return err
+	}
+	if replacedID != 0 {
+		mess.notifyReplaced(application, replacedID, toExternalMessage(message))
+	} else {
+		mess.notify(application, toExternalMessage(message))
+	}
+	return nil
+}
+
+// scheduleMessage 保存定时消息，投递时间到达后由 RunScheduler 创建消息
+func (mess *MessageService) scheduleMessage(ctx *gin.Context, message *model.MessageExternal) {
+	if message.TTL < 0 {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("ttl must not be negative"))
+		return
+	}
+	if message.ExpiresAt != nil && !message.ExpiresAt.After(*message.DeliverAt) {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("expiresAt must be after deliverAt"))
+		return
+	}
+	scheduled := &model.ScheduledMessage{
+		ApplicationID: message.ApplicationID,
+		Message:       message.Message,
+		Title:         message.Title,
+		Priority:      message.Priority,
+		TTL:           message.TTL,
+		ExpiresAt:     message.ExpiresAt,
+		DeliverAt:     *message.DeliverAt,
+		ReplaceKey:    message.ReplaceKey,
+		CreatedAt:     timeNow(),
+	}
+	if message.Extras != nil {
+		scheduled.Extras, _ = json.Marshal(message.Extras)
+	}
+	if success := successOrAbort(ctx, http.StatusInternalServerError, mess.DB.CreateScheduledMessage(scheduled)); !success {
+		return
+	}
+	mess.Scheduler.Wake()
+	ctx.JSON(http.StatusOK, toExternalScheduledMessage(scheduled))
+}
+
+func toExternalScheduledMessage(msg *model.ScheduledMessage) *model.ScheduledMessageExternal {
+	res := &model.ScheduledMessageExternal{
+		ID:            msg.ID,
+		ApplicationID: msg.ApplicationID,
+		Message:       msg.Message,
+		Title:         msg.Title,
+		Priority:      msg.Priority,
+		TTL:           msg.TTL,
+		ExpiresAt:     msg.ExpiresAt,
+		DeliverAt:     msg.DeliverAt,
+		ReplaceKey:    msg.ReplaceKey,
+		CreatedAt:     msg.CreatedAt,
+	}
+	if len(msg.Extras) != 0 {
+		res.Extras = make(map[string]interface{})
+		json.Unmarshal(msg.Extras, &res.Extras)
+	}
+	return res
+}
+
+// withOwnedApplication 在当前用户关注该应用时执行回调，否则返回 404
+func (mess *MessageService) withOwnedApplication(ctx *gin.Context, f func(appID uint)) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		owns, err := mess.DB.JudgeUserOwnsApplication(auth.GetUserID(ctx), id)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		if !owns {
+			ctx.AbortWithError(http.StatusNotFound, errors.New("application does not exist"))
+			return
+		}
+		f(id)
+	})
+}
+
+// 获取应用尚未投递的定时消息，最早投递的在前
+func (mess *MessageService) GetScheduledMessages(ctx *gin.Context) {
+	mess.withOwnedApplication(ctx, func(appID uint) {
+		messages, err := mess.DB.GetScheduledMessagesByApplication(appID)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		res := make([]*model.ScheduledMessageExternal, len(messages))
+		for i, m := range messages {
+			res[i] = toExternalScheduledMessage(m)
+		}
+		ctx.JSON(http.StatusOK, res)
+	})
+}
+
+// 取消尚未投递的定时消息
+func (mess *MessageService) CancelScheduledMessage(ctx *gin.Context) {
+	mess.withOwnedApplication(ctx, func(appID uint) {
+		withIntegerParam(ctx, "scheduledId", func(id uint) {
+			scheduled, err := mess.DB.GetScheduledMessageByID(id)
+			if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+				return
+			}
+			if scheduled == nil || scheduled.ApplicationID != appID {
+				ctx.AbortWithError(http.StatusNotFound, errors.New("scheduled message does not exist"))
+				return
+			}
+			if success := successOrAbort(ctx, http.StatusInternalServerError, mess.DB.DeleteScheduledMessageByID(id)); !success {
+				return
+			}
+			ctx.Status(http.StatusOK)
+		})
+	})
+}
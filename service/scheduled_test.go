@@ -0,0 +1,140 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/database"
+	"go-notify/model"
+)
+
+// failingApplicationDatabase 查询指定应用时返回错误，模拟投递定时消息时的临时故障
+type failingApplicationDatabase struct {
+	*database.GormDatabase
+	failing uint
+}
+
+func (d *failingApplicationDatabase) GetApplicationByID(id uint) (*model.Application, error) {
+	if id == d.failing {
+		return nil, errors.New("database is locked")
+	}
+	return d.GormDatabase.GetApplicationByID(id)
+}
+
+func newSchedulerTestService(t *testing.T, now *time.Time) (*MessageService, *database.GormDatabase, *recordingNotifier) {
+	timeNow = func() time.Time { return *now }
+	t.Cleanup(func() { timeNow = time.Now })
+	db := newWebhookTestDatabase(t)
+	notifier := &recordingNotifier{}
+	return &MessageService{DB: db, Notifier: notifier, Scheduler: NewScheduler()}, db, notifier
+}
+
+func scheduledParams(appID, scheduledID uint) gin.Params {
+	return gin.Params{{Key: "id", Value: strconv.Itoa(int(appID))}, {Key: "scheduledId", Value: strconv.Itoa(int(scheduledID))}}
+}
+
+func TestScheduledMessage_deliveredWhenDue(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	service, db, notifier := newSchedulerTestService(t, &now)
+	app := &model.Application{Name: "backup", Token: "Abackup"}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+
+	body := `{"message":"nightly backup","deliverAt":"2024-05-01T13:00:00Z"}`
+	recorder := performRequest(service.CreateMessage, http.MethodPost, body, 1, "Abackup", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var scheduled model.ScheduledMessageExternal
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &scheduled))
+	assert.Equal(t, "nightly backup", scheduled.Message)
+	assert.Len(t, service.Scheduler.wake, 1, "the scheduler is woken to recompute its timer")
+
+	recorder = performRequest(service.GetScheduledMessages, http.MethodGet, "", 1, "", idParam(app.ID))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var pending []*model.ScheduledMessageExternal
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &pending))
+	require.Len(t, pending, 1)
+	assert.Equal(t, scheduled.ID, pending[0].ID)
+
+	require.NoError(t, service.deliverDueMessages())
+	assert.Empty(t, notifier.notifications, "the message is not due yet")
+
+	now = now.Add(time.Hour)
+	require.NoError(t, service.deliverDueMessages())
+	require.Len(t, notifier.notifications, 1)
+	delivered := notifier.notifications[0].message
+	assert.Equal(t, "nightly backup", delivered.Message)
+	assert.Equal(t, "backup", delivered.Title)
+	assert.True(t, delivered.Date.Equal(now), "the message is dated at its delivery")
+	stored, err := db.GetMessageByID(delivered.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	next, err := db.GetNextScheduledMessage()
+	require.NoError(t, err)
+	assert.Nil(t, next)
+}
+
+func TestCancelScheduledMessage(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	service, db, notifier := newSchedulerTestService(t, &now)
+	require.NoError(t, db.CreateUser(&model.User{Name: "other"}))
+	app := &model.Application{Name: "backup", Token: "Abackup"}
+	require.NoError(t, db.CreateApplicationForUser(app, 1))
+	otherApp := &model.Application{Name: "other", Token: "Aother"}
+	require.NoError(t, db.CreateApplicationForUser(otherApp, 1))
+	scheduled := &model.ScheduledMessage{ApplicationID: app.ID, Message: "later", DeliverAt: now.Add(time.Minute)}
+	require.NoError(t, db.CreateScheduledMessage(scheduled))
+
+	recorder := performRequest(service.CancelScheduledMessage, http.MethodDelete, "", 2, "", scheduledParams(app.ID, scheduled.ID))
+	assert.Equal(t, http.StatusNotFound, recorder.Code, "applications of other users are not visible")
+	recorder = performRequest(service.CancelScheduledMessage, http.MethodDelete, "", 1, "", scheduledParams(otherApp.ID, scheduled.ID))
+	assert.Equal(t, http.StatusNotFound, recorder.Code, "the scheduled message belongs to another application")
+
+	recorder = performRequest(service.CancelScheduledMessage, http.MethodDelete, "", 1, "", scheduledParams(app.ID, scheduled.ID))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	now = now.Add(time.Hour)
+	require.NoError(t, service.deliverDueMessages())
+	assert.Empty(t, notifier.notifications, "cancelled messages are not delivered")
+
+	recorder = performRequest(service.CancelScheduledMessage, http.MethodDelete, "", 1, "", scheduledParams(app.ID, scheduled.ID))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestDeliverDueMessages_postponesFailingMessages(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	service, db, notifier := newSchedulerTestService(t, &now)
+	broken := &model.Application{Name: "broken", Token: "Abroken"}
+	require.NoError(t, db.CreateApplicationForUser(broken, 1))
+	working := &model.Application{Name: "working", Token: "Aworking"}
+	require.NoError(t, db.CreateApplicationForUser(working, 1))
+	service.DB = &failingApplicationDatabase{GormDatabase: db, failing: broken.ID}
+	failing := &model.ScheduledMessage{ApplicationID: broken.ID, Message: "fails", DeliverAt: now}
+	require.NoError(t, db.CreateScheduledMessage(failing))
+	require.NoError(t, db.CreateScheduledMessage(&model.ScheduledMessage{ApplicationID: working.ID, Message: "works", DeliverAt: now}))
+
+	require.NoError(t, service.deliverDueMessages())
+	require.Len(t, notifier.notifications, 1, "a failing message does not block the others")
+	assert.Equal(t, "works", notifier.notifications[0].message.Message)
+	parked, err := db.GetScheduledMessageByID(failing.ID)
+	require.NoError(t, err)
+	require.NotNil(t, parked)
+	assert.Equal(t, 1, parked.Attempts)
+	assert.True(t, parked.DeliverAt.Equal(now.Add(scheduledRetryWait)), "the failing message is retried later")
+	next, err := db.GetNextScheduledMessage()
+	require.NoError(t, err)
+	assert.True(t, next.DeliverAt.After(now), "the scheduler waits instead of retrying at once")
+
+	for attempt := 1; attempt < maxScheduledAttempts; attempt++ {
+		now = now.Add(scheduledRetryWait << (attempt - 1))
+		require.NoError(t, service.deliverDueMessages())
+	}
+	dropped, err := db.GetScheduledMessageByID(failing.ID)
+	require.NoError(t, err)
+	assert.Nil(t, dropped, "the message is dropped after the last attempt")
+	assert.Len(t, notifier.notifications, 1)
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go-notify/model"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseMessageFilter 解析消息列表的过滤条件：
+//
+//	q             标题或内容包含的词，多个词用空格分隔，需要全部匹配
+//	min_priority  最低优先级（含）
+//	max_priority  最高优先级（含）
+//	after         起始时间（含），RFC 3339 格式
+//	before        结束时间（不含），RFC 3339 格式
+//	app_ids       应用ID，可以重复或用逗号分隔
+//	extras_key    Extras 中包含的顶层键
+//	unread        为 true 时只返回未读消息
+func parseMessageFilter(ctx *gin.Context) (*model.MessageFilter, error) {
+	filter := &model.MessageFilter{
+		Search:    strings.TrimSpace(ctx.Query("q")),
+		ExtrasKey: ctx.Query("extras_key"),
+	}
+	var err error
+	if filter.MinPriority, err = parseOptionalInt(ctx.Query("min_priority"), "min_priority"); err != nil {
+		return nil, err
+	}
+	if filter.MaxPriority, err = parseOptionalInt(ctx.Query("max_priority"), "max_priority"); err != nil {
+		return nil, err
+	}
+	if filter.After, err = parseOptionalTime(ctx.Query("after"), "after"); err != nil {
+		return nil, err
+	}
+	if filter.Before, err = parseOptionalTime(ctx.Query("before"), "before"); err != nil {
+		return nil, err
+	}
+	for _, raw := range ctx.QueryArray("app_ids") {
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(s, 10, bits.UintSize)
+			if err != nil {
+				return nil, errors.New("invalid app_ids")
+			}
+			filter.AppIDs = append(filter.AppIDs, uint(id))
+		}
+	}
+	if raw := ctx.Query("unread"); raw != "" {
+		if filter.Unread, err = strconv.ParseBool(raw); err != nil {
+			return nil, errors.New("invalid unread")
+		}
+	}
+	return filter, nil
+}
+
+func parseOptionalInt(raw, name string) (*int, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, errors.New("invalid " + name)
+	}
+	return &n, nil
+}
+
+func parseOptionalTime(raw, name string) (*time.Time, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil, errors.New("invalid " + name)
+	}
+	return &t, nil
+}
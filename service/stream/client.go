@@ -6,11 +6,16 @@ import (
 	"go-notify/model"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	writeWait = 2 * time.Second
+	// replyBufferSize 等待写协程发送的命令回复数量，写满时读协程等待
+	replyBufferSize = 16
+	// resumeWait 等待客户端发送第一帧的最长时间，超时后按不需要补发处理，开始实时推送
+	resumeWait = time.Second
 )
 
 var ping = func(conn *websocket.Conn) error {
@@ -21,52 +26,120 @@ var writeJSON = func(conn *websocket.Conn, v interface{}) error {
 	return conn.WriteJSON(v)
 }
 
+// Client 是一个推送连接，WebSocket 和 SSE 连接共用同一个注册表
 type Client struct {
-	conn    *websocket.Conn
+	conn    *websocket.Conn // WebSocket 连接，SSE 连接为 nil
 	onClose func(*Client)
-	write   chan *model.MessageExternal // 写消息的管道，批量发送
-	userID  uint                        // 用户ID
-	token   string                      // 连接的令牌
+	queue   *sendQueue  // 有界发送队列，由写协程批量发送
+	userID  uint        // 用户ID
+	token   string      // 连接的令牌
+	resume  chan uint   // 补发请求，值为客户端已收到的最后一条消息ID
+	replies chan *Frame // 命令的回复，由写协程发送
 	sync.Once
+	resumeOnce   sync.Once
+	subscription atomic.Pointer[subscription] // 客户端设置的消息过滤条件
+	acked        atomic.Uint64                // 客户端确认收到的最大消息ID，断线时保存为重连的补发起点
 }
 
-func newClient(conn *websocket.Conn, userID uint, token string, onClose func(*Client)) *Client {
+func newClient(conn *websocket.Conn, userID uint, token string, queue QueueConfig, onClose func(*Client)) *Client {
 	return &Client{
 		conn:    conn,
-		write:   make(chan *model.MessageExternal, 1),
+		queue:   newSendQueue(queue),
 		userID:  userID,
 		token:   token,
+		resume:  make(chan uint, 1),
+		replies: make(chan *Frame, replyBufferSize),
 		onClose: onClose,
 	}
 }
 
+// requestResume 请求补发 since 之后的消息，每个连接只生效一次，返回 false 表示已经请求过；
+// since 为 0 表示不需要补发
+func (c *Client) requestResume(since uint) bool {
+	requested := false
+	c.resumeOnce.Do(func() {
+		c.resume <- since
+		requested = true
+	})
+	return requested
+}
+
+// newSSEClient 创建 SSE 连接，消息由请求处理协程从队列中取出并写入响应
+func newSSEClient(userID uint, token string, queue QueueConfig, onClose func(*Client)) *Client {
+	return &Client{
+		queue:   newSendQueue(queue),
+		userID:  userID,
+		token:   token,
+		onClose: onClose,
+	}
+}
+
+// send 把消息放入发送队列，永不阻塞；不符合客户端过滤条件的消息直接忽略
+func (c *Client) send(message *model.MessageExternal) (dropped, disconnect bool) {
+	if !c.accepts(message) {
+		return false, false
+	}
+	return c.queue.push(message)
+}
+
+// sendEvent 把事件放入发送队列；携带消息的事件与消息一样受客户端过滤条件影响
+func (c *Client) sendEvent(event *Event) (dropped, disconnect bool) {
+	if event.Message != nil && !c.accepts(event.Message) {
+		return false, false
+	}
+	return c.queue.pushEvent(event)
+}
+
+func (c *Client) accepts(message *model.MessageExternal) bool {
+	return c.subscription.Load().accepts(message)
+}
+
+// ack 记录客户端确认收到的消息，只保留最大的消息ID
+func (c *Client) ack(id uint) {
+	for {
+		acked := c.acked.Load()
+		if uint64(id) <= acked || c.acked.CompareAndSwap(acked, uint64(id)) {
+			return
+		}
+	}
+}
+
 func (c *Client) Close() {
 	c.Do(func() {
-		close(c.write)
-		_ = c.conn.Close()
+		c.queue.close()
+		c.closeConn()
 	})
 }
 
 func (c *Client) NotifyClose() {
 	if c.onClose != nil {
 		c.Do(func() {
-			c.conn.Close()
-			close(c.write)
+			c.closeConn()
+			c.queue.close()
 			c.onClose(c)
 		})
 	}
 }
 
-func (c *Client) startReading(ctx context.Context, pongWait time.Duration) {
+// closeConn 关闭 WebSocket 连接；SSE 连接在队列关闭后由请求处理协程自行结束
+func (c *Client) closeConn() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
+
+// startReading 读取客户端发送的命令，handle 处理一帧并返回需要回复的帧
+func (c *Client) startReading(ctx context.Context, pongWait time.Duration, readLimit int64,
+	handle func(data []byte, first bool) *Frame) {
 	defer c.NotifyClose()
 	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
-	c.conn.SetReadLimit(512)
+	c.conn.SetReadLimit(readLimit)
+	first := true
 	for {
-		log.Print("Waiting for WebSocket message from ", c.conn.RemoteAddr())
 		select {
 		case <-ctx.Done():
 			return
@@ -78,31 +151,72 @@ func (c *Client) startReading(ctx context.Context, pongWait time.Duration) {
 			if msgType == websocket.CloseMessage {
 				return
 			}
-			// 处理收到的消息 msgData
-			log.Print("Received message: ", string(msgData))
+			reply := handle(msgData, first)
+			if first {
+				// 第一帧不是补发请求时表示客户端不需要补发
+				first = false
+				c.requestResume(0)
+			}
+			if reply == nil {
+				continue
+			}
+			select {
+			case c.replies <- reply:
+			case <-c.queue.done:
+				return
+			}
 		}
 	}
 }
 
-func (c *Client) startWriting(ctx context.Context, pingPeriod time.Duration) {
+// startWriting 负责该连接的所有写操作，replay 用于分页补发 since 之后的消息
+func (c *Client) startWriting(ctx context.Context, pingPeriod time.Duration,
+	replay func(state *replayState, since uint, send func([]*model.MessageExternal) error) error) {
 	pingTicker := time.NewTicker(pingPeriod)
+	resumeTimer := time.NewTimer(resumeWait)
+	state := newReplayState()
 	defer func() {
 		c.NotifyClose()
 		pingTicker.Stop()
+		resumeTimer.Stop()
 	}()
 	log.Print("WebSocket connection established: ", c.conn.RemoteAddr())
+	// 补发完成之前不读取发送队列，实时消息不会早于补发的消息到达，与补发重复的消息在之后被跳过
+	var ready <-chan struct{}
 	for {
 		select {
-		case message, ok := <-c.write:
-			if !ok {
+		case <-resumeTimer.C:
+			c.requestResume(0)
+		case since := <-c.resume:
+			resumeTimer.Stop()
+			if err := replay(state, since, c.writeMessages); err != nil {
+				printWebSocketError("ReplayError", err)
 				return
 			}
-
+			ready = c.queue.ready
+		case <-ready:
+			for _, item := range c.queue.drain() {
+				var frame interface{} = item.event
+				if item.message != nil {
+					if !state.live(item.message) {
+						continue
+					}
+					frame = item.message
+				}
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := writeJSON(c.conn, frame); err != nil {
+					printWebSocketError("WriteError", err)
+					return
+				}
+			}
+		case reply := <-c.replies:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := writeJSON(c.conn, message); err != nil {
+			if err := writeJSON(c.conn, reply); err != nil {
 				printWebSocketError("WriteError", err)
 				return
 			}
+		case <-c.queue.done:
+			return
 		case <-pingTicker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := ping(c.conn); err != nil {
@@ -111,12 +225,22 @@ func (c *Client) startWriting(ctx context.Context, pingPeriod time.Duration) {
 			}
 		case <-ctx.Done():
 			return
-		default:
-			// No messages to send, just wait a bit
-			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
 
+// writeMessages 发送补发的消息，不符合客户端过滤条件的消息被跳过
+func (c *Client) writeMessages(messages []*model.MessageExternal) error {
+	for _, message := range messages {
+		if !c.accepts(message) {
+			continue
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := writeJSON(c.conn, message); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func printWebSocketError(s string, err error) {
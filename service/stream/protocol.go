@@ -0,0 +1,184 @@
+package websockettools
+
+import (
+	"errors"
+	"fmt"
+	"go-notify/model"
+
+	json "github.com/bytedance/sonic"
+)
+
+// 客户端通过 WebSocket 发送的命令，每一帧是一个带 type 字段的 JSON 对象：
+//
+//	{"type":"resume","since":<id>}                       补发 since 之后的消息，只能作为第一帧
+//	{"type":"ack","id":<id>}                             确认已收到某条消息，同一令牌重连时默认从这里补发
+//	{"type":"read","ids":[<id>...]}                      把消息标记为已读
+//	{"type":"subscribe","appIds":[...],"minPriority":<n>} 只接收这些应用、不低于该优先级的消息
+//	{"type":"unsubscribe","appIds":[...]}                不再接收这些应用的消息，不带 appIds 时取消所有过滤
+//	{"type":"ping"}                                      应用层心跳，服务端回复 pong
+//
+// 命令可以携带 ref，服务端的回复会带上相同的 ref。ack 之外的命令成功时回复 {"type":"ok"}，
+// ping 回复 {"type":"pong"}，失败时回复 {"type":"error","error":"..."}。
+// 推送的消息仍然是不带 type 的消息对象，与旧客户端兼容。
+// 补发完成之前不推送实时消息；第一帧不是 resume，或连接后 resumeWait 内没有收到任何帧时按不需要补发处理
+const (
+	commandResume      = "resume"
+	commandAck         = "ack"
+	commandRead        = "read"
+	commandSubscribe   = "subscribe"
+	commandUnsubscribe = "unsubscribe"
+	commandPing        = "ping"
+
+	frameOK    = "ok"
+	framePong  = "pong"
+	frameError = "error"
+)
+
+// command 是客户端发送的一帧命令
+type command struct {
+	Type        string `json:"type"`
+	Ref         string `json:"ref,omitempty"`
+	Since       uint   `json:"since,omitempty"`
+	ID          uint   `json:"id,omitempty"`
+	IDs         []uint `json:"ids,omitempty"`
+	AppIDs      []uint `json:"appIds,omitempty"`
+	MinPriority *int   `json:"minPriority,omitempty"`
+}
+
+// Frame 是服务端对命令的回复
+type Frame struct {
+	Type  string `json:"type"`
+	Ref   string `json:"ref,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// MarkReadFunc 把用户的消息标记为已读
+type MarkReadFunc func(userID uint, messageIDs []uint) error
+
+// subscription 是连接的消息过滤条件，零值表示接收所有消息
+type subscription struct {
+	apps        map[uint]struct{} // 只接收这些应用的消息，nil 表示所有应用
+	muted       map[uint]struct{} // 不接收这些应用的消息
+	minPriority int
+}
+
+func (s *subscription) accepts(message *model.MessageExternal) bool {
+	if s == nil {
+		return true
+	}
+	if _, ok := s.muted[message.ApplicationID]; ok {
+		return false
+	}
+	if s.apps != nil {
+		if _, ok := s.apps[message.ApplicationID]; !ok {
+			return false
+		}
+	}
+	return message.Priority >= s.minPriority
+}
+
+// subscribe 返回加入 appIDs 并更新最低优先级后的新过滤条件，原条件不变
+func (s *subscription) subscribe(appIDs []uint, minPriority *int) *subscription {
+	next := s.copy()
+	if len(appIDs) > 0 {
+		if next.apps == nil {
+			next.apps = make(map[uint]struct{})
+		}
+		for _, id := range appIDs {
+			next.apps[id] = struct{}{}
+			delete(next.muted, id)
+		}
+	}
+	if minPriority != nil {
+		next.minPriority = *minPriority
+	}
+	return next
+}
+
+// unsubscribe 返回去掉 appIDs 后的新过滤条件；appIDs 为空时返回 nil，即取消所有过滤
+func (s *subscription) unsubscribe(appIDs []uint) *subscription {
+	if len(appIDs) == 0 {
+		return nil
+	}
+	next := s.copy()
+	if next.muted == nil {
+		next.muted = make(map[uint]struct{})
+	}
+	for _, id := range appIDs {
+		delete(next.apps, id)
+		next.muted[id] = struct{}{}
+	}
+	return next
+}
+
+func (s *subscription) copy() *subscription {
+	next := &subscription{}
+	if s == nil {
+		return next
+	}
+	next.minPriority = s.minPriority
+	if s.apps != nil {
+		next.apps = make(map[uint]struct{}, len(s.apps))
+		for id := range s.apps {
+			next.apps[id] = struct{}{}
+		}
+	}
+	if s.muted != nil {
+		next.muted = make(map[uint]struct{}, len(s.muted))
+		for id := range s.muted {
+			next.muted[id] = struct{}{}
+		}
+	}
+	return next
+}
+
+// handleCommand 处理客户端发送的一帧，返回需要回复的帧，ack 不需要回复时返回 nil
+func (ws *WebSocketStream) handleCommand(c *Client, data []byte, first bool) *Frame {
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return &Frame{Type: frameError, Error: "invalid frame: " + err.Error()}
+	}
+	reply := func(err error) *Frame {
+		if err != nil {
+			return &Frame{Type: frameError, Ref: cmd.Ref, Error: err.Error()}
+		}
+		return &Frame{Type: frameOK, Ref: cmd.Ref}
+	}
+	switch cmd.Type {
+	case commandResume:
+		if !first {
+			return reply(errors.New("resume must be the first frame"))
+		}
+		if !c.requestResume(cmd.Since) {
+			return reply(errors.New("resume was already requested when connecting"))
+		}
+		return reply(nil)
+	case commandAck:
+		if cmd.ID == 0 {
+			return reply(errors.New("ack requires a message id"))
+		}
+		c.ack(cmd.ID)
+		return nil
+	case commandRead:
+		if len(cmd.IDs) == 0 {
+			return reply(errors.New("read requires message ids"))
+		}
+		if ws.markRead == nil {
+			return reply(errors.New("marking messages as read is not supported"))
+		}
+		return reply(ws.markRead(c.userID, cmd.IDs))
+	case commandSubscribe:
+		if len(cmd.AppIDs) == 0 && cmd.MinPriority == nil {
+			return reply(errors.New("subscribe requires appIds or minPriority"))
+		}
+		c.subscription.Store(c.subscription.Load().subscribe(cmd.AppIDs, cmd.MinPriority))
+		return reply(nil)
+	case commandUnsubscribe:
+		c.subscription.Store(c.subscription.Load().unsubscribe(cmd.AppIDs))
+		return reply(nil)
+	case commandPing:
+		return &Frame{Type: framePong, Ref: cmd.Ref}
+	default:
+		return reply(fmt.Errorf("unknown frame type %q", cmd.Type))
+	}
+}
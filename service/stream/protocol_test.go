@@ -0,0 +1,133 @@
+package websockettools
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go-notify/model"
+)
+
+func newTestClient() *Client {
+	return newClient(nil, 7, "Ctoken", QueueConfig{Size: 8, Policy: DropOldest}, nil)
+}
+
+func TestHandleCommand_subscribeFiltersMessages(t *testing.T) {
+	ws := &WebSocketStream{}
+	c := newTestClient()
+
+	reply := ws.handleCommand(c, []byte(`{"type":"subscribe","ref":"1","appIds":[1,2],"minPriority":5}`), false)
+	assert.Equal(t, &Frame{Type: frameOK, Ref: "1"}, reply)
+	c.send(&model.MessageExternal{ID: 1, ApplicationID: 1, Priority: 5})
+	c.send(&model.MessageExternal{ID: 2, ApplicationID: 1, Priority: 4})
+	c.send(&model.MessageExternal{ID: 3, ApplicationID: 3, Priority: 9})
+	c.send(&model.MessageExternal{ID: 4, ApplicationID: 2, Priority: 9})
+	assert.Equal(t, []uint{1, 4}, queuedMessageIDs(c.queue.drain()))
+
+	ws.handleCommand(c, []byte(`{"type":"unsubscribe","appIds":[2]}`), false)
+	c.send(&model.MessageExternal{ID: 5, ApplicationID: 1, Priority: 5})
+	c.send(&model.MessageExternal{ID: 6, ApplicationID: 2, Priority: 9})
+	assert.Equal(t, []uint{5}, queuedMessageIDs(c.queue.drain()))
+
+	ws.handleCommand(c, []byte(`{"type":"unsubscribe"}`), false)
+	c.send(&model.MessageExternal{ID: 7, ApplicationID: 3, Priority: 0})
+	assert.Equal(t, []uint{7}, queuedMessageIDs(c.queue.drain()))
+}
+
+func TestHandleCommand_unsubscribeWithoutSubscription(t *testing.T) {
+	ws := &WebSocketStream{}
+	c := newTestClient()
+
+	ws.handleCommand(c, []byte(`{"type":"unsubscribe","appIds":[2]}`), false)
+	c.send(&model.MessageExternal{ID: 1, ApplicationID: 1})
+	c.send(&model.MessageExternal{ID: 2, ApplicationID: 2})
+	assert.Equal(t, []uint{1}, queuedMessageIDs(c.queue.drain()))
+}
+
+func TestHandleCommand_ack(t *testing.T) {
+	ws := &WebSocketStream{}
+	c := newTestClient()
+
+	assert.Nil(t, ws.handleCommand(c, []byte(`{"type":"ack","id":5}`), false))
+	assert.Nil(t, ws.handleCommand(c, []byte(`{"type":"ack","id":3}`), false))
+	assert.Equal(t, uint64(5), c.acked.Load())
+
+	reply := ws.handleCommand(c, []byte(`{"type":"ack"}`), false)
+	assert.Equal(t, frameError, reply.Type)
+}
+
+func TestHandleCommand_read(t *testing.T) {
+	ws := &WebSocketStream{}
+	c := newTestClient()
+
+	reply := ws.handleCommand(c, []byte(`{"type":"read","ids":[1]}`), false)
+	assert.Equal(t, frameError, reply.Type)
+
+	var marked []uint
+	ws.SetMarkRead(func(userID uint, ids []uint) error {
+		assert.Equal(t, uint(7), userID)
+		marked = ids
+		return nil
+	})
+	reply = ws.handleCommand(c, []byte(`{"type":"read","ref":"r","ids":[1,2]}`), false)
+	assert.Equal(t, &Frame{Type: frameOK, Ref: "r"}, reply)
+	assert.Equal(t, []uint{1, 2}, marked)
+
+	ws.SetMarkRead(func(userID uint, ids []uint) error { return errors.New("boom") })
+	reply = ws.handleCommand(c, []byte(`{"type":"read","ids":[1]}`), false)
+	assert.Equal(t, &Frame{Type: frameError, Error: "boom"}, reply)
+}
+
+func TestHandleCommand_resumeOnlyAsFirstFrame(t *testing.T) {
+	ws := &WebSocketStream{}
+	c := newTestClient()
+
+	reply := ws.handleCommand(c, []byte(`{"type":"resume","since":3}`), false)
+	assert.Equal(t, frameError, reply.Type)
+	assert.Empty(t, c.resume)
+
+	reply = ws.handleCommand(c, []byte(`{"type":"resume","since":3}`), true)
+	assert.Equal(t, frameOK, reply.Type)
+	assert.Equal(t, uint(3), <-c.resume)
+
+	// 连接时已经通过查询参数 since 请求过补发
+	c = newTestClient()
+	c.requestResume(5)
+	reply = ws.handleCommand(c, []byte(`{"type":"resume","since":3}`), true)
+	assert.Equal(t, frameError, reply.Type)
+	assert.Equal(t, uint(5), <-c.resume)
+}
+
+func TestHandleCommand_pingAndErrors(t *testing.T) {
+	ws := &WebSocketStream{}
+	c := newTestClient()
+
+	assert.Equal(t, &Frame{Type: framePong, Ref: "p"}, ws.handleCommand(c, []byte(`{"type":"ping","ref":"p"}`), false))
+	assert.Equal(t, &Frame{Type: frameError, Ref: "x", Error: `unknown frame type "nope"`},
+		ws.handleCommand(c, []byte(`{"type":"nope","ref":"x"}`), false))
+	assert.Equal(t, frameError, ws.handleCommand(c, []byte(`not json`), false).Type)
+}
+
+func TestHandleCommand_subscriptionFiltersEvents(t *testing.T) {
+	ws := &WebSocketStream{}
+	c := newTestClient()
+
+	ws.handleCommand(c, []byte(`{"type":"subscribe","appIds":[1]}`), false)
+	c.sendEvent(&Event{Type: EventUpdated, Message: &model.MessageExternal{ID: 1, ApplicationID: 2}})
+	c.sendEvent(&Event{Type: EventUpdated, Message: &model.MessageExternal{ID: 2, ApplicationID: 1}})
+	items := c.queue.drain()
+	assert.Len(t, items, 1)
+	assert.Equal(t, uint(2), items[0].event.Message.ID)
+}
+
+func TestNotifyClient_onlyTheClientsConnections(t *testing.T) {
+	phone := newClient(nil, 7, "Cphone", QueueConfig{Size: 8, Policy: DropOldest}, nil)
+	tablet := newClient(nil, 7, "Ctablet", QueueConfig{Size: 8, Policy: DropOldest}, nil)
+	other := newClient(nil, 8, "Cphone", QueueConfig{Size: 8, Policy: DropOldest}, nil)
+	ws := &WebSocketStream{clients: map[uint][]*Client{7: {phone, tablet}, 8: {other}}}
+
+	ws.NotifyClient(7, "Cphone", &model.MessageExternal{ID: 1})
+	assert.Equal(t, []uint{1}, queuedMessageIDs(phone.queue.drain()))
+	assert.Empty(t, tablet.queue.drain())
+	assert.Empty(t, other.queue.drain())
+}
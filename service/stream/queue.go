@@ -0,0 +1,129 @@
+package websockettools
+
+import (
+	"go-notify/model"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy 决定连接的发送队列已满时如何处理新消息
+type OverflowPolicy string
+
+const (
+	// DropOldest 丢弃队列中最早的消息，为新消息腾出位置
+	DropOldest OverflowPolicy = "drop-oldest"
+	// DropNewest 丢弃新到达的消息
+	DropNewest OverflowPolicy = "drop-newest"
+	// Disconnect 断开消费过慢的连接，客户端重连后可以重新拉取消息
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+func (p OverflowPolicy) valid() bool {
+	return p == DropOldest || p == DropNewest || p == Disconnect
+}
+
+// QueueConfig 配置每个连接的发送队列
+type QueueConfig struct {
+	Size   int
+	Policy OverflowPolicy
+}
+
+// Event 是推送给客户端的消息之外的通知，带有 type 字段以便与消息区分
+type Event struct {
+	Type    string                 `json:"type"`
+	IDs     []uint                 `json:"ids,omitempty"`
+	Message *model.MessageExternal `json:"message,omitempty"`
+}
+
+const (
+	// EventDeleted 通知客户端这些消息已被删除
+	EventDeleted = "deleted"
+	// EventUpdated 推送替换了已有消息的新消息，被替换的消息ID在之前的 deleted 事件中通知
+	EventUpdated = "updated"
+)
+
+// outbound 是发送队列中的一项，message 和 event 只有一个不为 nil
+type outbound struct {
+	message *model.MessageExternal
+	event   *Event
+}
+
+// sendQueue 是每个连接独立的有界发送队列，入队永不阻塞，由写协程负责出队
+type sendQueue struct {
+	lock    sync.Mutex
+	items   []*outbound
+	size    int
+	policy  OverflowPolicy
+	closed  bool
+	ready   chan struct{} // 有新消息时发出信号，缓冲为1
+	done    chan struct{} // 队列关闭时关闭
+	dropped atomic.Uint64
+}
+
+func newSendQueue(conf QueueConfig) *sendQueue {
+	return &sendQueue{
+		items:  make([]*outbound, 0, conf.Size),
+		size:   conf.Size,
+		policy: conf.Policy,
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// push 把消息放入队列；dropped 表示有消息被丢弃，disconnect 表示按照策略应断开该连接
+func (q *sendQueue) push(message *model.MessageExternal) (dropped, disconnect bool) {
+	return q.pushItem(&outbound{message: message})
+}
+
+// pushEvent 把事件放入队列，队列已满时与消息按照同样的策略处理
+func (q *sendQueue) pushEvent(event *Event) (dropped, disconnect bool) {
+	return q.pushItem(&outbound{event: event})
+}
+
+func (q *sendQueue) pushItem(item *outbound) (dropped, disconnect bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false, false
+	}
+	if len(q.items) >= q.size {
+		q.dropped.Add(1)
+		switch q.policy {
+		case DropNewest:
+			return true, false
+		case Disconnect:
+			return true, true
+		default:
+			q.items = append(q.items[:0], q.items[1:]...)
+		}
+		dropped = true
+	}
+	q.items = append(q.items, item)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return dropped, false
+}
+
+// drain 取出队列中的所有消息和事件
+func (q *sendQueue) drain() []*outbound {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	items := q.items
+	q.items = make([]*outbound, 0, q.size)
+	return items
+}
+
+func (q *sendQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.items = nil
+		close(q.done)
+	}
+}
@@ -0,0 +1,81 @@
+package websockettools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go-notify/model"
+)
+
+func messageIDs(messages []*model.MessageExternal) []uint {
+	ids := make([]uint, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+// queuedMessageIDs 返回队列项中消息的ID，事件被忽略
+func queuedMessageIDs(items []*outbound) []uint {
+	ids := make([]uint, 0, len(items))
+	for _, item := range items {
+		if item.message != nil {
+			ids = append(ids, item.message.ID)
+		}
+	}
+	return ids
+}
+
+func TestSendQueue_dropOldest(t *testing.T) {
+	q := newSendQueue(QueueConfig{Size: 2, Policy: DropOldest})
+	for i := uint(1); i <= 3; i++ {
+		dropped, disconnect := q.push(&model.MessageExternal{ID: i})
+		assert.Equal(t, i == 3, dropped)
+		assert.False(t, disconnect)
+	}
+	assert.Len(t, q.ready, 1)
+	assert.Equal(t, []uint{2, 3}, queuedMessageIDs(q.drain()))
+	assert.Nil(t, q.drain())
+	assert.Equal(t, uint64(1), q.dropped.Load())
+}
+
+func TestSendQueue_dropNewest(t *testing.T) {
+	q := newSendQueue(QueueConfig{Size: 2, Policy: DropNewest})
+	for i := uint(1); i <= 3; i++ {
+		q.push(&model.MessageExternal{ID: i})
+	}
+	assert.Equal(t, []uint{1, 2}, queuedMessageIDs(q.drain()))
+	assert.Equal(t, uint64(1), q.dropped.Load())
+}
+
+func TestSendQueue_disconnect(t *testing.T) {
+	q := newSendQueue(QueueConfig{Size: 1, Policy: Disconnect})
+	_, disconnect := q.push(&model.MessageExternal{ID: 1})
+	assert.False(t, disconnect)
+	dropped, disconnect := q.push(&model.MessageExternal{ID: 2})
+	assert.True(t, dropped)
+	assert.True(t, disconnect)
+}
+
+func TestSendQueue_closed(t *testing.T) {
+	q := newSendQueue(QueueConfig{Size: 1, Policy: DropOldest})
+	q.close()
+	q.close()
+	dropped, disconnect := q.push(&model.MessageExternal{ID: 1})
+	assert.False(t, dropped)
+	assert.False(t, disconnect)
+	assert.Nil(t, q.drain())
+	<-q.done
+}
+
+func TestSendQueue_events(t *testing.T) {
+	q := newSendQueue(QueueConfig{Size: 2, Policy: DropOldest})
+	q.push(&model.MessageExternal{ID: 1})
+	q.pushEvent(&Event{Type: EventDeleted, IDs: []uint{1}})
+	q.push(&model.MessageExternal{ID: 2})
+	items := q.drain()
+	assert.Len(t, items, 2)
+	assert.Equal(t, &Event{Type: EventDeleted, IDs: []uint{1}}, items[0].event)
+	assert.Equal(t, uint(2), items[1].message.ID)
+	assert.Equal(t, uint64(1), q.dropped.Load())
+}
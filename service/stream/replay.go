@@ -0,0 +1,52 @@
+package websockettools
+
+import (
+	"go-notify/model"
+)
+
+// replayPageSize 重连补发时每次查询的消息数量
+const replayPageSize = 200
+
+// ReplayFunc 返回用户ID大于 since 的最早 limit 条消息，按ID从小到大排列，不包含其它客户端的 UnifiedPush 注册的消息
+type ReplayFunc func(userID uint, clientToken string, since uint, limit int) ([]*model.MessageExternal, error)
+
+// replayState 协调重连补发与实时推送，保证两者之间既不重复也不遗漏。
+// 连接在查询补发消息之前就已注册，补发期间创建的消息会进入发送队列，补发结束后才发送；
+// 补发会一直分页查询到最新的消息，因此队列中ID不大于补发游标的消息都已经发送过
+type replayState struct {
+	after uint // 已补发的最后一条消息ID
+}
+
+func newReplayState() *replayState {
+	return &replayState{}
+}
+
+// live 在实时推送消息前调用，返回 false 表示该消息已经补发过
+func (s *replayState) live(message *model.MessageExternal) bool {
+	return message.ID > s.after
+}
+
+// resume 从 since 之后按ID从小到大分页补发消息，直到追上最新的消息，每一页调用一次 send；
+// since 为 0 表示不需要补发
+func (ws *WebSocketStream) resume(state *replayState, userID uint, token string, since uint,
+	send func(messages []*model.MessageExternal) error) error {
+	if since == 0 || ws.replay == nil {
+		return nil
+	}
+	state.after = since
+	for {
+		messages, err := ws.replay(userID, token, state.after, replayPageSize)
+		if err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			if err := send(messages); err != nil {
+				return err
+			}
+			state.after = messages[len(messages)-1].ID
+		}
+		if len(messages) < replayPageSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package websockettools
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+// replayFromLog 模拟数据库中ID为 1..last 的消息，按 ReplayFunc 的约定分页返回
+func replayFromLog(last uint, calls *int) ReplayFunc {
+	return func(userID uint, token string, since uint, limit int) ([]*model.MessageExternal, error) {
+		*calls++
+		var messages []*model.MessageExternal
+		for id := since + 1; id <= last && len(messages) < limit; id++ {
+			messages = append(messages, &model.MessageExternal{ID: id})
+		}
+		return messages, nil
+	}
+}
+
+func TestResume_pagesUntilCaughtUp(t *testing.T) {
+	var calls int
+	ws := &WebSocketStream{replay: replayFromLog(2*replayPageSize+50, &calls)}
+	state := newReplayState()
+
+	var sent []uint
+	err := ws.resume(state, 7, "Cphone", 10, func(messages []*model.MessageExternal) error {
+		sent = append(sent, messageIDs(messages)...)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	require.Len(t, sent, 2*replayPageSize+40, "every missed message is replayed, not only the newest page")
+	assert.Equal(t, uint(11), sent[0])
+	assert.Equal(t, uint(2*replayPageSize+50), sent[len(sent)-1])
+	for i := 1; i < len(sent); i++ {
+		assert.Less(t, sent[i-1], sent[i], "messages are replayed oldest first")
+	}
+
+	// 补发期间进入发送队列的重复消息被跳过，新消息正常发送
+	assert.False(t, state.live(&model.MessageExternal{ID: 5}))
+	assert.False(t, state.live(&model.MessageExternal{ID: 2*replayPageSize + 50}))
+	assert.True(t, state.live(&model.MessageExternal{ID: 2*replayPageSize + 51}))
+}
+
+func TestResume_withoutSince(t *testing.T) {
+	ws := &WebSocketStream{replay: func(userID uint, token string, since uint, limit int) ([]*model.MessageExternal, error) {
+		t.Fatal("replay must not be queried")
+		return nil, nil
+	}}
+	state := newReplayState()
+	err := ws.resume(state, 7, "Cphone", 0, func(messages []*model.MessageExternal) error {
+		t.Fatal("nothing must be sent")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, state.live(&model.MessageExternal{ID: 1}))
+}
+
+func TestSSEHandler_replaysFromLastEventIDBeforeLiveMessages(t *testing.T) {
+	var ws *WebSocketStream
+	var calls int
+	last := uint(replayPageSize + 60)
+	replay := replayFromLog(last, &calls)
+	ws, server := newTestStreamServerWithReplay(t, func(userID uint, token string, since uint, limit int) ([]*model.MessageExternal, error) {
+		if calls == 0 {
+			assert.Equal(t, "Csse", token, "the messages are replayed for the connecting client")
+			// 补发期间创建的消息也在数据库中，不能重复发送，也不能早于补发的消息发送
+			ws.Notify(userID, &model.MessageExternal{ID: last})
+		}
+		return replay(userID, token, since, limit)
+	})
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/stream/sse?user=1&token=Csse", nil)
+	require.NoError(t, err)
+	request.Header.Set("Last-Event-ID", "10")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	events := bufio.NewScanner(response.Body)
+	nextID := func() uint {
+		for events.Scan() {
+			if id, ok := strings.CutPrefix(events.Text(), "id: "); ok {
+				parsed, err := strconv.ParseUint(id, 10, 64)
+				require.NoError(t, err)
+				return uint(parsed)
+			}
+		}
+		t.Fatal("the stream ended: ", events.Err())
+		return 0
+	}
+	for id := uint(11); id <= last; id++ {
+		require.Equal(t, id, nextID())
+	}
+	ws.Notify(1, &model.MessageExternal{ID: last + 1})
+	assert.Equal(t, last+1, nextID(), "the live message queued during the replay was skipped")
+}
+
+func TestGinHandler_replaysBeforeLiveMessages(t *testing.T) {
+	var ws *WebSocketStream
+	var calls int
+	last := uint(replayPageSize + 60)
+	replay := replayFromLog(last, &calls)
+	ws, server := newTestStreamServerWithReplay(t, func(userID uint, token string, since uint, limit int) ([]*model.MessageExternal, error) {
+		if calls == 0 {
+			ws.Notify(userID, &model.MessageExternal{ID: last})
+		}
+		return replay(userID, token, since, limit)
+	})
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/stream?user=1&token=Cws&since=10"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for id := uint(11); id <= last; id++ {
+		var message model.MessageExternal
+		require.NoError(t, conn.ReadJSON(&message))
+		require.Equal(t, id, message.ID, "the live message must not overtake the replay")
+	}
+	ws.Notify(1, &model.MessageExternal{ID: last + 1})
+	var message model.MessageExternal
+	require.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, last+1, message.ID, "the live message queued during the replay was skipped")
+}
+
+func TestGinHandler_deliversLiveMessagesWithoutResume(t *testing.T) {
+	ws, server := newTestStreamServer(t)
+	conn := dialStream(t, server, 1, "Cquiet")
+	require.Eventually(t, func() bool {
+		return len(connectedTokens(ws)[1]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 客户端没有发送任何帧，等待 resumeWait 后开始实时推送
+	ws.Notify(1, &model.MessageExternal{ID: 1})
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(resumeWait+5*time.Second)))
+	var message model.MessageExternal
+	require.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, uint(1), message.ID)
+}
+
+func TestGinHandler_resumesFromAckedMessageOfTheToken(t *testing.T) {
+	var calls int
+	ws, server := newTestStreamServerWithReplay(t, replayFromLog(20, &calls))
+	conn := dialStream(t, server, 1, "Cphone")
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "ack", "id": 7}))
+	require.Eventually(t, func() bool {
+		return len(connectedTokens(ws)[1]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		return ws.ackedSince(1, "Cphone") == 7
+	}, 5*time.Second, 10*time.Millisecond, "the acked message is kept after the connection closed")
+	assert.Zero(t, ws.ackedSince(1, "Cother"))
+
+	conn = dialStream(t, server, 1, "Cphone")
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(resumeWait+5*time.Second)))
+	for id := uint(8); id <= 20; id++ {
+		var message model.MessageExternal
+		require.NoError(t, conn.ReadJSON(&message))
+		require.Equal(t, id, message.ID)
+	}
+
+	ws.RemoveClientByToken(1, "Cphone")
+	assert.Zero(t, ws.ackedSince(1, "Cphone"), "revoked tokens forget their cursor")
+}
@@ -0,0 +1,132 @@
+package websockettools
+
+import (
+	"errors"
+	"fmt"
+	"go-notify/auth"
+	"go-notify/model"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+// SSEHandler 以 Server-Sent Events 推送消息，供无法使用 WebSocket 的客户端（例如位于不支持升级的代理之后）使用。
+// 与 WebSocket 共用连接注册表和认证方式，每条消息的 id 为消息ID，
+// 重连时浏览器携带的 Last-Event-ID（或查询参数 lastEventId）用于补发断线期间的消息
+func (ws *WebSocketStream) SSEHandler(ctx *gin.Context) {
+	token := auth.GetTokenID(ctx)
+	if token == "" {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("the stream requires a client token"))
+		return
+	}
+	lastEventID, err := parseLastEventID(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	userID := auth.GetUserID(ctx)
+
+	header := ctx.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no") // 关闭 nginx 的响应缓冲
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+
+	// 先注册连接再查询补发的消息，保证补发和实时推送之间没有遗漏
+	c := newSSEClient(userID, token, ws.queue, ws.removeConnection)
+	ws.AddClient(c)
+	defer c.NotifyClose()
+	log.Print("SSE connected: ", ctx.Request.RemoteAddr)
+
+	// 补发结束后才开始发送队列中的实时消息，与补发重复的消息会被跳过
+	state := newReplayState()
+	err = ws.resume(state, userID, token, lastEventID, func(messages []*model.MessageExternal) error {
+		for _, message := range messages {
+			if err := writeSSEMessage(ctx.Writer, message); err != nil {
+				return err
+			}
+		}
+		ctx.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		log.Printf("SSE replay for user %d failed: %v", userID, err)
+		return
+	}
+
+	pingTicker := time.NewTicker(ws.pingPeriod)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case <-c.queue.ready:
+			for _, item := range c.queue.drain() {
+				if item.event != nil {
+					if err := writeSSEEvent(ctx.Writer, item.event); err != nil {
+						return
+					}
+					continue
+				}
+				if !state.live(item.message) {
+					continue
+				}
+				if err := writeSSEMessage(ctx.Writer, item.message); err != nil {
+					return
+				}
+			}
+			ctx.Writer.Flush()
+		case <-pingTicker.C:
+			// 注释行用于保持连接，客户端会忽略
+			if _, err := io.WriteString(ctx.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+		case <-c.queue.done:
+			return
+		case <-ctx.Request.Context().Done():
+			return
+		case <-ws.ctx.Done():
+			return
+		}
+	}
+}
+
+func parseLastEventID(ctx *gin.Context) (uint, error) {
+	raw := ctx.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = ctx.Query("lastEventId")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid Last-Event-ID")
+	}
+	return uint(id), nil
+}
+
+func writeSSEMessage(w io.Writer, message *model.MessageExternal) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", message.ID, data)
+	return err
+}
+
+// writeSSEEvent 以事件类型作为 SSE 的 event 字段，不带 id，不影响客户端的 Last-Event-ID
+func writeSSEEvent(w io.Writer, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
@@ -2,13 +2,17 @@ package websockettools
 
 import (
 	"context"
+	"errors"
+	"go-notify/auth"
 	"go-notify/model"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,8 +24,21 @@ type WebSocketStream struct {
 	lock        sync.RWMutex
 	pingPeriod  time.Duration
 	pongTimeout time.Duration
+	readLimit   int64 // 客户端单帧命令的最大字节数
 	upgrader    websocket.Upgrader
 	ctx         context.Context
+	queue       QueueConfig
+	replay      ReplayFunc    // 查询断线期间的消息，用于重连补发
+	markRead    MarkReadFunc  // 处理客户端的 read 命令，为 nil 时不支持
+	dropped     atomic.Uint64 // 因发送队列已满而被丢弃的消息总数
+	// acked 记录每个客户端令牌断线前确认收到的最大消息ID，重连时没有指定 since 则从这里补发；
+	// 只保存在内存中，服务重启后需要客户端自行指定 since
+	acked map[ackKey]uint
+}
+
+type ackKey struct {
+	userID uint
+	token  string
 }
 
 // 辅助函数
@@ -58,42 +75,84 @@ func isAllowedOrigin(r *http.Request, allowedOrigins []*regexp.Regexp) bool {
 	return false
 }
 
-var (
-	userID uint = 0
-)
-
+// GinHandler 把请求升级为 WebSocket 连接，需要在之前经过 RequireClient 认证，
+// 连接以令牌所属的用户注册，同一用户可以有多个设备同时连接。
+// 断线重连时可以通过查询参数 since（或第一帧 {"type":"resume","since":<id>}）补发该ID之后的消息，
+// 没有指定时从该令牌上次连接通过 ack 确认的最大消息ID之后补发，连接上支持的其它命令见 protocol.go
 func (ws *WebSocketStream) GinHandler(ctx *gin.Context) {
+	token := auth.GetTokenID(ctx)
+	if token == "" {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("the stream requires a client token"))
+		return
+	}
+	var since uint
+	if raw := ctx.Query("since"); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid since"))
+			return
+		}
+		since = uint(id)
+	}
+	userID := auth.GetUserID(ctx)
 	conn, err := ws.upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 	if err != nil {
 		return
 	}
 	log.Print("WebSocket connected: ", ctx.Request.RemoteAddr)
-	c := newClient(conn, userID, "", func(client *Client) {
-		ws.RemoveClient(client.userID)
-	})
-	// 一个用户ID自增，实际应用中应使用真实用户ID，并且一个用户可能有多个连接
-	userID++
+	c := newClient(conn, userID, token, ws.queue, ws.removeConnection)
+	// 先注册连接再补发，补发期间创建的消息会进入发送队列
 	ws.AddClient(c)
-	type Message struct {
-		Type string `json:"type"`
-		Body string `json:"body"`
+	if since != 0 {
+		c.requestResume(since)
 	}
 	// 启动读写协程，监听该连接的读写
-	go c.startReading(ws.ctx, ws.pongTimeout)
-	go c.startWriting(ws.ctx, ws.pingPeriod)
+	go c.startReading(ws.ctx, ws.pongTimeout, ws.readLimit, func(data []byte, first bool) *Frame {
+		return ws.handleCommand(c, data, first)
+	})
+	go c.startWriting(ws.ctx, ws.pingPeriod, func(state *replayState, since uint, send func([]*model.MessageExternal) error) error {
+		if since == 0 {
+			since = ws.ackedSince(userID, token)
+		}
+		return ws.resume(state, userID, token, since, send)
+	})
 }
 
-func NewWebSocketStream(ctx context.Context, pingPeriod, pongTimeout time.Duration,
-	allowedWebSocketOrigins []string) *WebSocketStream {
+// NewWebSocketStream 创建推送连接的注册表，配置在加载时已校验，这里的检查只防止错误的调用
+func NewWebSocketStream(ctx context.Context, pingPeriod, pongTimeout time.Duration, readLimit int64,
+	allowedWebSocketOrigins []string, queue QueueConfig, replay ReplayFunc) *WebSocketStream {
+	if !queue.Policy.valid() {
+		panic("unknown overflow policy " + string(queue.Policy))
+	}
+	if queue.Size < 1 {
+		panic("the send queue size must be positive")
+	}
+	if readLimit < 1 {
+		panic("the read limit must be positive")
+	}
 	return &WebSocketStream{
 		clients:     make(map[uint][]*Client),
 		pingPeriod:  pingPeriod,
 		pongTimeout: pongTimeout,
+		readLimit:   readLimit,
 		upgrader:    newWebSocketUpgrader(allowedWebSocketOrigins),
 		ctx:         ctx,
+		queue:       queue,
+		replay:      replay,
+		acked:       make(map[ackKey]uint),
 	}
 }
 
+// SetMarkRead 设置处理客户端 read 命令的函数
+func (ws *WebSocketStream) SetMarkRead(markRead MarkReadFunc) {
+	ws.markRead = markRead
+}
+
+// DroppedMessages 返回因发送队列已满而被丢弃的消息总数
+func (ws *WebSocketStream) DroppedMessages() uint64 {
+	return ws.dropped.Load()
+}
+
 func (ws *WebSocketStream) AddClient(client *Client) {
 	ws.lock.Lock()
 	defer ws.lock.Unlock()
@@ -112,34 +171,94 @@ func (a *WebSocketStream) CollectConnectedClientTokens() []string {
 }
 
 func (ws *WebSocketStream) RemoveClient(uid uint) {
+	ws.lock.Lock()
+	clients := ws.clients[uid]
+	delete(ws.clients, uid)
+	for key := range ws.acked {
+		if key.userID == uid {
+			delete(ws.acked, key)
+		}
+	}
+	ws.lock.Unlock()
+	// 在锁外关闭连接，避免与连接自身的关闭回调（需要获取锁）互相等待
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+// removeConnection 在连接断开时调用，只移除该连接，不影响同一用户的其他设备，
+// 并记录该连接确认收到的最大消息ID，供同一令牌重连时补发
+func (ws *WebSocketStream) removeConnection(client *Client) {
 	ws.lock.Lock()
 	defer ws.lock.Unlock()
-	if clients, ok := ws.clients[uid]; ok {
-		for i, c := range clients {
-			c.Close()
-			clients[i] = nil
+	clients := ws.clients[client.userID]
+	for i, c := range clients {
+		if c == client {
+			clients = append(clients[:i], clients[i+1:]...)
+			ws.saveAcked(client)
+			break
 		}
-		delete(ws.clients, uid)
+	}
+	if len(clients) == 0 {
+		delete(ws.clients, client.userID)
+	} else {
+		ws.clients[client.userID] = clients
 	}
 }
 
 func (ws *WebSocketStream) RemoveClientByToken(userID uint, tokens ...string) {
 	ws.lock.Lock()
-	defer ws.lock.Unlock()
+	for _, token := range tokens {
+		delete(ws.acked, ackKey{userID: userID, token: token})
+	}
+	var removed []*Client
 	if clients, ok := ws.clients[userID]; ok {
-		for i, c := range clients {
-			for _, token := range tokens {
-				if c.token == token {
-					c.Close()
-					clients[i] = nil
-					clients = append(clients[:i], clients[i+1:]...)
-				}
+		remaining := clients[:0]
+		for _, c := range clients {
+			if containsToken(tokens, c.token) {
+				removed = append(removed, c)
+			} else {
+				remaining = append(remaining, c)
 			}
 		}
-		ws.clients[userID] = clients
+		if len(remaining) == 0 {
+			delete(ws.clients, userID)
+		} else {
+			ws.clients[userID] = remaining
+		}
+	}
+	ws.lock.Unlock()
+	// 在锁外关闭连接，避免与连接自身的关闭回调（需要获取锁）互相等待
+	for _, c := range removed {
+		c.Close()
 	}
 }
 
+// saveAcked 保存连接确认收到的最大消息ID；调用方需持有写锁
+func (ws *WebSocketStream) saveAcked(client *Client) {
+	acked := uint(client.acked.Load())
+	key := ackKey{userID: client.userID, token: client.token}
+	if acked > ws.acked[key] {
+		ws.acked[key] = acked
+	}
+}
+
+// ackedSince 返回该令牌之前的连接确认收到的最大消息ID，没有记录时返回 0
+func (ws *WebSocketStream) ackedSince(userID uint, token string) uint {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+	return ws.acked[ackKey{userID: userID, token: token}]
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
 // 把允许的origin字符串编译成正则表达式
 func compileAllowedWebSocketOrigins(allowedOrigins []string) []*regexp.Regexp {
 	var origins []*regexp.Regexp
@@ -162,35 +281,111 @@ func newWebSocketUpgrader(allowedOrigins []string) websocket.Upgrader {
 
 func (ws *WebSocketStream) BroadcastMessage(userIDs []uint, message *model.MessageExternal) {
 	ws.lock.RLock()
-	defer ws.lock.RUnlock()
+	var overflowed []*Client
 	for _, uid := range userIDs {
-		if clients, ok := ws.clients[uid]; ok {
-			for _, c := range clients {
-				c.write <- message
-			}
+		overflowed = append(overflowed, ws.enqueue(ws.clients[uid], message)...)
+	}
+	ws.lock.RUnlock()
+	ws.disconnect(overflowed)
+}
+
+// enqueue 把消息放入连接的发送队列，返回按照溢出策略需要断开的连接；调用方需持有读锁
+func (ws *WebSocketStream) enqueue(clients []*Client, message *model.MessageExternal) []*Client {
+	return ws.enqueueWith(clients, func(c *Client) (bool, bool) {
+		return c.send(message)
+	})
+}
+
+func (ws *WebSocketStream) enqueueWith(clients []*Client, send func(c *Client) (dropped, disconnect bool)) []*Client {
+	var overflowed []*Client
+	for _, c := range clients {
+		dropped, disconnect := send(c)
+		if dropped {
+			total := ws.dropped.Add(1)
+			log.Printf("WebSocket send queue of user %d is full, dropped a message (%d dropped in total)", c.userID, total)
+		}
+		if disconnect {
+			overflowed = append(overflowed, c)
 		}
 	}
+	return overflowed
+}
+
+// disconnect 断开消费过慢的连接，必须在锁外调用
+func (ws *WebSocketStream) disconnect(clients []*Client) {
+	for _, c := range clients {
+		c.NotifyClose()
+	}
 }
 
 func (ws *WebSocketStream) Close() {
 	ws.lock.Lock()
-	defer ws.lock.Unlock()
-	for uid, clients := range ws.clients {
-		for _, c := range clients {
+	clients := ws.clients
+	ws.clients = make(map[uint][]*Client) // 清空map,交给GC
+	ws.lock.Unlock()
+	for _, cs := range clients {
+		for _, c := range cs {
 			c.Close()
-			c = nil
 		}
-		delete(ws.clients, uid)
 	}
-	ws.clients = make(map[uint][]*Client) // 清空map,交给GC
 }
 
 func (ws *WebSocketStream) SendMessage(userID uint, message *model.MessageExternal) {
 	ws.lock.RLock()
-	defer ws.lock.RUnlock()
-	if clients, ok := ws.clients[userID]; ok {
-		for _, c := range clients {
-			c.write <- message
+	overflowed := ws.enqueue(ws.clients[userID], message)
+	ws.lock.RUnlock()
+	ws.disconnect(overflowed)
+}
+
+// Notify 实现 service.Notifier，把消息推送给该用户的所有连接
+func (ws *WebSocketStream) Notify(userID uint, message *model.MessageExternal) {
+	ws.SendMessage(userID, message)
+}
+
+// NotifyClient 实现 service.ClientNotifier，只把消息推送给使用该客户端令牌的连接
+func (ws *WebSocketStream) NotifyClient(userID uint, token string, message *model.MessageExternal) {
+	ws.lock.RLock()
+	var clients []*Client
+	for _, c := range ws.clients[userID] {
+		if c.token == token {
+			clients = append(clients, c)
 		}
 	}
+	overflowed := ws.enqueue(clients, message)
+	ws.lock.RUnlock()
+	ws.disconnect(overflowed)
+}
+
+// BroadcastNotify 实现 service.Notifier，把系统消息推送给所有在线用户
+func (ws *WebSocketStream) BroadcastNotify(message *model.MessageExternal) {
+	ws.BroadcastMessage(ws.connectedUserIDs(), message)
+}
+
+// NotifyDeleted 实现 service.DeletionNotifier，通知该用户的所有连接这些消息已被删除
+func (ws *WebSocketStream) NotifyDeleted(userID uint, messageIDs []uint) {
+	ws.sendEvent(userID, &Event{Type: EventDeleted, IDs: messageIDs})
+}
+
+// NotifyUpdated 实现 service.UpdateNotifier，通知该用户的所有连接用新的内容替换该消息
+func (ws *WebSocketStream) NotifyUpdated(userID uint, message *model.MessageExternal) {
+	ws.sendEvent(userID, &Event{Type: EventUpdated, Message: message})
+}
+
+func (ws *WebSocketStream) sendEvent(userID uint, event *Event) {
+	ws.lock.RLock()
+	overflowed := ws.enqueueWith(ws.clients[userID], func(c *Client) (bool, bool) {
+		return c.sendEvent(event)
+	})
+	ws.lock.RUnlock()
+	ws.disconnect(overflowed)
+}
+
+func (ws *WebSocketStream) connectedUserIDs() []uint {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+	userIDs := make([]uint, 0, len(ws.clients))
+	for uid := range ws.clients {
+		userIDs = append(userIDs, uid)
+	}
+	return userIDs
 }
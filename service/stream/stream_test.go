@@ -0,0 +1,171 @@
+package websockettools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/auth"
+	"go-notify/model"
+)
+
+// newTestStreamServer 启动使用 GinHandler 的测试服务，查询参数 user 和 token 代替认证中间件
+func newTestStreamServer(t *testing.T) (*WebSocketStream, *httptest.Server) {
+	return newTestStreamServerWithReplay(t, nil)
+}
+
+// newTestStreamServerWithReplay 同 newTestStreamServer，另外在 /stream/sse 提供 SSE，replay 用于补发
+func newTestStreamServerWithReplay(t *testing.T, replay ReplayFunc) (*WebSocketStream, *httptest.Server) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	ws := NewWebSocketStream(ctx, time.Minute, time.Minute, 4096, nil, QueueConfig{Size: 8, Policy: DropOldest}, replay)
+	authenticate := func(ctx *gin.Context) {
+		userID, _ := strconv.Atoi(ctx.Query("user"))
+		auth.RegisterAuthentication(ctx, nil, uint(userID), ctx.Query("token"))
+	}
+	engine := gin.New()
+	engine.GET("/stream", authenticate, ws.GinHandler)
+	engine.GET("/stream/sse", authenticate, ws.SSEHandler)
+	server := httptest.NewServer(engine)
+	t.Cleanup(func() {
+		ws.Close()
+		cancel()
+		server.Close()
+	})
+	return ws, server
+}
+
+func dialStream(t *testing.T, server *httptest.Server, userID uint, token string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/stream?user=" + strconv.Itoa(int(userID)) + "&token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connectedTokens 返回每个用户已注册的连接令牌
+func connectedTokens(ws *WebSocketStream) map[uint][]string {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+	tokens := make(map[uint][]string)
+	for userID, clients := range ws.clients {
+		for _, c := range clients {
+			tokens[userID] = append(tokens[userID], c.token)
+		}
+	}
+	return tokens
+}
+
+// assertClosed 检查服务端已关闭该连接
+func assertClosed(t *testing.T, conn *websocket.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			assert.False(t, isTimeout(err), "the connection was not closed")
+			return
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(interface{ Timeout() bool })
+	return ok && netErr.Timeout()
+}
+
+func TestRemoveClientByToken_disconnectsOnlyTheRevokedToken(t *testing.T) {
+	ws, server := newTestStreamServer(t)
+	revoked := dialStream(t, server, 1, "Crevoked")
+	dialStream(t, server, 1, "Ckept")
+	dialStream(t, server, 2, "Crevoked")
+	require.Eventually(t, func() bool {
+		return len(connectedTokens(ws)[1]) == 2 && len(connectedTokens(ws)[2]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ws.RemoveClientByToken(1, "Crevoked")
+	assertClosed(t, revoked)
+	assert.Equal(t, map[uint][]string{1: {"Ckept"}, 2: {"Crevoked"}}, connectedTokens(ws),
+		"the same token of another user and other devices stay connected")
+}
+
+func TestGinHandler_registersConnectionUnderUser(t *testing.T) {
+	ws, server := newTestStreamServer(t)
+
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/stream", nil)
+	auth.RegisterAuthentication(ctx, nil, 1, "")
+	ws.GinHandler(ctx)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code, "basic auth without a client token is rejected")
+
+	phone := dialStream(t, server, 1, "Cphone")
+	laptop := dialStream(t, server, 1, "Claptop")
+	dialStream(t, server, 2, "Cother")
+	require.Eventually(t, func() bool {
+		tokens := connectedTokens(ws)
+		return len(tokens[1]) == 2 && len(tokens[2]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"Cphone", "Claptop"}, connectedTokens(ws)[1])
+	assert.ElementsMatch(t, []string{"Cphone", "Claptop", "Cother"}, ws.CollectConnectedClientTokens())
+
+	require.NoError(t, phone.Close())
+	require.Eventually(t, func() bool {
+		return len(connectedTokens(ws)[1]) == 1
+	}, 5*time.Second, 10*time.Millisecond, "the closed connection is removed")
+	assert.Equal(t, []string{"Claptop"}, connectedTokens(ws)[1])
+
+	require.NoError(t, laptop.Close())
+	require.Eventually(t, func() bool {
+		_, ok := connectedTokens(ws)[1]
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond, "users without connections are removed")
+	assert.Equal(t, []string{"Cother"}, connectedTokens(ws)[2])
+}
+
+func TestNotifier_fansOutToConnectedUsers(t *testing.T) {
+	ws := NewWebSocketStream(context.Background(), time.Minute, time.Minute, 4096, nil, QueueConfig{Size: 8, Policy: DropOldest}, nil)
+	phone := newClient(nil, 1, "Cphone", ws.queue, nil)
+	laptop := newClient(nil, 1, "Claptop", ws.queue, nil)
+	other := newClient(nil, 2, "Cother", ws.queue, nil)
+	for _, c := range []*Client{phone, laptop, other} {
+		ws.AddClient(c)
+	}
+
+	ws.Notify(1, &model.MessageExternal{ID: 1})
+	assert.Equal(t, []uint{1}, queuedMessageIDs(phone.queue.drain()))
+	assert.Equal(t, []uint{1}, queuedMessageIDs(laptop.queue.drain()), "every device of the user is notified")
+	assert.Empty(t, other.queue.drain())
+
+	ws.BroadcastNotify(&model.MessageExternal{ID: 2})
+	for _, c := range []*Client{phone, laptop, other} {
+		assert.Equal(t, []uint{2}, queuedMessageIDs(c.queue.drain()), "broadcasts reach every connected user")
+	}
+}
+
+func TestNotifier_fansOutReplacementsToEveryDevice(t *testing.T) {
+	ws := NewWebSocketStream(context.Background(), time.Minute, time.Minute, 4096, nil, QueueConfig{Size: 8, Policy: DropOldest}, nil)
+	phone := newClient(nil, 1, "Cphone", ws.queue, nil)
+	laptop := newClient(nil, 1, "Claptop", ws.queue, nil)
+	other := newClient(nil, 2, "Cother", ws.queue, nil)
+	for _, c := range []*Client{phone, laptop, other} {
+		ws.AddClient(c)
+	}
+
+	replacement := &model.MessageExternal{ID: 9, Message: "build passed"}
+	ws.NotifyDeleted(1, []uint{4})
+	ws.NotifyUpdated(1, replacement)
+	for _, c := range []*Client{phone, laptop} {
+		items := c.queue.drain()
+		require.Len(t, items, 2)
+		assert.Equal(t, &Event{Type: EventDeleted, IDs: []uint{4}}, items[0].event)
+		assert.Equal(t, &Event{Type: EventUpdated, Message: replacement}, items[1].event)
+	}
+	assert.Empty(t, other.queue.drain())
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go-notify/auth"
+	"go-notify/model"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// unifiedPushExtrasKey 消息 extras 中保存推送内容的键，值包含注册的 token 和 base64 编码的原始内容
+	unifiedPushExtrasKey = "unifiedpush::message"
+	// maxUnifiedPushBody 推送内容的最大字节数，与 Web Push 的限制相同
+	maxUnifiedPushBody = 4096
+	// unifiedPushMaxMessages 注册创建的应用保留的消息数量，消息只用于转发给客户端和重连补发
+	unifiedPushMaxMessages = 100
+)
+
+type UnifiedPushDatabaseService interface {
+	GetClientByID(id uint) (*model.Client, error)
+	GetClientByToken(token string) (*model.Client, error)
+	GetApplicationByID(id uint) (*model.Application, error)
+	GetApplicationByToken(token string) (*model.Application, error)
+	CreateMessage(message *model.Message) error
+	CreateUnifiedPushRegistration(registration *model.UnifiedPushRegistration, application *model.Application) error
+	GetUnifiedPushRegistrationByID(id uint) (*model.UnifiedPushRegistration, error)
+	GetUnifiedPushRegistrationByToken(clientID uint, token string) (*model.UnifiedPushRegistration, error)
+	GetUnifiedPushRegistrationByApplication(appID uint) (*model.UnifiedPushRegistration, error)
+	GetUnifiedPushRegistrationsByUser(userID uint) ([]*model.UnifiedPushRegistration, error)
+	DeleteUnifiedPushRegistrationByID(id uint) error
+}
+
+// UnifiedPushService 实现 UnifiedPush 的推送服务端：客户端（分发器）为每个注册获得一个独立应用的推送地址，
+// 应用服务器向该地址 POST 的内容保存为消息，只推送给注册的客户端
+type UnifiedPushService struct {
+	DB       UnifiedPushDatabaseService
+	Notifier ClientNotifier
+}
+
+// 应用服务器用 GET 请求推送地址判断服务器是否支持 UnifiedPush
+func (s *UnifiedPushService) Discover(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"unifiedpush": gin.H{"version": 1}})
+}
+
+// 接收应用服务器推送的内容，原始内容以 base64 编码保存在 extras 中，是合法的 UTF-8 文本时同时作为消息内容。
+// 请求头 Urgency 决定消息的优先级，TTL 决定消息的过期时间
+func (s *UnifiedPushService) Push(ctx *gin.Context) {
+	application, err := s.DB.GetApplicationByToken(auth.GetTokenID(ctx))
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	registration, err := s.DB.GetUnifiedPushRegistrationByApplication(application.ID)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if registration == nil {
+		ctx.AbortWithError(http.StatusNotFound, errors.New("the application is not a UnifiedPush registration"))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxUnifiedPushBody+1))
+	if success := successOrAbort(ctx, http.StatusBadRequest, err); !success {
+		return
+	}
+	if len(body) > maxUnifiedPushBody {
+		ctx.AbortWithError(http.StatusRequestEntityTooLarge, fmt.Errorf("the body must not be larger than %d bytes", maxUnifiedPushBody))
+		return
+	}
+	priority, err := urgencyPriority(ctx.GetHeader("Urgency"), application.DefaultPriority)
+	if success := successOrAbort(ctx, http.StatusBadRequest, err); !success {
+		return
+	}
+	message := &model.MessageExternal{
+		ApplicationID: application.ID,
+		Title:         application.Name,
+		Priority:      priority,
+		Date:          timeNow(),
+		Extras: map[string]interface{}{
+			unifiedPushExtrasKey: map[string]interface{}{
+				"token": registration.Token,
+				"body":  base64.StdEncoding.EncodeToString(body),
+			},
+		},
+	}
+	if utf8.Valid(body) {
+		message.Message = string(body)
+	}
+	if ttl := ctx.GetHeader("TTL"); ttl != "" {
+		seconds, err := strconv.Atoi(ttl)
+		if err != nil || seconds < 0 {
+			ctx.AbortWithError(http.StatusBadRequest, errors.New("the TTL header must be a non-negative number of seconds"))
+			return
+		}
+		message.TTL = seconds
+	}
+	message.ExpiresAt, err = resolveExpiry(message, application, message.Date)
+	if success := successOrAbort(ctx, http.StatusBadRequest, err); !success {
+		return
+	}
+	msgInternal := toInternalMessage(message)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, s.DB.CreateMessage(msgInternal)); !success {
+		return
+	}
+	message = toExternalMessage(msgInternal)
+	client, err := s.DB.GetClientByID(registration.ClientID)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if client != nil {
+		s.Notifier.NotifyClient(registration.UserID, client.Token, message)
+	}
+	ctx.JSON(http.StatusCreated, message)
+}
+
+// urgencyPriority 把 RFC 8030 的 Urgency 请求头转换为消息优先级，与 Web Push 的转换相反
+func urgencyPriority(urgency string, defaultPriority int) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(urgency)) {
+	case "":
+		return defaultPriority, nil
+	case "very-low":
+		return 0, nil
+	case "low":
+		return 2, nil
+	case "normal":
+		return 5, nil
+	case "high":
+		return 8, nil
+	}
+	return 0, fmt.Errorf("unknown urgency %q", urgency)
+}
+
+// 获取当前用户的所有 UnifiedPush 注册
+func (s *UnifiedPushService) GetRegistrations(ctx *gin.Context) {
+	registrations, err := s.DB.GetUnifiedPushRegistrationsByUser(auth.GetUserID(ctx))
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if registrations == nil {
+		registrations = []*model.UnifiedPushRegistration{}
+	}
+	for _, registration := range registrations {
+		if !s.withEndpoint(ctx, registration) {
+			return
+		}
+	}
+	ctx.JSON(http.StatusOK, registrations)
+}
+
+// 为当前客户端注册应用，创建独立的应用并返回推送地址；同一客户端重复注册相同的 token 时返回已有的注册。
+// 需要使用客户端令牌认证，消息只推送给该客户端
+func (s *UnifiedPushService) Register(ctx *gin.Context) {
+	var client *model.Client
+	// 使用用户名密码认证时没有令牌
+	if token := auth.GetTokenID(ctx); token != "" {
+		var err error
+		client, err = s.DB.GetClientByToken(token)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+	}
+	if client == nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("UnifiedPush registrations require a client token"))
+		return
+	}
+	registration := &model.UnifiedPushRegistration{}
+	if err := ctx.Bind(registration); err != nil {
+		return
+	}
+	existing, err := s.DB.GetUnifiedPushRegistrationByToken(client.ID, registration.Token)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if existing == nil {
+		registration.ID = 0
+		registration.ClientID = client.ID
+		registration.UserID = client.UserID
+		registration.CreatedAt = timeNow()
+		application := &model.Application{
+			Name:        registration.Name,
+			Description: "UnifiedPush registration on " + client.Name,
+			Token:       auth.GenerateNotExistingToken(auth.GenerateApplicationToken, s.applicationExists),
+			MaxMessages: unifiedPushMaxMessages,
+		}
+		err := s.DB.CreateUnifiedPushRegistration(registration, application)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		existing = registration
+	}
+	if s.withEndpoint(ctx, existing) {
+		ctx.JSON(http.StatusOK, existing)
+	}
+}
+
+// 删除注册，注册创建的应用和消息也会被删除
+func (s *UnifiedPushService) Unregister(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		registration, err := s.DB.GetUnifiedPushRegistrationByID(id)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		if registration == nil || registration.UserID != auth.GetUserID(ctx) {
+			ctx.AbortWithError(http.StatusNotFound, fmt.Errorf("UnifiedPush registration with id %d doesn't exists", id))
+			return
+		}
+		successOrAbort(ctx, http.StatusInternalServerError, s.DB.DeleteUnifiedPushRegistrationByID(id))
+	})
+}
+
+// withEndpoint 填充注册的推送地址，地址中包含注册所属应用的令牌
+func (s *UnifiedPushService) withEndpoint(ctx *gin.Context, registration *model.UnifiedPushRegistration) bool {
+	application, err := s.DB.GetApplicationByID(registration.ApplicationID)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return false
+	}
+	if application == nil {
+		ctx.AbortWithError(http.StatusInternalServerError, fmt.Errorf("the application of UnifiedPush registration %d doesn't exist", registration.ID))
+		return false
+	}
+	endpoint := &url.URL{Path: "/UP", RawQuery: url.Values{"token": {application.Token}}.Encode()}
+	if location := Get(ctx); location != nil {
+		endpoint.Scheme = location.Scheme
+		endpoint.Host = location.Host
+	}
+	registration.Endpoint = endpoint.String()
+	return true
+}
+
+func (s *UnifiedPushService) applicationExists(token string) bool {
+	app, _ := s.DB.GetApplicationByToken(token)
+	return app != nil
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/auth"
+	"go-notify/model"
+)
+
+type clientNotification struct {
+	userID  uint
+	token   string
+	message *model.MessageExternal
+}
+
+type recordingClientNotifier struct {
+	notifications []clientNotification
+}
+
+func (r *recordingClientNotifier) NotifyClient(userID uint, token string, message *model.MessageExternal) {
+	r.notifications = append(r.notifications, clientNotification{userID: userID, token: token, message: message})
+}
+
+func performUnifiedPushRequest(handler gin.HandlerFunc, method, body string, userID uint, token string, prepare func(ctx *gin.Context)) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(method, "/", strings.NewReader(body))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	auth.RegisterAuthentication(ctx, nil, userID, token)
+	if prepare != nil {
+		prepare(ctx)
+	}
+	handler(ctx)
+	return recorder
+}
+
+func TestUnifiedPushService_registerAndPush(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	phone := &model.Client{Token: "Cphone", UserID: 1, Name: "phone"}
+	require.NoError(t, db.CreateClient(phone))
+	notifier := &recordingClientNotifier{}
+	service := &UnifiedPushService{DB: db, Notifier: notifier}
+
+	recorder := performUnifiedPushRequest(service.Register, http.MethodPost, `{"token":"inst-1","name":"org.example.chat"}`, 1, "", nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code, "a client token is required")
+
+	recorder = performUnifiedPushRequest(service.Register, http.MethodPost, `{"token":"inst-1","name":"org.example.chat"}`, 1, "Cphone", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var registration model.UnifiedPushRegistration
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &registration))
+	assert.Equal(t, phone.ID, registration.ClientID)
+	application, err := db.GetApplicationByID(registration.ApplicationID)
+	require.NoError(t, err)
+	assert.Equal(t, "org.example.chat", application.Name)
+	assert.Equal(t, unifiedPushMaxMessages, application.MaxMessages)
+	endpoint, err := url.Parse(registration.Endpoint)
+	require.NoError(t, err)
+	assert.Equal(t, "/UP", endpoint.Path)
+	assert.Equal(t, application.Token, endpoint.Query().Get("token"))
+	apps, err := db.GetApplicationsByUser(1)
+	require.NoError(t, err)
+	assert.Len(t, apps, 1, "the application belongs to the user")
+
+	// 连接器重新注册时返回已有的注册
+	recorder = performUnifiedPushRequest(service.Register, http.MethodPost, `{"token":"inst-1","name":"org.example.chat"}`, 1, "Cphone", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var again model.UnifiedPushRegistration
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &again))
+	assert.Equal(t, registration.ID, again.ID)
+	assert.Equal(t, registration.Endpoint, again.Endpoint)
+
+	recorder = performUnifiedPushRequest(service.Push, http.MethodPost, "hello", 1, application.Token, func(ctx *gin.Context) {
+		ctx.Request.Header.Set("Urgency", "high")
+		ctx.Request.Header.Set("TTL", "60")
+	})
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.Len(t, notifier.notifications, 1)
+	pushed := notifier.notifications[0]
+	assert.Equal(t, uint(1), pushed.userID)
+	assert.Equal(t, "Cphone", pushed.token)
+	assert.Equal(t, "hello", pushed.message.Message)
+	assert.Equal(t, 8, pushed.message.Priority)
+	require.NotNil(t, pushed.message.ExpiresAt)
+	assert.Equal(t, pushed.message.Date.Add(time.Minute), *pushed.message.ExpiresAt)
+	extras := pushed.message.Extras[unifiedPushExtrasKey].(map[string]interface{})
+	assert.Equal(t, "inst-1", extras["token"])
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("hello")), extras["body"])
+	stored, err := db.GetMessageByID(pushed.message.ID)
+	require.NoError(t, err)
+	assert.Equal(t, application.ID, stored.ApplicationID)
+
+	binary := string([]byte{0xff, 0x00, 0xfe})
+	recorder = performUnifiedPushRequest(service.Push, http.MethodPost, binary, 1, application.Token, nil)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.Len(t, notifier.notifications, 2)
+	assert.Empty(t, notifier.notifications[1].message.Message, "binary bodies are only stored in the extras")
+	extras = notifier.notifications[1].message.Extras[unifiedPushExtrasKey].(map[string]interface{})
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(binary)), extras["body"])
+
+	recorder = performUnifiedPushRequest(service.Push, http.MethodPost, strings.Repeat("x", maxUnifiedPushBody+1), 1, application.Token, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	recorder = performUnifiedPushRequest(service.Push, http.MethodPost, "x", 1, application.Token, func(ctx *gin.Context) {
+		ctx.Request.Header.Set("Urgency", "soon")
+	})
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Len(t, notifier.notifications, 2)
+}
+
+func TestUnifiedPushService_pushRequiresRegistration(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	application := &model.Application{Name: "plain", Token: "Aplain"}
+	require.NoError(t, db.CreateApplicationForUser(application, 1))
+	notifier := &recordingClientNotifier{}
+	service := &UnifiedPushService{DB: db, Notifier: notifier}
+
+	recorder := performUnifiedPushRequest(service.Push, http.MethodPost, "hello", 1, "Aplain", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Empty(t, notifier.notifications)
+}
+
+func TestUnifiedPushService_unregister(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	phone := &model.Client{Token: "Cphone", UserID: 1, Name: "phone"}
+	require.NoError(t, db.CreateClient(phone))
+	service := &UnifiedPushService{DB: db, Notifier: &recordingClientNotifier{}}
+
+	register := func(token string) *model.UnifiedPushRegistration {
+		recorder := performUnifiedPushRequest(service.Register, http.MethodPost, `{"token":"`+token+`","name":"app"}`, 1, "Cphone", nil)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		registration := new(model.UnifiedPushRegistration)
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), registration))
+		return registration
+	}
+	first := register("inst-1")
+	second := register("inst-2")
+
+	recorder := performUnifiedPushRequest(service.Unregister, http.MethodDelete, "", 2, "", func(ctx *gin.Context) {
+		ctx.Params = gin.Params{{Key: "id", Value: "1"}}
+	})
+	assert.Equal(t, http.StatusNotFound, recorder.Code, "registrations of other users are not visible")
+
+	recorder = performUnifiedPushRequest(service.Unregister, http.MethodDelete, "", 1, "", func(ctx *gin.Context) {
+		ctx.Params = gin.Params{{Key: "id", Value: "1"}}
+	})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	app, err := db.GetApplicationByID(first.ApplicationID)
+	require.NoError(t, err)
+	assert.Nil(t, app, "the application of the registration is deleted")
+
+	// 删除客户端时一并删除它的注册
+	require.NoError(t, db.DeleteClientByID(phone.ID))
+	registration, err := db.GetUnifiedPushRegistrationByID(second.ID)
+	require.NoError(t, err)
+	assert.Nil(t, registration)
+	app, err = db.GetApplicationByID(second.ApplicationID)
+	require.NoError(t, err)
+	assert.Nil(t, app)
+}
+
+func TestUnifiedPushService_messagesOnlyForTheRegisteredClient(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	for _, token := range []string{"Cphone", "Claptop"} {
+		require.NoError(t, db.CreateClient(&model.Client{Token: token, UserID: 1, Name: token}))
+	}
+	service := &UnifiedPushService{DB: db, Notifier: &recordingClientNotifier{}}
+	messages := &MessageService{DB: db}
+
+	recorder := performUnifiedPushRequest(service.GetRegistrations, http.MethodGet, "", 1, "Cphone", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, "[]", recorder.Body.String())
+
+	recorder = performUnifiedPushRequest(service.Register, http.MethodPost, `{"token":"inst-1","name":"org.example.chat"}`, 1, "Cphone", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var registration model.UnifiedPushRegistration
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &registration))
+	application, err := db.GetApplicationByID(registration.ApplicationID)
+	require.NoError(t, err)
+	recorder = performUnifiedPushRequest(service.Push, http.MethodPost, "private", 1, application.Token, nil)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	plain := &model.Application{Name: "backup", Token: "Abackup"}
+	require.NoError(t, db.CreateApplicationForUser(plain, 1))
+	require.NoError(t, db.CreateMessage(&model.Message{ApplicationID: plain.ID, Message: "backup done"}))
+
+	listed := func(token string) []string {
+		recorder := performUnifiedPushRequest(messages.GetMessages, http.MethodGet, "", 1, token, nil)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var paged model.PagedMessages
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &paged))
+		var texts []string
+		for _, m := range paged.Messages {
+			texts = append(texts, m.Message)
+		}
+		return texts
+	}
+	assert.Equal(t, []string{"backup done", "private"}, listed("Cphone"))
+	assert.Equal(t, []string{"backup done"}, listed("Claptop"), "other clients do not see the pushes of the registration")
+	assert.Equal(t, []string{"backup done"}, listed(""))
+
+	replayed, err := messages.MessagesSince(1, "Claptop", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, replayed, 1)
+	assert.Equal(t, "backup done", replayed[0].Message)
+	replayed, err = messages.MessagesSince(1, "Cphone", 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, replayed, 2)
+}
+
+func TestUnifiedPushService_applicationMessagesAndUnreadCountsOnlyForTheRegisteredClient(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	for _, token := range []string{"Cphone", "Claptop"} {
+		require.NoError(t, db.CreateClient(&model.Client{Token: token, UserID: 1, Name: token}))
+	}
+	service := &UnifiedPushService{DB: db, Notifier: &recordingClientNotifier{}}
+	messages := &MessageService{DB: db}
+
+	recorder := performUnifiedPushRequest(service.Register, http.MethodPost, `{"token":"inst-1","name":"org.example.chat"}`, 1, "Cphone", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var registration model.UnifiedPushRegistration
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &registration))
+	application, err := db.GetApplicationByID(registration.ApplicationID)
+	require.NoError(t, err)
+	recorder = performUnifiedPushRequest(service.Push, http.MethodPost, "private", 1, application.Token, nil)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+
+	listed := func(token string) int {
+		recorder := performRequest(messages.GetMessageWithApplication, http.MethodGet, "", 1, token, idParam(application.ID))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var paged model.PagedMessages
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &paged))
+		return len(paged.Messages)
+	}
+	assert.Equal(t, 1, listed("Cphone"))
+	assert.Equal(t, 0, listed("Claptop"))
+	assert.Equal(t, 0, listed(""))
+
+	unread := func(token string) int {
+		recorder := performRequest(messages.GetUnreadCount, http.MethodGet, "", 1, token, nil)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var counts model.UnreadCount
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &counts))
+		return counts.Total
+	}
+	assert.Equal(t, 1, unread("Cphone"))
+	assert.Equal(t, 0, unread("Claptop"))
+	assert.Equal(t, 0, unread(""))
+}
+
+func TestUnifiedPushService_applicationIsManaged(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	require.NoError(t, db.CreateClient(&model.Client{Token: "Cphone", UserID: 1, Name: "phone"}))
+	service := &UnifiedPushService{DB: db, Notifier: &recordingClientNotifier{}}
+	recorder := performUnifiedPushRequest(service.Register, http.MethodPost, `{"token":"inst-1","name":"org.example.chat"}`, 1, "Cphone", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var registration model.UnifiedPushRegistration
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &registration))
+	application, err := db.GetApplicationByID(registration.ApplicationID)
+	require.NoError(t, err)
+	plain := &model.Application{Name: "backup", Token: "Abackup"}
+	require.NoError(t, db.CreateApplicationForUser(plain, 1))
+
+	applications := &ApplicationService{DB: db}
+	recorder = performRequest(applications.GetApplications, http.MethodGet, "", 1, "", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var listed []*model.Application
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &listed))
+	require.Len(t, listed, 1, "the application of the registration is not listed")
+	assert.Equal(t, plain.ID, listed[0].ID)
+	for _, handler := range []gin.HandlerFunc{applications.UpdateApplication, applications.DeleteApplication, applications.RotateApplicationToken} {
+		recorder = performRequest(handler, http.MethodPut, `{"name":"renamed"}`, 1, "", idParam(application.ID))
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+	unchanged, err := db.GetApplicationByID(application.ID)
+	require.NoError(t, err)
+	assert.Equal(t, application.Token, unchanged.Token)
+	assert.Equal(t, "org.example.chat", unchanged.Name)
+
+	notifier := &recordingNotifier{}
+	messages := &MessageService{DB: db, Notifier: notifier}
+	recorder = performRequest(messages.CreateMessage, http.MethodPost, `{"message":"hello"}`, 0, application.Token, nil)
+	assert.Equal(t, http.StatusForbidden, recorder.Code, "the token can only push through the UnifiedPush endpoint")
+	recorder = performRequest(messages.CreateMessage, http.MethodPost, `{"message":"hello"}`, 0, plain.Token, nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, notifier.notifications, 1)
+}
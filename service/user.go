@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-notify/auth"
+	"go-notify/model"
+)
+
+type UserDatabaseService interface {
+	GetUsers() ([]*model.User, error)
+	GetUserByID(id uint) (*model.User, error)
+	GetUserByName(name string) (*model.User, error)
+	DeleteUserByID(id uint) error
+	UpdateUser(user *model.User) error
+	CreateUser(user *model.User) error
+	CountUser(condition ...interface{}) (int, error)
+}
+
+type UserService struct {
+	DB             UserDatabaseService
+	PasswordPolicy auth.PasswordPolicy
+	// NotifyDeleted 在用户被删除后调用，用于断开该用户的所有推送连接
+	NotifyDeleted func(userID uint)
+}
+
+var errLastAdmin = errors.New("cannot delete or demote the last admin")
+
+func toExternalUser(user *model.User) *model.UserExternal {
+	return &model.UserExternal{
+		ID:    user.ID,
+		Name:  user.Name,
+		Admin: user.Admin,
+	}
+}
+
+// 获取所有用户，仅管理员可用
+func (u *UserService) GetUsers(ctx *gin.Context) {
+	users, err := u.DB.GetUsers()
+	if success := successOrAbort(ctx, 500, err); !success {
+		return
+	}
+	resp := make([]*model.UserExternal, 0, len(users))
+	for _, user := range users {
+		resp = append(resp, toExternalUser(user))
+	}
+	ctx.JSON(200, resp)
+}
+
+// 获取当前登录的用户
+func (u *UserService) GetCurrentUser(ctx *gin.Context) {
+	user, err := u.DB.GetUserByID(auth.GetUserID(ctx))
+	if success := successOrAbort(ctx, 500, err); !success {
+		return
+	}
+	if user == nil {
+		ctx.AbortWithError(404, errors.New("user does not exist"))
+		return
+	}
+	ctx.JSON(200, toExternalUser(user))
+}
+
+// 创建用户，仅管理员可用
+func (u *UserService) CreateUser(ctx *gin.Context) {
+	user := model.CreateUserExternal{}
+	if err := ctx.Bind(&user); err == nil {
+		existing, err := u.DB.GetUserByName(user.Name)
+		if success := successOrAbort(ctx, 500, err); !success {
+			return
+		}
+		if existing != nil {
+			ctx.AbortWithError(400, errors.New("username already exists"))
+			return
+		}
+		if err := u.PasswordPolicy.Validate(user.Pass); err != nil {
+			ctx.AbortWithError(400, err)
+			return
+		}
+		internal := &model.User{
+			Name:  user.Name,
+			Admin: user.Admin,
+			Pass:  u.PasswordPolicy.Hash(user.Pass),
+		}
+		if success := successOrAbort(ctx, 500, u.DB.CreateUser(internal)); !success {
+			return
+		}
+		ctx.JSON(200, toExternalUser(internal))
+	}
+}
+
+// 按ID获取用户，仅管理员可用
+func (u *UserService) GetUserByID(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		user, ok := u.existingUser(ctx, id)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, toExternalUser(user))
+	})
+}
+
+// 修改当前用户的密码，需要提供当前密码，避免仅凭泄露的客户端令牌就能接管账户
+func (u *UserService) ChangePassword(ctx *gin.Context) {
+	pw := model.UserExternalPass{}
+	if err := ctx.Bind(&pw); err == nil {
+		user, ok := u.existingUser(ctx, auth.GetUserID(ctx))
+		if !ok {
+			return
+		}
+		if !auth.ComparePassword(user.Pass, []byte(pw.OldPass)) {
+			ctx.AbortWithError(400, errors.New("the current password is incorrect"))
+			return
+		}
+		if err := u.PasswordPolicy.Validate(pw.Pass); err != nil {
+			ctx.AbortWithError(400, err)
+			return
+		}
+		user.Pass = u.PasswordPolicy.Hash(pw.Pass)
+		successOrAbort(ctx, 500, u.DB.UpdateUser(user))
+	}
+}
+
+// 按ID删除用户并断开其推送连接，最后一个管理员不允许删除，仅管理员可用
+func (u *UserService) DeleteUserByID(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		user, ok := u.existingUser(ctx, id)
+		if !ok {
+			return
+		}
+		if user.Admin {
+			if isLast, ok := u.isLastAdmin(ctx); !ok {
+				return
+			} else if isLast {
+				ctx.AbortWithError(400, errLastAdmin)
+				return
+			}
+		}
+		if success := successOrAbort(ctx, 500, u.DB.DeleteUserByID(id)); !success {
+			return
+		}
+		if u.NotifyDeleted != nil {
+			u.NotifyDeleted(id)
+		}
+	})
+}
+
+// 按ID更新用户，密码为空时保留原密码，仅管理员可用
+func (u *UserService) UpdateUserByID(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		var user model.UpdateUserExternal
+		if err := ctx.Bind(&user); err == nil {
+			oldUser, ok := u.existingUser(ctx, id)
+			if !ok {
+				return
+			}
+			if other, err := u.DB.GetUserByName(user.Name); err != nil {
+				ctx.AbortWithError(500, err)
+				return
+			} else if other != nil && other.ID != id {
+				ctx.AbortWithError(400, errors.New("username already exists"))
+				return
+			}
+			if oldUser.Admin && !user.Admin {
+				if isLast, ok := u.isLastAdmin(ctx); !ok {
+					return
+				} else if isLast {
+					ctx.AbortWithError(400, errLastAdmin)
+					return
+				}
+			}
+			if user.Pass != "" {
+				if err := u.PasswordPolicy.Validate(user.Pass); err != nil {
+					ctx.AbortWithError(400, err)
+					return
+				}
+				oldUser.Pass = u.PasswordPolicy.Hash(user.Pass)
+			}
+			oldUser.Name = user.Name
+			oldUser.Admin = user.Admin
+			if success := successOrAbort(ctx, 500, u.DB.UpdateUser(oldUser)); !success {
+				return
+			}
+			ctx.JSON(200, toExternalUser(oldUser))
+		}
+	})
+}
+
+// isLastAdmin 判断系统中是否只剩一个管理员，查询失败时中止请求
+func (u *UserService) isLastAdmin(ctx *gin.Context) (isLast, ok bool) {
+	admins, err := u.DB.CountUser("admin = ?", true)
+	if success := successOrAbort(ctx, 500, err); !success {
+		return false, false
+	}
+	return admins <= 1, true
+}
+
+// existingUser 返回指定ID的用户，不存在时中止请求
+func (u *UserService) existingUser(ctx *gin.Context, id uint) (*model.User, bool) {
+	user, err := u.DB.GetUserByID(id)
+	if success := successOrAbort(ctx, 500, err); !success {
+		return nil, false
+	}
+	if user == nil {
+		ctx.AbortWithError(404, fmt.Errorf("user with id %d doesn't exists", id))
+		return nil, false
+	}
+	return user, true
+}
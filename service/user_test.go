@@ -0,0 +1,61 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/auth"
+)
+
+func newUserTestService(t *testing.T) (*UserService, *[]uint) {
+	var disconnected []uint
+	service := &UserService{
+		DB:             newWebhookTestDatabase(t),
+		PasswordPolicy: auth.PasswordPolicy{MinLength: 8, Strength: 4},
+		NotifyDeleted:  func(userID uint) { disconnected = append(disconnected, userID) },
+	}
+	return service, &disconnected
+}
+
+func TestUserService_lastAdminGuard(t *testing.T) {
+	service, disconnected := newUserTestService(t)
+
+	recorder := performRequest(service.DeleteUserByID, http.MethodDelete, "", 1, "", idParam(1))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = performRequest(service.UpdateUserByID, http.MethodPut, `{"name":"admin","admin":false}`, 1, "", idParam(1))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	admin, err := service.DB.GetUserByID(1)
+	require.NoError(t, err)
+	assert.True(t, admin.Admin, "the last admin is not demoted")
+
+	recorder = performRequest(service.CreateUser, http.MethodPost, `{"name":"second","pass":"long enough","admin":true}`, 1, "", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	recorder = performRequest(service.UpdateUserByID, http.MethodPut, `{"name":"admin","admin":false}`, 1, "", idParam(1))
+	assert.Equal(t, http.StatusOK, recorder.Code, "another admin is left")
+	recorder = performRequest(service.DeleteUserByID, http.MethodDelete, "", 1, "", idParam(2))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code, "the remaining admin is the last one")
+	recorder = performRequest(service.DeleteUserByID, http.MethodDelete, "", 2, "", idParam(1))
+	assert.Equal(t, http.StatusOK, recorder.Code, "deleting a normal user is always allowed")
+	assert.Equal(t, []uint{1}, *disconnected, "the streams of the deleted user are disconnected")
+}
+
+func TestUserService_changePassword(t *testing.T) {
+	service, _ := newUserTestService(t)
+	changePassword := func(body string) int {
+		return performRequest(service.ChangePassword, http.MethodPost, body, 1, "Cstolen", nil).Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, changePassword(`{"pass":"new password"}`), "the current password is required")
+	assert.Equal(t, http.StatusBadRequest, changePassword(`{"oldPass":"wrong","pass":"new password"}`))
+	assert.Equal(t, http.StatusBadRequest, changePassword(`{"oldPass":"admin","pass":"short"}`), "the policy applies")
+	user, err := service.DB.GetUserByID(1)
+	require.NoError(t, err)
+	assert.True(t, auth.ComparePassword(user.Pass, []byte("admin")), "the password is unchanged")
+
+	assert.Equal(t, http.StatusOK, changePassword(`{"oldPass":"admin","pass":"new password"}`))
+	user, err = service.DB.GetUserByID(1)
+	require.NoError(t, err)
+	assert.True(t, auth.ComparePassword(user.Pass, []byte("new password")))
+}
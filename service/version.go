@@ -0,0 +1,15 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-notify/model"
+)
+
+type VersionService struct {
+	Info *model.VersionInfo
+}
+
+// 返回当前程序的版本信息
+func (v *VersionService) Version(ctx *gin.Context) {
+	ctx.JSON(200, v.Info)
+}
@@ -0,0 +1,468 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-notify/auth"
+	"go-notify/model"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// signatureHeader 包含以 webhook 密钥计算的请求体 HMAC-SHA256，格式为 sha256=<hex>
+	signatureHeader = "X-Signature"
+	// deliveryIDHeader 标识一次投递，重试时保持不变，接收方可以据此去重
+	deliveryIDHeader = "X-Delivery-ID"
+	webhookIDHeader  = "X-Webhook-ID"
+	// maxWebhookWait 没有更早的重试时也定期检查，避免系统时间调整后错过投递
+	maxWebhookWait = time.Minute
+	// maxWebhookBackoff 两次重试之间最长的等待时间
+	maxWebhookBackoff = time.Hour
+	// webhookBatchSize 每次并发投递的最大数量
+	webhookBatchSize = 50
+	// maxWebhookResponse 读取并丢弃的响应内容的最大字节数，读完响应才能复用连接
+	maxWebhookResponse = 4096
+)
+
+type WebhookDatabaseService interface {
+	CreateWebhook(webhook *model.Webhook) error
+	GetWebhookByID(id uint) (*model.Webhook, error)
+	GetWebhooksByUser(userID uint) ([]*model.Webhook, error)
+	GetEnabledWebhooks(userID uint) ([]*model.Webhook, error)
+	UpdateWebhook(webhook *model.Webhook) error
+	DeleteWebhookByID(id uint) error
+	CreateWebhookDeliveries(deliveries []*model.WebhookDelivery) error
+	GetWebhookDeliveryByID(id uint) (*model.WebhookDelivery, error)
+	GetDueWebhookDeliveries(now time.Time, limit int) ([]*model.WebhookDelivery, error)
+	GetNextWebhookDelivery() (*model.WebhookDelivery, error)
+	UpdateWebhookDelivery(delivery *model.WebhookDelivery) error
+	GetWebhookDeliveries(webhookID uint, limit int, since uint) ([]*model.WebhookDelivery, error)
+	GetDeadWebhookDeliveriesByUser(userID uint, limit int, since uint) ([]*model.WebhookDelivery, error)
+	JudgeUserOwnsApplication(userID, appID uint) (bool, error)
+}
+
+// WebhookNotifier 把消息以 JSON POST 到用户注册的 webhook，失败时按指数退避重试，
+// 超过最大次数后放入死信列表。投递记录保存在数据库中，重启后继续投递
+type WebhookNotifier struct {
+	DB          WebhookDatabaseService
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration // 第一次重试前等待的时间，之后每次翻倍
+	wake        chan struct{}
+}
+
+func NewWebhookNotifier(db WebhookDatabaseService, client *http.Client, maxAttempts int, backoff time.Duration) *WebhookNotifier {
+	if maxAttempts < 1 || backoff <= 0 {
+		panic("the webhook attempts and backoff must be positive")
+	}
+	return &WebhookNotifier{DB: db, Client: client, MaxAttempts: maxAttempts, Backoff: backoff, wake: make(chan struct{}, 1)}
+}
+
+func (w *WebhookNotifier) Notify(userID uint, message *model.MessageExternal) {
+	webhooks, err := w.DB.GetEnabledWebhooks(userID)
+	if err != nil {
+		log.Printf("Failed to load the webhooks of user %d: %v", userID, err)
+		return
+	}
+	w.enqueue(webhooks, message)
+}
+
+func (w *WebhookNotifier) BroadcastNotify(message *model.MessageExternal) {
+	webhooks, err := w.DB.GetEnabledWebhooks(0)
+	if err != nil {
+		log.Printf("Failed to load webhooks: %v", err)
+		return
+	}
+	w.enqueue(webhooks, message)
+}
+
+// enqueue 为接收该消息的 webhook 创建投递记录，并唤醒投递协程
+func (w *WebhookNotifier) enqueue(webhooks []*model.Webhook, message *model.MessageExternal) {
+	var deliveries []*model.WebhookDelivery
+	var payload []byte
+	now := timeNow()
+	for _, webhook := range webhooks {
+		if !webhookAccepts(webhook, message) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(message); err != nil {
+				log.Printf("Failed to encode message %d for webhooks: %v", message.ID, err)
+				return
+			}
+		}
+		deliveries = append(deliveries, &model.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			MessageID:     message.ID,
+			Payload:       payload,
+			Status:        model.WebhookDeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		})
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	if err := w.DB.CreateWebhookDeliveries(deliveries); err != nil {
+		log.Printf("Failed to queue message %d for webhooks: %v", message.ID, err)
+		return
+	}
+	wake(w.wake)
+}
+
+func webhookAccepts(webhook *model.Webhook, message *model.MessageExternal) bool {
+	if webhook.ApplicationID != 0 && webhook.ApplicationID != message.ApplicationID {
+		return false
+	}
+	return message.Priority >= webhook.MinPriority
+}
+
+// Run 投递到期的 webhook 请求，直到 ctx 结束
+func (w *WebhookNotifier) Run(ctx context.Context) {
+	for {
+		w.deliverDue(ctx)
+		wait := maxWebhookWait
+		next, err := w.DB.GetNextWebhookDelivery()
+		if err != nil {
+			log.Printf("Failed to query webhook deliveries: %v", err)
+		} else if next != nil && next.NextAttemptAt != nil {
+			wait = max(min(next.NextAttemptAt.Sub(timeNow()), wait), 0)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-w.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (w *WebhookNotifier) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		due, err := w.DB.GetDueWebhookDeliveries(timeNow(), webhookBatchSize)
+		if err != nil {
+			log.Printf("Failed to query webhook deliveries: %v", err)
+			return
+		}
+		webhooks := make(map[uint]*model.Webhook)
+		for _, delivery := range due {
+			if _, ok := webhooks[delivery.WebhookID]; ok {
+				continue
+			}
+			webhook, err := w.DB.GetWebhookByID(delivery.WebhookID)
+			if err != nil {
+				log.Printf("Failed to load webhook %d: %v", delivery.WebhookID, err)
+				return
+			}
+			webhooks[delivery.WebhookID] = webhook
+		}
+		// 同一批次的请求并发发送，避免一个响应缓慢的接收方拖慢其它 webhook
+		var wg sync.WaitGroup
+		for _, delivery := range due {
+			wg.Add(1)
+			go func(delivery *model.WebhookDelivery) {
+				defer wg.Done()
+				w.attempt(ctx, webhooks[delivery.WebhookID], delivery)
+			}(delivery)
+		}
+		wg.Wait()
+		if len(due) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+// attempt 发送一次请求并记录结果
+func (w *WebhookNotifier) attempt(ctx context.Context, webhook *model.Webhook, delivery *model.WebhookDelivery) {
+	if webhook == nil {
+		// webhook 已被删除，投递记录会随之删除
+		return
+	}
+	now := timeNow()
+	if webhook.Disabled {
+		delivery.Status = model.WebhookDeliveryDead
+		delivery.NextAttemptAt = nil
+		delivery.LastError = "the webhook is disabled"
+	} else {
+		delivery.Attempts++
+		delivery.LastAttemptAt = &now
+		delivery.LastStatusCode, delivery.LastError = 0, ""
+		status, err := w.send(ctx, webhook, delivery)
+		delivery.LastStatusCode = status
+		switch {
+		case err == nil:
+			delivery.Status = model.WebhookDeliveryDelivered
+			delivery.NextAttemptAt = nil
+		case ctx.Err() != nil:
+			// 服务停止导致的失败不计入尝试次数
+			delivery.Attempts--
+			return
+		case delivery.Attempts >= w.MaxAttempts:
+			delivery.Status = model.WebhookDeliveryDead
+			delivery.NextAttemptAt = nil
+			delivery.LastError = err.Error()
+		default:
+			next := now.Add(w.backoff(delivery.Attempts))
+			delivery.NextAttemptAt = &next
+			delivery.LastError = err.Error()
+		}
+	}
+	if err := w.DB.UpdateWebhookDelivery(delivery); err != nil {
+		log.Printf("Failed to update webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// backoff 返回第 attempts 次失败后到下一次重试的等待时间
+func (w *WebhookNotifier) backoff(attempts int) time.Duration {
+	wait := w.Backoff
+	for i := 1; i < attempts && wait < maxWebhookBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxWebhookBackoff)
+}
+
+func (w *WebhookNotifier) send(ctx context.Context, webhook *model.Webhook, delivery *model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-notify")
+	req.Header.Set(signatureHeader, signPayload(webhook.Secret, delivery.Payload))
+	req.Header.Set(deliveryIDHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(webhookIDHeader, strconv.FormatUint(uint64(webhook.ID), 10))
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+	// 响应内容由接收方控制，可能包含内部服务的信息，不记录在投递记录中
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signPayload 返回 X-Signature 请求头的值
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retry 把死信重新放入投递队列
+func (w *WebhookNotifier) retry(delivery *model.WebhookDelivery) error {
+	now := timeNow()
+	delivery.Status = model.WebhookDeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = &now
+	if err := w.DB.UpdateWebhookDelivery(delivery); err != nil {
+		return err
+	}
+	wake(w.wake)
+	return nil
+}
+
+// WebhookService 管理当前用户的 webhook 及其投递记录
+type WebhookService struct {
+	DB       WebhookDatabaseService
+	Notifier *WebhookNotifier
+	Guard    *WebhookGuard // 拒绝指向内部网络的 webhook 地址
+}
+
+var errWebhookScheme = errors.New("the webhook url must use http or https")
+
+// 获取当前用户的所有 webhook
+func (s *WebhookService) GetWebhooks(ctx *gin.Context) {
+	webhooks, err := s.DB.GetWebhooksByUser(auth.GetUserID(ctx))
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+	if webhooks == nil {
+		webhooks = []*model.Webhook{}
+	}
+	ctx.JSON(http.StatusOK, webhooks)
+}
+
+// 创建 webhook，密钥由服务端生成
+func (s *WebhookService) CreateWebhook(ctx *gin.Context) {
+	webhook := model.Webhook{}
+	if err := ctx.Bind(&webhook); err != nil {
+		return
+	}
+	webhook.ID = 0
+	webhook.UserID = auth.GetUserID(ctx)
+	webhook.Secret = auth.GenerateWebhookSecret()
+	webhook.CreatedAt = timeNow()
+	if !s.validWebhook(ctx, &webhook) {
+		return
+	}
+	if success := successOrAbort(ctx, http.StatusInternalServerError, s.DB.CreateWebhook(&webhook)); !success {
+		return
+	}
+	ctx.JSON(http.StatusOK, webhook)
+}
+
+// 修改 webhook 的地址和过滤条件
+func (s *WebhookService) UpdateWebhook(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		webhook, ok := s.ownedWebhook(ctx, id)
+		if !ok {
+			return
+		}
+		newValues := model.Webhook{}
+		if err := ctx.Bind(&newValues); err != nil {
+			return
+		}
+		webhook.URL = newValues.URL
+		webhook.ApplicationID = newValues.ApplicationID
+		webhook.MinPriority = newValues.MinPriority
+		webhook.Disabled = newValues.Disabled
+		if !s.validWebhook(ctx, webhook) {
+			return
+		}
+		if success := successOrAbort(ctx, http.StatusInternalServerError, s.DB.UpdateWebhook(webhook)); !success {
+			return
+		}
+		ctx.JSON(http.StatusOK, webhook)
+	})
+}
+
+// 删除 webhook 及其投递记录
+func (s *WebhookService) DeleteWebhook(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		if _, ok := s.ownedWebhook(ctx, id); !ok {
+			return
+		}
+		successOrAbort(ctx, http.StatusInternalServerError, s.DB.DeleteWebhookByID(id))
+	})
+}
+
+// 重新生成 webhook 的密钥
+func (s *WebhookService) RotateWebhookSecret(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		webhook, ok := s.ownedWebhook(ctx, id)
+		if !ok {
+			return
+		}
+		webhook.Secret = auth.GenerateWebhookSecret()
+		if success := successOrAbort(ctx, http.StatusInternalServerError, s.DB.UpdateWebhook(webhook)); !success {
+			return
+		}
+		ctx.JSON(http.StatusOK, webhook)
+	})
+}
+
+// 获取 webhook 的投递记录，从新到旧排列
+func (s *WebhookService) GetWebhookDeliveries(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		if _, ok := s.ownedWebhook(ctx, id); !ok {
+			return
+		}
+		withPaging(ctx, func(params *pagingParams) {
+			deliveries, err := s.DB.GetWebhookDeliveries(id, params.Limit, params.Since)
+			if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+				return
+			}
+			respondWithDeliveries(ctx, deliveries)
+		})
+	})
+}
+
+// 获取当前用户所有 webhook 的死信，即重试次数用尽仍未投递成功的请求
+func (s *WebhookService) GetDeadLetters(ctx *gin.Context) {
+	withPaging(ctx, func(params *pagingParams) {
+		deliveries, err := s.DB.GetDeadWebhookDeliveriesByUser(auth.GetUserID(ctx), params.Limit, params.Since)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		respondWithDeliveries(ctx, deliveries)
+	})
+}
+
+// 把死信重新放入投递队列，重新计算尝试次数
+func (s *WebhookService) RetryWebhookDelivery(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		delivery, err := s.DB.GetWebhookDeliveryByID(id)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		if delivery == nil {
+			ctx.AbortWithError(http.StatusNotFound, fmt.Errorf("webhook delivery with id %d doesn't exists", id))
+			return
+		}
+		if _, ok := s.ownedWebhook(ctx, delivery.WebhookID); !ok {
+			return
+		}
+		if delivery.Status != model.WebhookDeliveryDead {
+			ctx.AbortWithError(http.StatusConflict, errors.New("only dead deliveries can be retried"))
+			return
+		}
+		if success := successOrAbort(ctx, http.StatusInternalServerError, s.Notifier.retry(delivery)); !success {
+			return
+		}
+		ctx.JSON(http.StatusOK, delivery)
+	})
+}
+
+func respondWithDeliveries(ctx *gin.Context, deliveries []*model.WebhookDelivery) {
+	if deliveries == nil {
+		deliveries = []*model.WebhookDelivery{}
+	}
+	ctx.JSON(http.StatusOK, deliveries)
+}
+
+func (s *WebhookService) ownedWebhook(ctx *gin.Context, id uint) (*model.Webhook, bool) {
+	webhook, err := s.DB.GetWebhookByID(id)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return nil, false
+	}
+	if webhook == nil || webhook.UserID != auth.GetUserID(ctx) {
+		ctx.AbortWithError(http.StatusNotFound, fmt.Errorf("webhook with id %d doesn't exists", id))
+		return nil, false
+	}
+	return webhook, true
+}
+
+// validWebhook 检查 webhook 的地址和过滤的应用，无效时中止请求
+func (s *WebhookService) validWebhook(ctx *gin.Context, webhook *model.Webhook) bool {
+	if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		ctx.AbortWithError(http.StatusBadRequest, errWebhookScheme)
+		return false
+	}
+	if err := s.Guard.CheckURL(ctx.Request.Context(), webhook.URL); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return false
+	}
+	if webhook.ApplicationID == 0 {
+		return true
+	}
+	owns, err := s.DB.JudgeUserOwnsApplication(webhook.UserID, webhook.ApplicationID)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return false
+	}
+	if !owns {
+		ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("application %d does not exist", webhook.ApplicationID))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/database"
+	"go-notify/model"
+)
+
+func newWebhookTestDatabase(t *testing.T) *database.GormDatabase {
+	db, err := database.NewGormDatabase(filepath.Join(t.TempDir(), "test.db"), "admin", "admin", 4)
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestWebhookNotifier_delivers(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	received := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{header: r.Header, body: body}
+	}))
+	defer server.Close()
+
+	webhook := &model.Webhook{UserID: 1, URL: server.URL, Secret: "secret", MinPriority: 3}
+	filtered := &model.Webhook{UserID: 1, URL: server.URL, Secret: "other", ApplicationID: 9}
+	disabled := &model.Webhook{UserID: 1, URL: server.URL, Secret: "other", Disabled: true}
+	require.NoError(t, db.CreateWebhook(webhook))
+	require.NoError(t, db.CreateWebhook(filtered))
+	require.NoError(t, db.CreateWebhook(disabled))
+	notifier := NewWebhookNotifier(db, server.Client(), 3, time.Second)
+
+	notifier.Notify(1, &model.MessageExternal{ID: 7, ApplicationID: 2, Message: "low", Priority: 2})
+	notifier.Notify(1, &model.MessageExternal{ID: 8, ApplicationID: 2, Message: "hello", Priority: 5})
+	notifier.Notify(2, &model.MessageExternal{ID: 9, ApplicationID: 2, Message: "other user", Priority: 5})
+	notifier.deliverDue(context.Background())
+
+	require.Len(t, received, 1)
+	req := <-received
+	assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+	assert.Equal(t, signPayload("secret", req.body), req.header.Get(signatureHeader))
+	assert.Equal(t, strconv.Itoa(int(webhook.ID)), req.header.Get(webhookIDHeader))
+	var message model.MessageExternal
+	require.NoError(t, json.Unmarshal(req.body, &message))
+	assert.Equal(t, uint(8), message.ID)
+	assert.Equal(t, "hello", message.Message)
+
+	deliveries, err := db.GetWebhookDeliveries(webhook.ID, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, req.header.Get(deliveryIDHeader), strconv.Itoa(int(deliveries[0].ID)))
+	assert.Equal(t, model.WebhookDeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusOK, deliveries[0].LastStatusCode)
+	assert.Nil(t, deliveries[0].NextAttemptAt)
+}
+
+func TestWebhookNotifier_retriesAndDeadLetters(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	webhook := &model.Webhook{UserID: 1, URL: server.URL, Secret: "secret"}
+	require.NoError(t, db.CreateWebhook(webhook))
+	notifier := NewWebhookNotifier(db, server.Client(), 3, time.Minute)
+	notifier.Notify(1, &model.MessageExternal{ID: 1, Message: "hello"})
+
+	notifier.deliverDue(context.Background())
+	delivery, err := db.GetWebhookDeliveryByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, model.WebhookDeliveryPending, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.LastStatusCode)
+	assert.Equal(t, "unexpected status 503", delivery.LastError, "the response body is not stored")
+	assert.True(t, now.Add(time.Minute).Equal(*delivery.NextAttemptAt))
+
+	// 还没到重试的时间
+	notifier.deliverDue(context.Background())
+	delivery, _ = db.GetWebhookDeliveryByID(1)
+	assert.Equal(t, 1, delivery.Attempts)
+
+	now = now.Add(time.Minute)
+	notifier.deliverDue(context.Background())
+	delivery, _ = db.GetWebhookDeliveryByID(1)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.True(t, now.Add(2*time.Minute).Equal(*delivery.NextAttemptAt), "backoff doubles")
+
+	now = now.Add(2 * time.Minute)
+	notifier.deliverDue(context.Background())
+	dead, err := db.GetDeadWebhookDeliveriesByUser(1, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Nil(t, dead[0].NextAttemptAt)
+	next, err := db.GetNextWebhookDelivery()
+	require.NoError(t, err)
+	assert.Nil(t, next)
+
+	failing.Store(false)
+	require.NoError(t, notifier.retry(dead[0]))
+	notifier.deliverDue(context.Background())
+	delivery, _ = db.GetWebhookDeliveryByID(1)
+	assert.Equal(t, model.WebhookDeliveryDelivered, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+
+	require.NoError(t, db.DeleteWebhookDeliveriesBefore(now.Add(time.Second)))
+	delivery, err = db.GetWebhookDeliveryByID(1)
+	require.NoError(t, err)
+	assert.Nil(t, delivery)
+}
+
+func TestWebhookNotifier_backoff(t *testing.T) {
+	notifier := NewWebhookNotifier(nil, nil, 10, 30*time.Second)
+	assert.Equal(t, 30*time.Second, notifier.backoff(1))
+	assert.Equal(t, time.Minute, notifier.backoff(2))
+	assert.Equal(t, 4*time.Minute, notifier.backoff(4))
+	assert.Equal(t, maxWebhookBackoff, notifier.backoff(20))
+}
+
+func TestWebhookGuard_CheckURL(t *testing.T) {
+	guard, err := NewWebhookGuard(nil)
+	require.NoError(t, err)
+	for _, url := range []string{"http://127.0.0.1/hook", "http://localhost:8080/hook", "http://[::1]/hook", "http://10.1.2.3/hook",
+		"https://192.168.0.10/hook", "http://169.254.169.254/latest/meta-data", "http://[fe80::1]/hook", "http://0.0.0.0/hook"} {
+		assert.Error(t, guard.CheckURL(context.Background(), url), url)
+	}
+	assert.NoError(t, guard.CheckURL(context.Background(), "https://93.184.216.34/hook"))
+
+	guard, err = NewWebhookGuard([]string{"LocalHost", "10.0.0.0/8"})
+	require.NoError(t, err)
+	assert.NoError(t, guard.CheckURL(context.Background(), "http://localhost:8080/hook"))
+	assert.NoError(t, guard.CheckURL(context.Background(), "http://10.1.2.3/hook"))
+	assert.Error(t, guard.CheckURL(context.Background(), "http://192.168.0.10/hook"))
+
+	_, err = NewWebhookGuard([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestWebhookService_rejectsInternalAddresses(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	guard, err := NewWebhookGuard(nil)
+	require.NoError(t, err)
+	service := &WebhookService{DB: db, Guard: guard}
+
+	recorder := performRequest(service.CreateWebhook, http.MethodPost, `{"url":"http://169.254.169.254/latest/meta-data"}`, 1, "", nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = performRequest(service.CreateWebhook, http.MethodPost, `{"url":"https://93.184.216.34/hook"}`, 1, "", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var webhook model.Webhook
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &webhook))
+
+	recorder = performRequest(service.UpdateWebhook, http.MethodPut, `{"url":"http://127.0.0.1:6379/"}`, 1, "", idParam(webhook.ID))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	stored, err := db.GetWebhookByID(webhook.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "https://93.184.216.34/hook", stored.URL)
+}
+
+func TestWebhookNotifier_connectsOnlyToAllowedAddresses(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+	// 创建后才解析到内部地址的 webhook 在连接时被拒绝
+	webhook := &model.Webhook{UserID: 1, URL: server.URL, Secret: "secret"}
+	require.NoError(t, db.CreateWebhook(webhook))
+
+	guard, err := NewWebhookGuard(nil)
+	require.NoError(t, err)
+	notifier := NewWebhookNotifier(db, guard.Client(time.Second), 3, time.Minute)
+	notifier.Notify(1, &model.MessageExternal{ID: 1, Message: "hello"})
+	notifier.deliverDue(context.Background())
+	delivery, err := db.GetWebhookDeliveryByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, model.WebhookDeliveryPending, delivery.Status)
+	assert.Contains(t, delivery.LastError, "internal address")
+	assert.Zero(t, requests.Load())
+
+	guard, err = NewWebhookGuard([]string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	notifier = NewWebhookNotifier(db, guard.Client(time.Second), 3, time.Minute)
+	require.NoError(t, notifier.retry(delivery))
+	notifier.deliverDue(context.Background())
+	delivery, _ = db.GetWebhookDeliveryByID(1)
+	assert.Equal(t, model.WebhookDeliveryDelivered, delivery.Status)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestWebhookNotifier_doesNotFollowRedirects(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	var redirected atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hook", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/internal", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/internal", func(w http.ResponseWriter, r *http.Request) {
+		redirected.Store(true)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	webhook := &model.Webhook{UserID: 1, URL: server.URL + "/hook", Secret: "secret"}
+	require.NoError(t, db.CreateWebhook(webhook))
+
+	guard, err := NewWebhookGuard([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	notifier := NewWebhookNotifier(db, guard.Client(time.Second), 3, time.Minute)
+	notifier.Notify(1, &model.MessageExternal{ID: 1, Message: "hello"})
+	notifier.deliverDue(context.Background())
+	delivery, err := db.GetWebhookDeliveryByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, model.WebhookDeliveryPending, delivery.Status)
+	assert.Equal(t, http.StatusTemporaryRedirect, delivery.LastStatusCode)
+	assert.False(t, redirected.Load(), "redirects are not followed")
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WebhookGuard 阻止 webhook 和 Web Push 请求访问服务器所在的内部网络：解析到回环、链路本地、私有等地址的主机默认不允许访问，
+// 管理员可以放行部分主机或网段。创建 webhook 或推送订阅时检查地址，发送请求时检查实际连接的地址，避免 DNS 解析结果改变后绕过检查
+type WebhookGuard struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+// NewWebhookGuard 创建 WebhookGuard，allowed 中的每一项是允许访问的主机名、IP 地址或 CIDR 网段
+func NewWebhookGuard(allowed []string) (*WebhookGuard, error) {
+	g := &WebhookGuard{hosts: make(map[string]bool)}
+	for _, entry := range allowed {
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			g.networks = append(g.networks, network)
+			continue
+		}
+		g.hosts[strings.ToLower(entry)] = true
+	}
+	return g, nil
+}
+
+// Client 返回发送 webhook 和推送请求的 HTTP 客户端：只连接允许访问的地址，不使用代理，也不跟随重定向，
+// 重定向的响应按失败处理
+func (g *WebhookGuard) Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: g.dialContext, TLSHandshakeTimeout: timeout},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (g *WebhookGuard) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	if !g.hosts[strings.ToLower(host)] {
+		// address 是解析后的 IP 地址和端口
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return g.checkIP(net.ParseIP(ip))
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// CheckURL 解析地址的主机，解析出的任何一个地址不允许访问时返回错误
+func (g *WebhookGuard) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if g.hosts[strings.ToLower(host)] {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return g.checkIP(ip)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("the host %q cannot be resolved", host)
+	}
+	for _, addr := range addrs {
+		if err := g.checkIP(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *WebhookGuard) checkIP(ip net.IP) error {
+	if ip == nil {
+		return errors.New("invalid address")
+	}
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("requests must not be sent to the internal address %s", ip)
+	}
+	return nil
+}
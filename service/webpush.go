@@ -0,0 +1,467 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-notify/auth"
+	"go-notify/model"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	json "github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// pushRecordSize 加密内容的记录大小，整个消息只有一条记录
+	pushRecordSize = 4096
+	// maxPushPayload 推送服务至少支持 4096 字节的请求体，减去头部（86 字节）、认证标签（16 字节）和分隔符（1 字节）
+	maxPushPayload = pushRecordSize - 86 - 16 - 1
+	// vapidTokenLifetime VAPID 令牌的有效期，RFC 8292 规定不能超过 24 小时
+	vapidTokenLifetime = 12 * time.Hour
+	// maxPushResponse 读取的响应内容的最大字节数，只用于记录错误
+	maxPushResponse = 512
+	// webPushWorkers 同时发送推送的协程数
+	webPushWorkers = 4
+	// webPushQueueSize 等待发送的推送数，队列满时丢弃新的推送
+	webPushQueueSize = 1000
+)
+
+type WebPushDatabaseService interface {
+	GetVAPIDKey() (*model.VAPIDKey, error)
+	CreateVAPIDKey(key *model.VAPIDKey) error
+	GetClientByID(id uint) (*model.Client, error)
+	SaveWebPushSubscription(subscription *model.WebPushSubscription) error
+	GetWebPushSubscriptionByClient(clientID uint) (*model.WebPushSubscription, error)
+	GetWebPushSubscriptions(userID uint) ([]*model.WebPushSubscription, error)
+	DeleteWebPushSubscriptionByID(id uint) error
+	DeleteWebPushSubscriptionByClient(clientID uint) error
+}
+
+// VAPIDKey 是服务器向推送服务证明身份的密钥（RFC 8292）
+type VAPIDKey struct {
+	private *ecdsa.PrivateKey
+	// PublicKey 是未压缩的公钥，浏览器订阅时作为 applicationServerKey
+	PublicKey []byte
+}
+
+// LoadVAPIDKey 读取数据库中的 VAPID 密钥，第一次启动时生成并保存
+func LoadVAPIDKey(db WebPushDatabaseService) (*VAPIDKey, error) {
+	stored, err := db.GetVAPIDKey()
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newVAPIDKey(private)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		stored = &model.VAPIDKey{
+			PrivateKey: base64.StdEncoding.EncodeToString(der),
+			PublicKey:  base64.RawURLEncoding.EncodeToString(key.PublicKey),
+		}
+		if err := db.CreateVAPIDKey(stored); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	der, err := base64.StdEncoding.DecodeString(stored.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || private.Curve != elliptic.P256() {
+		return nil, errors.New("the stored VAPID key is not a P-256 key")
+	}
+	return newVAPIDKey(private)
+}
+
+func newVAPIDKey(private *ecdsa.PrivateKey) (*VAPIDKey, error) {
+	public, err := private.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return &VAPIDKey{private: private, PublicKey: public.Bytes()}, nil
+}
+
+// authorization 返回推送请求的 Authorization 请求头，令牌的 aud 是推送服务的源
+func (k *VAPIDKey) authorization(endpoint, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidTokenLifetime).Unix(),
+	}
+	if subject != "" {
+		claims["sub"] = subject
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS 的 ES256 签名是定长的 r || s
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(signature) +
+		", k=" + base64.RawURLEncoding.EncodeToString(k.PublicKey), nil
+}
+
+// WebPushNotifier 通过浏览器的推送服务（RFC 8030）发送消息，网页应用没有打开时也能收到通知。
+// 推送由 Run 启动的固定数量的协程发送，推送服务返回 404 或 410 时订阅已经失效，会被删除
+type WebPushNotifier struct {
+	DB     WebPushDatabaseService
+	Client *http.Client
+	Key    *VAPIDKey
+	// Subject 是推送服务联系服务器管理员的 mailto: 或 https: 地址
+	Subject string
+	queue   chan webPushJob
+}
+
+type webPushJob struct {
+	subscription *model.WebPushSubscription
+	payload      []byte
+	messageID    uint
+	priority     int
+}
+
+func NewWebPushNotifier(db WebPushDatabaseService, client *http.Client, key *VAPIDKey, subject string) *WebPushNotifier {
+	return &WebPushNotifier{DB: db, Client: client, Key: key, Subject: subject, queue: make(chan webPushJob, webPushQueueSize)}
+}
+
+// Run 发送队列中的推送直到 ctx 结束
+func (w *WebPushNotifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < webPushWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-w.queue:
+					if err := w.push(job.subscription, job.payload, job.priority); err != nil {
+						log.Printf("Failed to push message %d to client %d: %v", job.messageID, job.subscription.ClientID, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (w *WebPushNotifier) Notify(userID uint, message *model.MessageExternal) {
+	w.pushToSubscriptions(userID, message)
+}
+
+func (w *WebPushNotifier) BroadcastNotify(message *model.MessageExternal) {
+	w.pushToSubscriptions(0, message)
+}
+
+func (w *WebPushNotifier) pushToSubscriptions(userID uint, message *model.MessageExternal) {
+	subscriptions, err := w.DB.GetWebPushSubscriptions(userID)
+	if err != nil {
+		log.Printf("Failed to load web push subscriptions: %v", err)
+		return
+	}
+	if len(subscriptions) == 0 {
+		return
+	}
+	payload, err := pushPayload(message)
+	if err != nil {
+		log.Printf("Failed to encode message %d for web push: %v", message.ID, err)
+		return
+	}
+	for _, subscription := range subscriptions {
+		// 推送服务可能很慢，不阻塞消息的创建
+		select {
+		case w.queue <- webPushJob{subscription: subscription, payload: payload, messageID: message.ID, priority: message.Priority}:
+		default:
+			log.Printf("Dropping the push of message %d to client %d, too many pushes are pending", message.ID, subscription.ClientID)
+		}
+	}
+}
+
+func (w *WebPushNotifier) push(subscription *model.WebPushSubscription, payload []byte, priority int) error {
+	uaPublic, err := decodePushKey(subscription.Keys.P256dh)
+	if err != nil {
+		return err
+	}
+	authSecret, err := decodePushKey(subscription.Keys.Auth)
+	if err != nil {
+		return err
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	body, err := encryptPushPayload(uaPublic, authSecret, asKey, salt, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := w.Key.authorization(subscription.Endpoint, w.Subject, timeNow())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	urgency, ttl := pushUrgency(priority)
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(ttl.Seconds())))
+	req.Header.Set("Urgency", urgency)
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// 订阅已过期或被用户取消
+		log.Printf("Removing the expired web push subscription of client %d", subscription.ClientID)
+		return w.DB.DeleteWebPushSubscriptionByID(subscription.ID)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		content, _ := io.ReadAll(io.LimitReader(resp.Body, maxPushResponse))
+		return fmt.Errorf("push service responded with %d: %s", resp.StatusCode, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+// pushUrgency 按消息优先级决定推送的紧急程度和推送服务保留消息的时间，
+// 低优先级的消息对电量更友好，过期后不再投递
+func pushUrgency(priority int) (string, time.Duration) {
+	switch {
+	case priority <= 0:
+		return "very-low", time.Hour
+	case priority <= 3:
+		return "low", 12 * time.Hour
+	case priority <= 7:
+		return "normal", 24 * time.Hour
+	default:
+		return "high", 4 * 24 * time.Hour
+	}
+}
+
+// pushPayload 把消息编码为 JSON，超出推送服务的大小限制时先去掉 extras，再截断消息内容
+func pushPayload(message *model.MessageExternal) ([]byte, error) {
+	payload, err := json.Marshal(message)
+	if err != nil || len(payload) <= maxPushPayload {
+		return payload, err
+	}
+	trimmed := *message
+	trimmed.Extras = nil
+	for {
+		payload, err = json.Marshal(&trimmed)
+		if err != nil || len(payload) <= maxPushPayload {
+			return payload, err
+		}
+		if trimmed.Message == "" {
+			return nil, fmt.Errorf("the message is %d bytes larger than a push payload", len(payload)-maxPushPayload)
+		}
+		// 每个字节编码后至少占一个字节，去掉超出的字节数后最多再循环几次
+		cut := max(len(trimmed.Message)-(len(payload)-maxPushPayload), 0)
+		for cut > 0 && !utf8.RuneStart(trimmed.Message[cut]) {
+			cut--
+		}
+		trimmed.Message = trimmed.Message[:cut]
+	}
+}
+
+// encryptPushPayload 按 RFC 8291 加密推送内容，使用 aes128gcm 内容编码（RFC 8188），整个消息是一条记录
+func encryptPushPayload(uaPublicBytes, authSecret []byte, asKey *ecdh.PrivateKey, salt, plaintext []byte) ([]byte, error) {
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := asKey.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublicBytes...), asPublic...)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, authSecret, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, 21+len(asPublic)+len(plaintext)+1+gcm.Overhead())
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, pushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	// 0x02 标记最后一条记录，不添加填充。plaintext 可能被多个订阅共用，不能在其后追加
+	record := make([]byte, len(plaintext)+1)
+	copy(record, plaintext)
+	record[len(plaintext)] = 0x02
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// decodePushKey 解码浏览器提供的 base64url 密钥，兼容带填充的写法
+func decodePushKey(key string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+}
+
+// validPushSubscription 检查订阅的地址不指向内部网络，并且密钥能用于加密
+func validPushSubscription(ctx context.Context, guard *WebhookGuard, subscription *model.WebPushSubscription) error {
+	u, err := url.Parse(subscription.Endpoint)
+	if err != nil || u.Scheme != "https" {
+		return errors.New("the endpoint must be a https url")
+	}
+	if err := guard.CheckURL(ctx, subscription.Endpoint); err != nil {
+		return err
+	}
+	p256dh, err := decodePushKey(subscription.Keys.P256dh)
+	if err != nil {
+		return errors.New("p256dh is not base64url encoded")
+	}
+	if _, err := ecdh.P256().NewPublicKey(p256dh); err != nil {
+		return errors.New("p256dh is not an uncompressed P-256 public key")
+	}
+	authSecret, err := decodePushKey(subscription.Keys.Auth)
+	if err != nil || len(authSecret) != 16 {
+		return errors.New("auth must be 16 base64url encoded bytes")
+	}
+	return nil
+}
+
+// WebPushService 管理客户端的推送订阅
+type WebPushService struct {
+	DB    WebPushDatabaseService
+	Key   *VAPIDKey
+	Guard *WebhookGuard // 拒绝指向内部网络的推送地址
+}
+
+// 获取服务器的 VAPID 公钥，浏览器订阅时作为 applicationServerKey
+func (s *WebPushService) GetVAPIDPublicKey(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"publicKey": base64.RawURLEncoding.EncodeToString(s.Key.PublicKey)})
+}
+
+// 获取客户端的推送订阅
+func (s *WebPushService) GetWebPushSubscription(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		if !s.ownsClient(ctx, id) {
+			return
+		}
+		subscription, err := s.DB.GetWebPushSubscriptionByClient(id)
+		if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+			return
+		}
+		if subscription == nil {
+			ctx.AbortWithError(http.StatusNotFound, fmt.Errorf("client with id %d has no web push subscription", id))
+			return
+		}
+		ctx.JSON(http.StatusOK, subscription)
+	})
+}
+
+// 为客户端注册推送订阅，替换之前的订阅
+func (s *WebPushService) RegisterWebPushSubscription(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		if !s.ownsClient(ctx, id) {
+			return
+		}
+		subscription := &model.WebPushSubscription{}
+		if err := ctx.Bind(subscription); err != nil {
+			return
+		}
+		if err := validPushSubscription(ctx.Request.Context(), s.Guard, subscription); err != nil {
+			ctx.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		subscription.ID = 0
+		subscription.ClientID = id
+		subscription.UserID = auth.GetUserID(ctx)
+		subscription.CreatedAt = timeNow()
+		if success := successOrAbort(ctx, http.StatusInternalServerError, s.DB.SaveWebPushSubscription(subscription)); !success {
+			return
+		}
+		ctx.JSON(http.StatusOK, subscription)
+	})
+}
+
+// 删除客户端的推送订阅
+func (s *WebPushService) DeleteWebPushSubscription(ctx *gin.Context) {
+	withIntegerParam(ctx, "id", func(id uint) {
+		if !s.ownsClient(ctx, id) {
+			return
+		}
+		successOrAbort(ctx, http.StatusInternalServerError, s.DB.DeleteWebPushSubscriptionByClient(id))
+	})
+}
+
+// ownsClient 判断客户端是否属于当前用户，不存在或无权限时中止请求
+func (s *WebPushService) ownsClient(ctx *gin.Context, id uint) bool {
+	client, err := s.DB.GetClientByID(id)
+	if success := successOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return false
+	}
+	if client == nil || client.UserID != auth.GetUserID(ctx) {
+		ctx.AbortWithError(http.StatusNotFound, fmt.Errorf("client with id %d doesn't exists", id))
+		return false
+	}
+	return true
+}
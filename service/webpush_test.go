@@ -0,0 +1,260 @@
+package service
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/bytedance/sonic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-notify/model"
+)
+
+func decodeB64(t *testing.T, s string) []byte {
+	b, err := decodePushKey(s)
+	require.NoError(t, err)
+	return b
+}
+
+// 加密的示例来自 RFC 8291 第 5 节
+func TestEncryptPushPayload_rfc8291Example(t *testing.T) {
+	asKey, err := ecdh.P256().NewPrivateKey(decodeB64(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	require.NoError(t, err)
+	body, err := encryptPushPayload(
+		decodeB64(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"),
+		decodeB64(t, "BTBZMqHH6r4Tts7J_aSIgg"),
+		asKey,
+		decodeB64(t, "DGv6ra1nlYgDCS1FRnbzlw"),
+		[]byte("When I grow up, I want to be a watermelon"))
+	require.NoError(t, err)
+	assert.Equal(t, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN",
+		base64.RawURLEncoding.EncodeToString(body))
+}
+
+// decryptPushPayload 以浏览器的身份解密推送内容
+func decryptPushPayload(t *testing.T, uaKey *ecdh.PrivateKey, authSecret, body []byte) []byte {
+	salt := body[:16]
+	assert.Equal(t, uint32(pushRecordSize), binary.BigEndian.Uint32(body[16:20]))
+	idLen := int(body[20])
+	asPublic, err := ecdh.P256().NewPublicKey(body[21 : 21+idLen])
+	require.NoError(t, err)
+	shared, err := uaKey.ECDH(asPublic)
+	require.NoError(t, err)
+	keyInfo := "WebPush: info\x00" + string(uaKey.PublicKey().Bytes()) + string(asPublic.Bytes())
+	ikm, err := hkdf.Key(sha256.New, shared, authSecret, keyInfo, 32)
+	require.NoError(t, err)
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	require.NoError(t, err)
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(cek)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	record, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x02), record[len(record)-1])
+	return record[:len(record)-1]
+}
+
+// verifyVAPID 检查 Authorization 请求头中的令牌由服务器的 VAPID 密钥签名，返回令牌的声明
+func verifyVAPID(t *testing.T, key *VAPIDKey, header string) map[string]interface{} {
+	require.True(t, strings.HasPrefix(header, "vapid t="), header)
+	token, k, ok := strings.Cut(strings.TrimPrefix(header, "vapid t="), ", k=")
+	require.True(t, ok)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(key.PublicKey), k)
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	signature := decodeB64(t, parts[2])
+	require.Len(t, signature, 64)
+	x, y := elliptic.Unmarshal(elliptic.P256(), key.PublicKey)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.True(t, ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest[:],
+		new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])))
+	claims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(decodeB64(t, parts[1]), &claims))
+	return claims
+}
+
+type pushRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func TestWebPushNotifier_pushes(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	key, err := LoadVAPIDKey(db)
+	require.NoError(t, err)
+	reloaded, err := LoadVAPIDKey(db)
+	require.NoError(t, err)
+	assert.Equal(t, key.PublicKey, reloaded.PublicKey, "the key is generated once")
+
+	received := make(chan pushRequest, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		received <- pushRequest{header: r.Header, body: body}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authSecret := []byte("0123456789abcdef")
+	active := &model.WebPushSubscription{ClientID: 1, UserID: 1, Endpoint: server.URL + "/active", Keys: model.WebPushKeys{
+		P256dh: base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+		Auth:   base64.URLEncoding.EncodeToString(authSecret),
+	}}
+	gone := &model.WebPushSubscription{ClientID: 2, UserID: 1, Endpoint: server.URL + "/gone", Keys: active.Keys}
+	require.NoError(t, db.SaveWebPushSubscription(active))
+	require.NoError(t, db.SaveWebPushSubscription(gone))
+
+	notifier := NewWebPushNotifier(db, server.Client(), key, "mailto:admin@example.com")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+	notifier.Notify(2, &model.MessageExternal{ID: 1, Message: "other user"})
+	notifier.Notify(1, &model.MessageExternal{ID: 2, Title: "Backup", Message: "done", Priority: 8})
+
+	var req pushRequest
+	select {
+	case req = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no push received")
+	}
+	assert.Equal(t, "aes128gcm", req.header.Get("Content-Encoding"))
+	assert.Equal(t, "high", req.header.Get("Urgency"))
+	assert.Equal(t, "345600", req.header.Get("TTL"))
+	claims := verifyVAPID(t, key, req.header.Get("Authorization"))
+	assert.Equal(t, server.URL, claims["aud"])
+	assert.Equal(t, "mailto:admin@example.com", claims["sub"])
+
+	var message model.MessageExternal
+	require.NoError(t, json.Unmarshal(decryptPushPayload(t, uaKey, authSecret, req.body), &message))
+	assert.Equal(t, uint(2), message.ID)
+	assert.Equal(t, "done", message.Message)
+
+	require.Eventually(t, func() bool {
+		subscription, err := db.GetWebPushSubscriptionByClient(2)
+		return err == nil && subscription == nil
+	}, 5*time.Second, 10*time.Millisecond, "the gone subscription is removed")
+	subscription, err := db.GetWebPushSubscriptionByClient(1)
+	require.NoError(t, err)
+	assert.NotNil(t, subscription)
+	assert.Empty(t, received)
+}
+
+func TestWebPushNotifier_guardedClient(t *testing.T) {
+	db := newWebhookTestDatabase(t)
+	key, err := LoadVAPIDKey(db)
+	require.NoError(t, err)
+	var hits []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/active", http.StatusTemporaryRedirect)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	subscription := &model.WebPushSubscription{ClientID: 1, UserID: 1, Endpoint: server.URL + "/active", Keys: model.WebPushKeys{
+		P256dh: base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+		Auth:   base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef")),
+	}}
+
+	guard, err := NewWebhookGuard(nil)
+	require.NoError(t, err)
+	notifier := NewWebPushNotifier(db, guard.Client(5*time.Second), key, "")
+	err = notifier.push(subscription, []byte("{}"), 5)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "internal address")
+	assert.Empty(t, hits, "the internal push service is not contacted")
+
+	guard, err = NewWebhookGuard([]string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	client := guard.Client(5 * time.Second)
+	client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	notifier = NewWebPushNotifier(db, client, key, "")
+	subscription.Endpoint = server.URL + "/redirect"
+	assert.Error(t, notifier.push(subscription, []byte("{}"), 5), "redirects are failures")
+	assert.Equal(t, []string{"/redirect"}, hits, "redirects are not followed")
+}
+
+func TestPushPayload_trimsLargeMessages(t *testing.T) {
+	message := &model.MessageExternal{
+		ID:      1,
+		Title:   "large",
+		Message: strings.Repeat("ä", maxPushPayload),
+		Extras:  map[string]interface{}{"client::display": map[string]interface{}{"contentType": "text/markdown"}},
+	}
+	payload, err := pushPayload(message)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(payload), maxPushPayload)
+	var decoded model.MessageExternal
+	require.NoError(t, json.Unmarshal(payload, &decoded))
+	assert.Nil(t, decoded.Extras)
+	assert.True(t, strings.HasPrefix(message.Message, decoded.Message))
+	assert.Greater(t, len(decoded.Message), maxPushPayload/2)
+	assert.NotNil(t, message.Extras, "the original message is not modified")
+
+	small := &model.MessageExternal{ID: 2, Message: "small", Extras: message.Extras}
+	payload, err = pushPayload(small)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(payload, &decoded))
+	assert.Equal(t, "small", decoded.Message)
+	assert.NotNil(t, decoded.Extras)
+}
+
+func TestPushUrgency(t *testing.T) {
+	for priority, expected := range map[int]string{0: "very-low", 2: "low", 5: "normal", 8: "high", 10: "high"} {
+		urgency, _ := pushUrgency(priority)
+		assert.Equal(t, expected, urgency, "priority %d", priority)
+	}
+}
+
+func TestValidPushSubscription(t *testing.T) {
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	valid := model.WebPushSubscription{Endpoint: "https://push.example.com/abc", Keys: model.WebPushKeys{
+		P256dh: base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+		Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+	}}
+	guard, err := NewWebhookGuard([]string{"push.example.com"})
+	require.NoError(t, err)
+	assert.NoError(t, validPushSubscription(context.Background(), guard, &valid))
+
+	insecure := valid
+	insecure.Endpoint = "http://push.example.com/abc"
+	assert.Error(t, validPushSubscription(context.Background(), guard, &insecure))
+	badKey := valid
+	badKey.Keys.P256dh = base64.RawURLEncoding.EncodeToString(make([]byte, 65))
+	assert.Error(t, validPushSubscription(context.Background(), guard, &badKey))
+	internal := valid
+	internal.Endpoint = "https://127.0.0.1/abc"
+	assert.Error(t, validPushSubscription(context.Background(), guard, &internal), "internal addresses are rejected")
+	badAuth := valid
+	badAuth.Keys.Auth = "c2hvcnQ"
+	assert.Error(t, validPushSubscription(context.Background(), guard, &badAuth))
+}